@@ -2,11 +2,16 @@ package main
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/dedis/protobuf"
 	"github.com/eliasmpw/Peerster/common"
 	"github.com/eliasmpw/Peerster/gossiper"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
 	"strings"
 )
 
@@ -14,18 +19,70 @@ const HOP_LIMIT = 10
 
 func main() {
 	// Load values passed via flags
+	uiHost := flag.String("UIHost", "127.0.0.1", "Host or IP of the gossiper UI")
 	uiPort := flag.String("UIPort", "8080", "Port for the UI client");
 	msg := flag.String("msg", "", "Message to be sent");
 	dest := flag.String("dest", "", "Destination for the private message")
-	file := flag.String("file", "", "File to be indexed by the gossiper")
+	file := flag.String("file", "", "File or folder to be indexed by the gossiper")
 	request := flag.String("request", "", "Request a chunk or metafile of this hash")
 	keywords := flag.String("keywords", "", "Keywords for file search")
 	budget := flag.Int64("budget", 2, "Budget for search query messages")
+	topic := flag.String("topic", "", "Topic of the message to be gossiped")
+	group := flag.String("group", "", "Group to send the message to, or to create when there is no message")
+	members := flag.String("members", "", "Comma separated names of the members of the group")
+	downloads := flag.Bool("downloads", false, "List the downloads of the gossiper and their progress")
+	pause := flag.String("pause", "", "Pause the download of the file with this metafile hash")
+	resume := flag.String("resume", "", "Resume the download of the file with this metafile hash")
+	cancel := flag.String("cancel", "", "Cancel the download of the file with this metafile hash")
+	unshare := flag.String("unshare", "", "Stop sharing the file or folder with this metafile hash")
+	scrub := flag.Bool("scrub", false, "Check every chunk of the gossiper against its hash and quarantine the corrupt ones")
+	repair := flag.Bool("repair", false, "With scrub, repair the files that lost chunks")
 	flag.Parse()
+
+	// Downloads and shared files are managed over the HTTP API of the gossiper, served on the same port
+	guiAddress := "http://" + net.JoinHostPort(*uiHost, *uiPort)
+	if *downloads {
+		listDownloads(guiAddress)
+		return
+	}
+	if *pause != "" {
+		postHash(guiAddress+"/download/pause", *pause)
+		return
+	}
+	if *resume != "" {
+		postHash(guiAddress+"/download/resume", *resume)
+		return
+	}
+	if *cancel != "" {
+		postHash(guiAddress+"/download/cancel", *cancel)
+		return
+	}
+	if *unshare != "" {
+		postHash(guiAddress+"/unshareFile", *unshare)
+		return
+	}
+	if *scrub {
+		scrubChunks(guiAddress, *repair)
+		return
+	}
+
 	// Create packet to send
 	var packetToSend = gossiper.GossipPacket{}
 
-	if *msg == "" {
+	if *group != "" {
+		// If it is a group message, or the creation of a group
+		groupToSend := gossiper.GroupMessage{
+			Group:    *group,
+			Text:     *msg,
+			HopLimit: HOP_LIMIT,
+		}
+		if *members != "" {
+			groupToSend.Members = strings.Split(*members, ",")
+		}
+		packetToSend = gossiper.GossipPacket{
+			Group: &groupToSend,
+		}
+	} else if *msg == "" {
 		// If there is no message
 		if *file != "" && *dest != "" && *request != "" {
 			// If it is a download request
@@ -63,6 +120,14 @@ func main() {
 			}
 
 		}
+	} else if *topic != "" {
+		// If it is a gossip with a topic
+		packetToSend = gossiper.GossipPacket{
+			Rumor: &gossiper.RumorMessage{
+				Text:  *msg,
+				Topic: *topic,
+			},
+		}
 	} else if *dest == "" {
 		// If it is a gossip
 		simpleToSend := gossiper.SimpleMessage{
@@ -90,10 +155,71 @@ func main() {
 	// Send packet
 	content, err := protobuf.Encode(&packetToSend)
 	common.CheckError(err)
-	addressToSend, err := net.ResolveUDPAddr("udp4", "127.0.0.1:"+*uiPort)
+	addressToSend, err := net.ResolveUDPAddr("udp", net.JoinHostPort(*uiHost, *uiPort))
 	common.CheckError(err)
-	udpConnection, err := net.DialUDP("udp4", nil, addressToSend)
+	udpConnection, err := net.DialUDP("udp", nil, addressToSend)
 	common.CheckError(err)
 	udpConnection.Write(content)
 	udpConnection.Close()
 }
+
+// Print the downloads of the gossiper, one per line
+func listDownloads(guiAddress string) {
+	response, err := http.Get(guiAddress + "/download")
+	common.CheckError(err)
+	defer response.Body.Close()
+	var downloads []gossiper.DownloadInfo
+	common.CheckError(json.NewDecoder(response.Body).Decode(&downloads))
+	for _, download := range downloads {
+		line := fmt.Sprintf("%s %s %s %d/%d chunks %.0f B/s", download.Hash, download.FileName,
+			download.Status, download.Chunks, download.TotalChunks, download.BytesPerSecond)
+		if download.TotalFiles > 0 {
+			line += fmt.Sprintf(" %d/%d files", download.Files, download.TotalFiles)
+		}
+		if len(download.Sources) > 0 {
+			line += " from " + strings.Join(download.Sources, ",")
+		}
+		if download.Error != "" {
+			line += " error: " + download.Error
+		}
+		fmt.Println(line)
+	}
+}
+
+// Post a metafile hash to a control endpoint, exits with an error if it was refused
+func postHash(url, hash string) {
+	response, err := http.Post(url, "text/plain", strings.NewReader(hash))
+	common.CheckError(err)
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		fmt.Fprint(os.Stderr, string(message))
+		os.Exit(1)
+	}
+}
+
+// Scrub the chunks of the gossiper and print what was found
+func scrubChunks(guiAddress string, repair bool) {
+	body := ""
+	if repair {
+		body = "repair"
+	}
+	response, err := http.Post(guiAddress+"/scrub", "text/plain", strings.NewReader(body))
+	common.CheckError(err)
+	defer response.Body.Close()
+	var report gossiper.ScrubReport
+	common.CheckError(json.NewDecoder(response.Body).Decode(&report))
+	fmt.Printf("%d chunks checked, %d corrupt\n", report.Chunks, len(report.Corrupt))
+	for _, hash := range report.Corrupt {
+		fmt.Println("corrupt " + hash)
+	}
+	for _, name := range report.Damaged {
+		fmt.Println("damaged " + name)
+	}
+	for _, name := range report.Repaired {
+		fmt.Println("repaired " + name)
+	}
+	for _, name := range report.Downloading {
+		fmt.Println("downloading again " + name)
+	}
+}
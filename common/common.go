@@ -11,15 +11,15 @@ import (
 
 const BUFFER_SIZE = 65535
 
-// Create a UDP connection
-func StartLocalConnection(port string) (portString string, udpConn *net.UDPConn) {
+// Create a UDP connection bound to host, which can be a hostname, an IPv4 or an IPv6 literal
+func StartLocalConnection(host, port string) (portString string, udpConn *net.UDPConn) {
 	var udpAddr *net.UDPAddr
 	var err error
 	successful := false
 	for !successful {
-		udpAddr, err = net.ResolveUDPAddr("udp4", "127.0.0.1:"+port)
+		udpAddr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
 		CheckError(err)
-		udpConn, err = net.ListenUDP("udp4", udpAddr)
+		udpConn, err = net.ListenUDP("udp", udpAddr)
 		if err == nil {
 			successful = true
 		} else {
@@ -31,6 +31,16 @@ func StartLocalConnection(port string) (portString string, udpConn *net.UDPConn)
 	return port, udpConn
 }
 
+// Resolve an address of the form host:port to the canonical string used in the peers list
+// and routing table, e.g. localhost:5000 becomes 127.0.0.1:5000 and [0:0::1]:5000 becomes [::1]:5000
+func CanonicalAddress(address string) (string, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return "", err
+	}
+	return udpAddr.String(), nil
+}
+
 // Check Error
 func CheckError(e error) {
 	if e != nil {
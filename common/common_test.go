@@ -0,0 +1,40 @@
+package common
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCanonicalAddress(t *testing.T) {
+	for address, canonical := range map[string]string{
+		"127.0.0.1:5000":     "127.0.0.1:5000",
+		"localhost:5000":     "127.0.0.1:5000",
+		"[::1]:5000":         "[::1]:5000",
+		"[0:0::1]:5000":      "[::1]:5000",
+		"[fe80:0::0:1]:5000": "[fe80::1]:5000",
+	} {
+		result, err := CanonicalAddress(address)
+		if err != nil || result != canonical {
+			t.Errorf("%s canonical as %q: %v", address, result, err)
+		}
+	}
+	for _, address := range []string{"127.0.0.1", "::1:5000", "[::1]", "127.0.0.1:port"} {
+		if _, err := CanonicalAddress(address); err == nil {
+			t.Errorf("invalid address %s accepted", address)
+		}
+	}
+}
+
+func TestStartLocalConnectionOnIPv6(t *testing.T) {
+	probe, err := net.ListenPacket("udp", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback: ", err)
+	}
+	probe.Close()
+	port, conn := StartLocalConnection("::1", "0")
+	defer conn.Close()
+	address := conn.LocalAddr().(*net.UDPAddr)
+	if !address.IP.Equal(net.IPv6loopback) || port != "0" {
+		t.Fatalf("bound to %s with port %s", address, port)
+	}
+}
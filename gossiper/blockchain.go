@@ -9,7 +9,7 @@ import (
 )
 
 func startMining(gsspr *Gossiper) {
-	for {
+	for !gsspr.isStopped() {
 		// Start recording time for mining to give an equal delay later
 		start := time.Now()
 		// Generate random Nonce
@@ -17,6 +17,9 @@ func startMining(gsspr *Gossiper) {
 		auxBlock := gsspr.miningBlock
 		// Check proof of work, if not valid keep mining
 		for !isBlockPOWValid(auxBlock) {
+			if gsspr.isStopped() {
+				return
+			}
 			gsspr.miningBlock.Nonce = randomNonce()
 			auxBlock = gsspr.miningBlock
 		}
@@ -54,7 +57,7 @@ func isBlockPOWValid(miningBlock Block) bool {
 func broadcastNewFile(gsspr *Gossiper, file File) {
 	for _, peer := range gsspr.peersList {
 		if peer != gsspr.addressStr {
-			gsspr.sendGossipQueue <- &QueuedMessage{
+			gsspr.queueGossip(&QueuedMessage{
 				packet: GossipPacket{
 					TxPublish: &TxPublish{
 						File:     file,
@@ -62,7 +65,7 @@ func broadcastNewFile(gsspr *Gossiper, file File) {
 					},
 				},
 				destination: peer,
-			}
+			})
 		}
 	}
 }
@@ -74,12 +77,12 @@ func processTransactionReceived(gsspr *Gossiper, transaction TxPublish, sourceAd
 		if transaction.HopLimit > 0 {
 			for _, peer := range gsspr.peersList {
 				if peer != gsspr.addressStr && peer != sourceAddress {
-					gsspr.sendGossipQueue <- &QueuedMessage{
+					gsspr.queueGossip(&QueuedMessage{
 						packet: GossipPacket{
 							TxPublish: &transaction,
 						},
 						destination: peer,
-					}
+					})
 				}
 			}
 		}
@@ -112,12 +115,12 @@ func processBlockPublishReceived(gsspr *Gossiper, blockPublish BlockPublish, sou
 		if blockPublish.HopLimit > 0 {
 			for _, peer := range gsspr.peersList {
 				if peer != gsspr.addressStr && peer != sourceAddress {
-					gsspr.sendGossipQueue <- &QueuedMessage{
+					gsspr.queueGossip(&QueuedMessage{
 						packet: GossipPacket{
 							BlockPublish: &blockPublish,
 						},
 						destination: peer,
-					}
+					})
 				}
 			}
 		}
@@ -327,7 +330,7 @@ func PublishBlockWithDelays(gsspr *Gossiper, delay time.Duration, block Block) {
 		time.Sleep(delay)
 		for _, peer := range gsspr.peersList {
 			if peer != gsspr.addressStr {
-				gsspr.sendGossipQueue <- &QueuedMessage{
+				gsspr.queueGossip(&QueuedMessage{
 					packet: GossipPacket{
 						BlockPublish: &BlockPublish{
 							Block:    block,
@@ -335,7 +338,7 @@ func PublishBlockWithDelays(gsspr *Gossiper, delay time.Duration, block Block) {
 						},
 					},
 					destination: peer,
-				}
+				})
 			}
 		}
 	}()
@@ -0,0 +1,336 @@
+package gossiper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Once over its maximum size, the chunk directory is brought this percentage under it, so chunks
+// are evicted in batches rather than one for each chunk received
+const CHUNK_STORE_EVICTION_MARGIN = 10
+
+// Which chunks are deleted first when the chunk directory is over its maximum size
+type EvictionPolicy int
+
+const (
+	// Evict the chunks served or received the longest time ago
+	EVICT_LEAST_RECENTLY_USED EvictionPolicy = iota
+	// Evict the chunks served the fewest times, the oldest first among them
+	EVICT_LEAST_FREQUENTLY_USED
+)
+
+// Parse the policy names used in the command line: lru or lfu
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case "lru":
+		return EVICT_LEAST_RECENTLY_USED, nil
+	case "lfu":
+		return EVICT_LEAST_FREQUENTLY_USED, nil
+	}
+	return EVICT_LEAST_RECENTLY_USED, errors.New("unknown eviction policy: " + name)
+}
+
+// A chunk of the chunk directory, with the files it is a chunk of
+type storedChunk struct {
+	size     int64
+	lastUsed time.Time
+	uses     uint64
+	// Chunk numbers of the chunk in each file, by metafile hash
+	files map[string][]uint64
+}
+
+// A chunk deleted from the chunk directory, its chunk numbers must be removed from chunk maps
+type evictedChunk struct {
+	hash  []byte
+	files map[string][]uint64
+}
+
+// The data chunks of the chunk directory, kept under a maximum size by evicting the chunks of
+// files we neither shared nor are downloading. Nodes of tree metafiles are not counted
+type ChunkStore struct {
+	chunks map[string]*storedChunk
+	size   int64
+	// In bytes, 0 for no limit
+	maxSize int64
+	policy  EvictionPolicy
+	// Metafile hashes of the files that lost chunks found corrupt or missing, until repaired
+	damaged map[string]bool
+	mutex   *sync.Mutex
+}
+
+func NewChunkStore() *ChunkStore {
+	return &ChunkStore{
+		chunks:  make(map[string]*storedChunk),
+		damaged: make(map[string]bool),
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// Count a chunk already in the chunk directory as chunk chunkNumber of a file
+func (cs *ChunkStore) Register(chunkHash []byte, size int, fileHash []byte, chunkNumber uint64) {
+	cs.mutex.Lock()
+	cs.register(chunkHash, size, fileHash, chunkNumber)
+	cs.mutex.Unlock()
+}
+
+func (cs *ChunkStore) register(chunkHash []byte, size int, fileHash []byte, chunkNumber uint64) {
+	chunk := cs.chunks[string(chunkHash)]
+	if chunk == nil {
+		chunk = &storedChunk{
+			size:     int64(size),
+			lastUsed: time.Now(),
+			files:    make(map[string][]uint64),
+		}
+		cs.chunks[string(chunkHash)] = chunk
+		cs.size += chunk.size
+	}
+	for _, number := range chunk.files[string(fileHash)] {
+		if number == chunkNumber {
+			return
+		}
+	}
+	chunk.files[string(fileHash)] = append(chunk.files[string(fileHash)], chunkNumber)
+}
+
+// Write a chunk we received to the chunk directory and count it, it can't be evicted meanwhile
+func (cs *ChunkStore) Write(chunkDir string, chunkData []byte, fileHash []byte, chunkNumber uint64) {
+	cs.mutex.Lock()
+	WriteChunksOnDisk([][]byte{chunkData}, chunkDir, "")
+	chunkHash := sha256.Sum256(chunkData)
+	cs.register(chunkHash[:], len(chunkData), fileHash, chunkNumber)
+	if chunk := cs.chunks[string(chunkHash[:])]; chunk != nil {
+		chunk.lastUsed = time.Now()
+	}
+	cs.mutex.Unlock()
+}
+
+// Note that a chunk was served
+func (cs *ChunkStore) Touch(chunkHash []byte) {
+	cs.mutex.Lock()
+	if chunk := cs.chunks[string(chunkHash)]; chunk != nil {
+		chunk.lastUsed = time.Now()
+		chunk.uses++
+	}
+	cs.mutex.Unlock()
+}
+
+// Stop counting the chunks of a file, those of no other file are no longer counted at all
+func (cs *ChunkStore) Forget(fileHash []byte) {
+	cs.mutex.Lock()
+	delete(cs.damaged, string(fileHash))
+	for chunkHash, chunk := range cs.chunks {
+		delete(chunk.files, string(fileHash))
+		if len(chunk.files) == 0 {
+			cs.size -= chunk.size
+			delete(cs.chunks, chunkHash)
+		}
+	}
+	cs.mutex.Unlock()
+}
+
+func (cs *ChunkStore) SetLimit(maxSize int64, policy EvictionPolicy) {
+	cs.mutex.Lock()
+	cs.maxSize = maxSize
+	cs.policy = policy
+	cs.mutex.Unlock()
+}
+
+func (cs *ChunkStore) OverLimit() bool {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return cs.maxSize > 0 && cs.size > cs.maxSize
+}
+
+// Move a chunk file to the quarantine directory if it doesn't match its hash, and stop counting
+// it. Returns the chunk numbers it had in each file, and false if it matches its hash
+func (cs *ChunkStore) Quarantine(chunkDir string, chunkHash []byte, hashSize uint) (map[string][]uint64, bool) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	// Checked again while no chunk is being written
+	fileName := GetChunkFilename(chunkHash, hashSize)
+	chunk, err := ioutil.ReadFile(chunkDir + fileName)
+	if os.IsNotExist(err) {
+		return nil, false
+	}
+	hash := sha256.Sum256(chunk)
+	if err == nil && bytes.Equal(hash[:], chunkHash) {
+		return nil, false
+	}
+	os.MkdirAll(chunkDir+QUARANTINE_DIR, os.ModePerm)
+	if os.Rename(chunkDir+fileName, chunkDir+QUARANTINE_DIR+fileName) != nil {
+		return nil, false
+	}
+	// Kept QUARANTINE_RETENTION from now on
+	now := time.Now()
+	os.Chtimes(chunkDir+QUARANTINE_DIR+fileName, now, now)
+	files := make(map[string][]uint64)
+	if chunk := cs.chunks[string(chunkHash)]; chunk != nil {
+		files = chunk.files
+		cs.size -= chunk.size
+		delete(cs.chunks, string(chunkHash))
+	}
+	for fileHash := range files {
+		cs.damaged[fileHash] = true
+	}
+	return files, true
+}
+
+// Note that a file lost chunks, to repair it at the next scrub
+func (cs *ChunkStore) MarkDamaged(fileHash []byte) {
+	cs.mutex.Lock()
+	cs.damaged[string(fileHash)] = true
+	cs.mutex.Unlock()
+}
+
+func (cs *ChunkStore) MarkRepaired(fileHash []byte) {
+	cs.mutex.Lock()
+	delete(cs.damaged, string(fileHash))
+	cs.mutex.Unlock()
+}
+
+// Metafile hashes of the files that lost chunks
+func (cs *ChunkStore) Damaged() [][]byte {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	damaged := make([][]byte, 0, len(cs.damaged))
+	for fileHash := range cs.damaged {
+		damaged = append(damaged, []byte(fileHash))
+	}
+	return damaged
+}
+
+// Delete chunks from the chunk directory until it is CHUNK_STORE_EVICTION_MARGIN percent under
+// its maximum size, following the policy. Chunks of protected files are kept, so the size can
+// stay over the maximum
+func (cs *ChunkStore) Evict(chunkDir string, hashSize uint, protected map[string]bool) []evictedChunk {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	evicted := make([]evictedChunk, 0)
+	if cs.maxSize <= 0 || cs.size <= cs.maxSize {
+		return evicted
+	}
+	candidates := make([]string, 0)
+	for chunkHash, chunk := range cs.chunks {
+		isProtected := false
+		for fileHash := range chunk.files {
+			if protected[fileHash] {
+				isProtected = true
+				break
+			}
+		}
+		if !isProtected {
+			candidates = append(candidates, chunkHash)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := cs.chunks[candidates[i]], cs.chunks[candidates[j]]
+		if cs.policy == EVICT_LEAST_FREQUENTLY_USED && a.uses != b.uses {
+			return a.uses < b.uses
+		}
+		return a.lastUsed.Before(b.lastUsed)
+	})
+	targetSize := cs.maxSize - cs.maxSize*CHUNK_STORE_EVICTION_MARGIN/100
+	for _, chunkHash := range candidates {
+		if cs.size <= targetSize {
+			break
+		}
+		err := os.Remove(chunkDir + GetChunkFilename([]byte(chunkHash), hashSize))
+		if err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		chunk := cs.chunks[chunkHash]
+		cs.size -= chunk.size
+		delete(cs.chunks, chunkHash)
+		evicted = append(evicted, evictedChunk{
+			hash:  []byte(chunkHash),
+			files: chunk.files,
+		})
+	}
+	return evicted
+}
+
+// Maximum size in bytes of the chunks of the chunk directory, 0 for no limit, and which chunks
+// are evicted first. Chunks of files we shared or are downloading are never evicted
+func (gsspr *Gossiper) SetChunkStoreLimit(maxSize int64, policy EvictionPolicy) {
+	gsspr.chunkStore.SetLimit(maxSize, policy)
+	gsspr.evictChunks()
+}
+
+// Count the chunks of a file listed in its chunk map
+func (gsspr *Gossiper) registerChunks(metaData FileMetaData) {
+	chunkCount := GetChunkNumber(metaData.MetaFile, gsspr.hashSize)
+	segment := uint64(0)
+	var segmentHashes [][]byte
+	for _, chunkNumber := range metaData.ChunkMap {
+		if chunkNumber < 1 || chunkNumber > chunkCount {
+			continue
+		}
+		if segmentHashes == nil || (chunkNumber-1)/METAFILE_FANOUT != segment {
+			segment = (chunkNumber - 1) / METAFILE_FANOUT
+			segmentHashes, _ = metaData.SegmentHashes(segment, gsspr.hashSize, gsspr.readMetaFileNode)
+		}
+		if segmentHashes == nil {
+			continue
+		}
+		chunkHash := segmentHashes[(chunkNumber-1)%METAFILE_FANOUT]
+		size, exists := gsspr.chunkFileSize(chunkHash)
+		if exists {
+			gsspr.chunkStore.Register(chunkHash, size, metaData.HashValue, chunkNumber)
+		}
+	}
+}
+
+// Size of a chunk file of the chunk directory, false if it is missing
+func (gsspr *Gossiper) chunkFileSize(chunkHash []byte) (int, bool) {
+	info, err := os.Stat(gsspr.chunkFilesDir + GetChunkFilename(chunkHash, gsspr.hashSize))
+	if err != nil {
+		return 0, false
+	}
+	return int(info.Size()), true
+}
+
+// Evict chunks if the chunk directory is over its maximum size, and remove them from the chunk
+// maps of their files so search replies only list the chunks we have
+func (gsspr *Gossiper) evictChunks() {
+	if !gsspr.chunkStore.OverLimit() {
+		return
+	}
+	// Files we shared, and the downloads that can still need their chunks
+	protected := make(map[string]bool)
+	gsspr.metaDataList.mutex.Lock()
+	for _, metaData := range gsspr.metaDataList.metaDataFiles {
+		if len(metaData.Origins) > 0 && metaData.Origins[0] == gsspr.Name {
+			protected[string(metaData.HashValue)] = true
+		}
+	}
+	gsspr.metaDataList.mutex.Unlock()
+	gsspr.fileDownloadsList.mutex.Lock()
+	for _, download := range gsspr.fileDownloadsList.fileDownloads {
+		if download.status == DOWNLOAD_ACTIVE || download.status == DOWNLOAD_PAUSED {
+			protected[string(download.request.HashValue)] = true
+		}
+	}
+	gsspr.fileDownloadsList.mutex.Unlock()
+	for _, hash := range gsspr.journaledDownloads() {
+		protected[string(hash)] = true
+	}
+
+	evicted := gsspr.chunkStore.Evict(gsspr.chunkFilesDir, gsspr.hashSize, protected)
+	for _, chunk := range evicted {
+		for fileHash, chunkNumbers := range chunk.files {
+			for _, chunkNumber := range chunkNumbers {
+				gsspr.metaDataList.RemoveChunkNumberFromMap([]byte(fileHash), chunkNumber)
+				gsspr.fileDownloadsList.RemoveChunkNumberFromMetaData([]byte(fileHash), chunkNumber)
+			}
+		}
+	}
+	if len(evicted) > 0 {
+		logChunksEvicted(len(evicted))
+	}
+}
@@ -0,0 +1,31 @@
+package gossiper
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestDownloadedChunksCountedWithTheirSize(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "")
+	os.MkdirAll(alice.chunkFilesDir, 0755)
+	content := bytes.Repeat([]byte("downloaded "), 2000)
+	shared, err := alice.indexContent(bytes.NewReader(content), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.metaDataList.Remove(shared.HashValue)
+	alice.chunkStore.Forget(shared.HashValue)
+
+	// Downloaded files keep their chunk count as size, or 0 when found by a search
+	for _, size := range []uint64{GetChunkNumber(shared.MetaFile, alice.hashSize), 0} {
+		downloaded := *shared
+		downloaded.Size = size
+		alice.chunkStore = *NewChunkStore()
+		alice.registerChunks(downloaded)
+		if alice.chunkStore.size != int64(len(content)) {
+			t.Fatalf("%d bytes counted for %d bytes of chunks", alice.chunkStore.size, len(content))
+		}
+	}
+}
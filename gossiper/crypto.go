@@ -0,0 +1,396 @@
+package gossiper
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/dedis/protobuf"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Long-term keys of a gossiper
+type KeyPair struct {
+	encryptionKey *ecdh.PrivateKey
+	signingKey    ed25519.PrivateKey
+}
+
+// Format of the key file on disk
+type storedKeys struct {
+	EncryptionKey []byte
+	// Seed of the signing key
+	SigningKey []byte
+}
+
+func NewKeyPair() (*KeyPair, error) {
+	encryptionKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{
+		encryptionKey: encryptionKey,
+		signingKey:    signingKey,
+	}, nil
+}
+
+// Load the keys stored at path, or create them and store them there if the file doesn't exist
+func LoadOrCreateKeyPair(path string) (*KeyPair, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		keys, err := NewKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		return keys, keys.Save(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stored := storedKeys{}
+	err = protobuf.Decode(content, &stored)
+	if err != nil {
+		return nil, err
+	}
+	encryptionKey, err := ecdh.X25519().NewPrivateKey(stored.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(stored.SigningKey) != ed25519.SeedSize {
+		// Key file written before rumors were signed, add a signing key to it
+		_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		keys := &KeyPair{
+			encryptionKey: encryptionKey,
+			signingKey:    signingKey,
+		}
+		return keys, keys.Save(path)
+	}
+	return &KeyPair{
+		encryptionKey: encryptionKey,
+		signingKey:    ed25519.NewKeyFromSeed(stored.SigningKey),
+	}, nil
+}
+
+func (kp *KeyPair) Save(path string) error {
+	content, err := protobuf.Encode(&storedKeys{
+		EncryptionKey: kp.encryptionKey.Bytes(),
+		SigningKey:    kp.signingKey.Seed(),
+	})
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0600)
+}
+
+func (kp *KeyPair) EncryptionPublicKey() []byte {
+	return kp.encryptionKey.PublicKey().Bytes()
+}
+
+func (kp *KeyPair) SigningPublicKey() []byte {
+	return kp.signingKey.Public().(ed25519.PublicKey)
+}
+
+// Public keys of the other gossipers, learned from their signed rumors.
+// The first key seen for an origin is kept, later different keys are rejected
+type KeyStore struct {
+	encryptionKeys map[string][]byte
+	signingKeys    map[string][]byte
+	mutex          *sync.Mutex
+}
+
+func NewKeyStore() *KeyStore {
+	return &KeyStore{
+		encryptionKeys: make(map[string][]byte),
+		signingKeys:    make(map[string][]byte),
+		mutex:          &sync.Mutex{},
+	}
+}
+
+// Register the key of an origin, returns false if it conflicts with the one we already know
+func (ks *KeyStore) RegisterEncryptionKey(origin string, key []byte) bool {
+	if origin == "" || len(key) == 0 {
+		return true
+	}
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	known, exists := ks.encryptionKeys[origin]
+	if exists {
+		return bytes.Equal(known, key)
+	}
+	ks.encryptionKeys[origin] = append([]byte{}, key...)
+	return true
+}
+
+func (ks *KeyStore) GetEncryptionKey(origin string) []byte {
+	ks.mutex.Lock()
+	key := ks.encryptionKeys[origin]
+	ks.mutex.Unlock()
+	return key
+}
+
+func (ks *KeyStore) GetSigningKey(origin string) []byte {
+	ks.mutex.Lock()
+	key := ks.signingKeys[origin]
+	ks.mutex.Unlock()
+	return key
+}
+
+// Policy for rumors that carry no signature, e.g. from peers running an older version
+type UnsignedRumorPolicy int
+
+const (
+	// Accept unsigned rumors only for origins that never sent us a signed rumor
+	UNSIGNED_ACCEPT_UNKNOWN UnsignedRumorPolicy = iota
+	// Accept every unsigned rumor
+	UNSIGNED_ACCEPT
+	// Drop every unsigned rumor
+	UNSIGNED_REJECT
+)
+
+// Parse the policy names used in the command line: unknown, accept or reject
+func ParseUnsignedRumorPolicy(name string) (UnsignedRumorPolicy, error) {
+	switch name {
+	case "unknown":
+		return UNSIGNED_ACCEPT_UNKNOWN, nil
+	case "accept":
+		return UNSIGNED_ACCEPT, nil
+	case "reject":
+		return UNSIGNED_REJECT, nil
+	}
+	return UNSIGNED_ACCEPT_UNKNOWN, errors.New("unknown policy for unsigned rumors: " + name)
+}
+
+// Hash of the fields of a rumor covered by the signature of its origin
+func rumorSignedData(rumor *RumorMessage) []byte {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, uint32(len(rumor.Origin)))
+	h.Write([]byte(rumor.Origin))
+	binary.Write(h, binary.LittleEndian, rumor.ID)
+	binary.Write(h, binary.LittleEndian, uint32(len(rumor.Text)))
+	h.Write([]byte(rumor.Text))
+	if rumor.Topic != "" {
+		// Left out when empty, so rumors without topic keep the signature of older versions
+		binary.Write(h, binary.LittleEndian, uint32(len(rumor.Topic)))
+		h.Write([]byte(rumor.Topic))
+	}
+	binary.Write(h, binary.LittleEndian, uint32(len(rumor.EncryptionKey)))
+	h.Write(rumor.EncryptionKey)
+	binary.Write(h, binary.LittleEndian, uint32(len(rumor.SigningKey)))
+	h.Write(rumor.SigningKey)
+	return h.Sum(nil)
+}
+
+func signRumor(keys *KeyPair, rumor *RumorMessage) {
+	rumor.SigningKey = keys.SigningPublicKey()
+	rumor.Signature = ed25519.Sign(keys.signingKey, rumorSignedData(rumor))
+}
+
+// Check that a rumor really comes from its origin. The signature is checked against the key
+// pinned for the origin, or against the key carried by the rumor if it is the first one we see
+func (ks *KeyStore) VerifyRumor(rumor *RumorMessage, policy UnsignedRumorPolicy) bool {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	knownKey, known := ks.signingKeys[rumor.Origin]
+	if rumor.Signature == nil {
+		switch policy {
+		case UNSIGNED_ACCEPT:
+			return true
+		case UNSIGNED_ACCEPT_UNKNOWN:
+			return !known
+		default:
+			return false
+		}
+	}
+	if len(rumor.SigningKey) != ed25519.PublicKeySize || (known && !bytes.Equal(knownKey, rumor.SigningKey)) {
+		return false
+	}
+	if !ed25519.Verify(rumor.SigningKey, rumorSignedData(rumor), rumor.Signature) {
+		return false
+	}
+	if !known && rumor.Origin != "" {
+		ks.signingKeys[rumor.Origin] = append([]byte{}, rumor.SigningKey...)
+	}
+	return true
+}
+
+// Hash of the clock of a status packet and of its sender, covered by the signature of the sender
+func statusSignedData(status *StatusPacket) []byte {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, uint32(len(status.Origin)))
+	h.Write([]byte(status.Origin))
+	binary.Write(h, binary.LittleEndian, uint32(len(status.Want)))
+	for _, peerStatus := range status.Want {
+		binary.Write(h, binary.LittleEndian, uint32(len(peerStatus.Identifier)))
+		h.Write([]byte(peerStatus.Identifier))
+		binary.Write(h, binary.LittleEndian, peerStatus.NextID)
+	}
+	binary.Write(h, binary.LittleEndian, uint32(len(status.SigningKey)))
+	h.Write(status.SigningKey)
+	return h.Sum(nil)
+}
+
+func signStatus(keys *KeyPair, origin string, status *StatusPacket) {
+	status.Origin = origin
+	status.SigningKey = keys.SigningPublicKey()
+	status.Signature = ed25519.Sign(keys.signingKey, statusSignedData(status))
+}
+
+// Check that a status packet comes from the node it names, with the same policy for unsigned
+// packets as for rumors. Only rumors pin keys, the key of an origin we don't know yet is taken
+// from the packet
+func (ks *KeyStore) VerifyStatus(status *StatusPacket, policy UnsignedRumorPolicy) bool {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	knownKey, known := ks.signingKeys[status.Origin]
+	if status.Signature == nil {
+		switch policy {
+		case UNSIGNED_ACCEPT:
+			return true
+		case UNSIGNED_ACCEPT_UNKNOWN:
+			return !known
+		default:
+			return false
+		}
+	}
+	if len(status.SigningKey) != ed25519.PublicKeySize || (known && !bytes.Equal(knownKey, status.SigningKey)) {
+		return false
+	}
+	return ed25519.Verify(status.SigningKey, statusSignedData(status), status.Signature)
+}
+
+// Hash of the fields of a private acknowledgment covered by the signature of its origin
+func privateAckSignedData(ack *PrivateAck) []byte {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, uint32(len(ack.Origin)))
+	h.Write([]byte(ack.Origin))
+	binary.Write(h, binary.LittleEndian, uint32(len(ack.Destination)))
+	h.Write([]byte(ack.Destination))
+	binary.Write(h, binary.LittleEndian, ack.ID)
+	binary.Write(h, binary.LittleEndian, ack.Read)
+	return h.Sum(nil)
+}
+
+func signPrivateAck(keys *KeyPair, ack *PrivateAck) {
+	ack.Signature = ed25519.Sign(keys.signingKey, privateAckSignedData(ack))
+}
+
+// Check that an acknowledgment comes from its origin with the key pinned for it. Acknowledgments
+// of an origin whose key we don't know can't be checked and are accepted
+func (ks *KeyStore) VerifyPrivateAck(ack *PrivateAck) bool {
+	knownKey := ks.GetSigningKey(ack.Origin)
+	if knownKey == nil {
+		return true
+	}
+	return ack.Signature != nil && ed25519.Verify(knownKey, privateAckSignedData(ack), ack.Signature)
+}
+
+// Derive the symmetric key shared by origin and destination. Both sides get the same key
+// from their own private key and the other's public key, so only they can seal or open messages
+func deriveSharedKey(privateKey *ecdh.PrivateKey, peerPublicKey []byte, origin, destination string) ([]byte, error) {
+	publicKey, err := ecdh.X25519().NewPublicKey(peerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := privateKey.ECDH(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write(secret)
+	h.Write([]byte(origin))
+	h.Write([]byte{0})
+	h.Write([]byte(destination))
+	return h.Sum(nil), nil
+}
+
+// AES-GCM cipher keyed with the key shared by origin and destination
+func sharedCipher(keys *KeyPair, peerKey []byte, origin, destination string) (cipher.AEAD, error) {
+	sharedKey, err := deriveSharedKey(keys.encryptionKey, peerKey, origin, destination)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(sharedKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt a text from origin to destination, returns the random nonce used and the sealed text
+func sealText(keys *KeyPair, destinationKey []byte, origin, destination string, text, additionalData []byte) ([]byte, []byte, error) {
+	aead, err := sharedCipher(keys, destinationKey, origin, destination)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, text, additionalData), nil
+}
+
+// Decrypt a text sealed by origin for destination
+func openText(keys *KeyPair, originKey []byte, origin, destination string, nonce, sealed, additionalData []byte) ([]byte, error) {
+	if len(originKey) == 0 {
+		return nil, errors.New("unknown public key of " + origin)
+	}
+	aead, err := sharedCipher(keys, originKey, origin, destination)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	return aead.Open(nil, nonce, sealed, additionalData)
+}
+
+// Data authenticated along the text, so a relay can't change who the message is from or for
+func privateMessageAdditionalData(message *PrivateMessage) []byte {
+	return []byte(fmt.Sprintf("%s\x00%s\x00%d", message.Origin, message.Destination, message.ID))
+}
+
+// Encrypt the text of a private message for its destination, the text is removed from the message
+func sealPrivateMessage(keys *KeyPair, destinationKey []byte, message *PrivateMessage) error {
+	nonce, sealed, err := sealText(keys, destinationKey, message.Origin, message.Destination,
+		[]byte(message.Text), privateMessageAdditionalData(message))
+	if err != nil {
+		return err
+	}
+	message.Nonce = nonce
+	message.Sealed = sealed
+	message.Text = ""
+	return nil
+}
+
+// Decrypt a sealed private message and check it was sealed by its origin
+func openPrivateMessage(keys *KeyPair, originKey []byte, message *PrivateMessage) error {
+	text, err := openText(keys, originKey, message.Origin, message.Destination,
+		message.Nonce, message.Sealed, privateMessageAdditionalData(message))
+	if err != nil {
+		return err
+	}
+	message.Text = string(text)
+	message.Sealed = nil
+	message.Nonce = nil
+	return nil
+}
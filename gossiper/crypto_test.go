@@ -0,0 +1,278 @@
+package gossiper
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func newTestKeyPair(t *testing.T) *KeyPair {
+	keys, err := NewKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestSealOpenRoundTrip(t *testing.T) {
+	alice, bob := newTestKeyPair(t), newTestKeyPair(t)
+	message := PrivateMessage{
+		Origin:      "alice",
+		ID:          7,
+		Text:        "meet at noon",
+		Destination: "bob",
+		HopLimit:    10,
+	}
+	err := sealPrivateMessage(alice, bob.EncryptionPublicKey(), &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Text != "" || message.Sealed == nil || bytes.Contains(message.Sealed, []byte("noon")) {
+		t.Fatal("text still readable in the sealed message")
+	}
+	opened := message
+	err = openPrivateMessage(bob, alice.EncryptionPublicKey(), &opened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.Text != "meet at noon" || opened.Sealed != nil || opened.Nonce != nil {
+		t.Errorf("opened as %+v", opened)
+	}
+}
+
+func TestOpenRejectsTamperedMessages(t *testing.T) {
+	alice, bob, mallory := newTestKeyPair(t), newTestKeyPair(t), newTestKeyPair(t)
+	sealed := PrivateMessage{
+		Origin:      "alice",
+		ID:          7,
+		Text:        "meet at noon",
+		Destination: "bob",
+	}
+	err := sealPrivateMessage(alice, bob.EncryptionPublicKey(), &sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := map[string]func(message *PrivateMessage){
+		"origin":      func(message *PrivateMessage) { message.Origin = "mallory" },
+		"destination": func(message *PrivateMessage) { message.Destination = "carol" },
+		"id":          func(message *PrivateMessage) { message.ID++ },
+		"sealed text": func(message *PrivateMessage) { message.Sealed[0] ^= 1 },
+		"nonce":       func(message *PrivateMessage) { message.Nonce = message.Nonce[1:] },
+	}
+	for name, tamper := range tampered {
+		message := sealed
+		message.Sealed = append([]byte{}, sealed.Sealed...)
+		message.Nonce = append([]byte{}, sealed.Nonce...)
+		tamper(&message)
+		if openPrivateMessage(bob, alice.EncryptionPublicKey(), &message) == nil {
+			t.Errorf("message opened with a changed %s", name)
+		}
+	}
+
+	// Sealed by someone else claiming to be alice
+	forged := PrivateMessage{
+		Origin:      "alice",
+		ID:          8,
+		Text:        "meet at midnight",
+		Destination: "bob",
+	}
+	sealPrivateMessage(mallory, bob.EncryptionPublicKey(), &forged)
+	if openPrivateMessage(bob, alice.EncryptionPublicKey(), &forged) == nil {
+		t.Error("message sealed with another key opened as coming from alice")
+	}
+	message := sealed
+	if openPrivateMessage(bob, nil, &message) == nil {
+		t.Error("message opened without the key of its origin")
+	}
+}
+
+func TestVerifyRumor(t *testing.T) {
+	alice, mallory := newTestKeyPair(t), newTestKeyPair(t)
+	rumor := &RumorMessage{
+		Origin:        "alice",
+		ID:            1,
+		Text:          "hello",
+		EncryptionKey: alice.EncryptionPublicKey(),
+	}
+	signRumor(alice, rumor)
+
+	keyStore := NewKeyStore()
+	if !keyStore.VerifyRumor(rumor, UNSIGNED_REJECT) {
+		t.Fatal("signed rumor rejected")
+	}
+	changed := *rumor
+	changed.Text = "goodbye"
+	if keyStore.VerifyRumor(&changed, UNSIGNED_ACCEPT) {
+		t.Error("rumor with a changed text accepted")
+	}
+	impersonated := &RumorMessage{
+		Origin: "alice",
+		ID:     2,
+		Text:   "hello from mallory",
+	}
+	signRumor(mallory, impersonated)
+	if keyStore.VerifyRumor(impersonated, UNSIGNED_ACCEPT) {
+		t.Error("rumor signed with another key accepted once the key of its origin is pinned")
+	}
+
+	unsigned := &RumorMessage{
+		Origin: "alice",
+		ID:     3,
+	}
+	if keyStore.VerifyRumor(unsigned, UNSIGNED_ACCEPT_UNKNOWN) {
+		t.Error("unsigned rumor accepted from an origin that signs its rumors")
+	}
+	if !keyStore.VerifyRumor(unsigned, UNSIGNED_ACCEPT) {
+		t.Error("unsigned rumor rejected with the accept policy")
+	}
+	unsigned.Origin = "bob"
+	if !keyStore.VerifyRumor(unsigned, UNSIGNED_ACCEPT_UNKNOWN) || keyStore.VerifyRumor(unsigned, UNSIGNED_REJECT) {
+		t.Error("policy for unsigned rumors of unknown origins not applied")
+	}
+}
+
+func TestUnsealedPrivateMessageFromKnownOriginDropped(t *testing.T) {
+	network := NewMemoryNetwork()
+	bob := newTestGossiper(t, network, "bob", "127.0.0.1:5001", "")
+	alice := newTestKeyPair(t)
+	bob.keyStore.RegisterEncryptionKey("alice", alice.EncryptionPublicKey())
+
+	// A relay replaced the sealed text of alice by its own
+	handleMessage(bob, &GossipPacket{
+		Private: &PrivateMessage{
+			Origin:      "alice",
+			Text:        "forged by a relay",
+			Destination: "bob",
+			HopLimit:    9,
+		},
+	}, "127.0.0.1:5002")
+	if len(bob.allPrivateMessages) != 0 {
+		t.Fatalf("unsealed message accepted: %+v", bob.allPrivateMessages)
+	}
+
+	sealed := PrivateMessage{
+		Origin:      "alice",
+		Text:        "really from alice",
+		Destination: "bob",
+		HopLimit:    9,
+	}
+	sealPrivateMessage(alice, bob.keys.EncryptionPublicKey(), &sealed)
+	handleMessage(bob, &GossipPacket{
+		Private: &sealed,
+	}, "127.0.0.1:5002")
+	if len(bob.allPrivateMessages) != 1 || bob.allPrivateMessages[0].Text != "really from alice" {
+		t.Fatalf("sealed message not received: %+v", bob.allPrivateMessages)
+	}
+}
+
+func TestPrivateMessageNeverSentInClear(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "")
+
+	// Reachable destination that never advertised a key
+	alice.routingTable.RegisterNextHop("bob", "127.0.0.1:5001")
+	message := PrivateMessage{
+		Origin:      "alice",
+		ID:          alice.privateMessages.NextId("bob"),
+		Text:        "secret",
+		Destination: "bob",
+		HopLimit:    10,
+	}
+	sendPrivateMessageReliably(alice, message, time.Now().Add(MAILBOX_TTL))
+	if status := alice.privateMessages.GetStatus(message.ID); status != PRIVATE_NO_KEY {
+		t.Errorf("status %s instead of %s", status, PRIVATE_NO_KEY)
+	}
+
+	// Unknown destination, the message waits in our mailbox for its key
+	message.ID = alice.privateMessages.NextId("carol")
+	message.Destination = "carol"
+	sendPrivateMessageReliably(alice, message, time.Now().Add(MAILBOX_TTL))
+	if status := alice.privateMessages.GetStatus(message.ID); status != PRIVATE_STORED {
+		t.Errorf("status %s instead of %s", status, PRIVATE_STORED)
+	}
+}
+
+func TestVerifyStatus(t *testing.T) {
+	alice, mallory := newTestKeyPair(t), newTestKeyPair(t)
+	keyStore := NewKeyStore()
+	status := NewStatusPacket("alice")
+	status.Want = append(status.Want, PeerStatus{
+		Identifier: "bob",
+		NextID:     4,
+	})
+	signStatus(alice, "alice", status)
+	if !keyStore.VerifyStatus(status, UNSIGNED_REJECT) {
+		t.Fatal("signed status rejected")
+	}
+	changed := *status
+	changed.Want = append([]PeerStatus{}, status.Want...)
+	changed.Want[1].NextID = 5
+	if keyStore.VerifyStatus(&changed, UNSIGNED_ACCEPT) {
+		t.Error("status with a changed clock accepted")
+	}
+
+	// Once a signed rumor pinned the key of alice, only alice can send status packets as alice
+	rumor := &RumorMessage{
+		Origin: "alice",
+		ID:     1,
+	}
+	signRumor(alice, rumor)
+	keyStore.VerifyRumor(rumor, UNSIGNED_REJECT)
+	impersonated := NewStatusPacket("alice")
+	signStatus(mallory, "alice", impersonated)
+	if keyStore.VerifyStatus(impersonated, UNSIGNED_ACCEPT) {
+		t.Error("status signed with another key accepted")
+	}
+	unsigned := NewStatusPacket("alice")
+	unsigned.Origin = "alice"
+	if keyStore.VerifyStatus(unsigned, UNSIGNED_ACCEPT_UNKNOWN) || !keyStore.VerifyStatus(unsigned, UNSIGNED_ACCEPT) {
+		t.Error("policy for unsigned status packets not applied")
+	}
+}
+
+func TestEncryptionKeysPinnedOnlyFromSignedRumors(t *testing.T) {
+	network := NewMemoryNetwork()
+	bob := newTestGossiper(t, network, "bob", "127.0.0.1:5001", "")
+	alice, mallory := newTestKeyPair(t), newTestKeyPair(t)
+
+	// Forged by a neighbour, accepted by the default policy since alice never signed a rumor
+	handleMessage(bob, &GossipPacket{
+		Rumor: &RumorMessage{
+			Origin:        "alice",
+			ID:            1,
+			EncryptionKey: mallory.EncryptionPublicKey(),
+		},
+	}, "127.0.0.1:5002")
+	if bob.Vc.GetNextId("alice") != 2 {
+		t.Fatal("unsigned rumor rejected")
+	}
+	if bob.keyStore.GetEncryptionKey("alice") != nil {
+		t.Fatal("key pinned from an unsigned rumor")
+	}
+
+	signed := &RumorMessage{
+		Origin:        "alice",
+		ID:            2,
+		EncryptionKey: alice.EncryptionPublicKey(),
+	}
+	signRumor(alice, signed)
+	handleMessage(bob, &GossipPacket{Rumor: signed}, "127.0.0.1:5002")
+	if !bytes.Equal(bob.keyStore.GetEncryptionKey("alice"), alice.EncryptionPublicKey()) {
+		t.Fatal("key of a signed rumor not pinned")
+	}
+
+	// Signed by alice, but with another encryption key
+	conflicting := &RumorMessage{
+		Origin:        "alice",
+		ID:            3,
+		EncryptionKey: mallory.EncryptionPublicKey(),
+	}
+	signRumor(alice, conflicting)
+	handleMessage(bob, &GossipPacket{Rumor: conflicting}, "127.0.0.1:5002")
+	if bob.Vc.GetNextId("alice") != 3 {
+		t.Error("rumor with a conflicting encryption key accepted")
+	}
+	if !bytes.Equal(bob.keyStore.GetEncryptionKey("alice"), alice.EncryptionPublicKey()) {
+		t.Error("pinned key replaced")
+	}
+}
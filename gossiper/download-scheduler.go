@@ -0,0 +1,262 @@
+package gossiper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Number of chunk requests a download keeps outstanding, unless set with SetDownloadWindow
+const DEFAULT_DOWNLOAD_WINDOW = 8
+
+// Period at which requests are checked for timeouts
+const DOWNLOAD_CHECK_INTERVAL = 250 * time.Millisecond
+
+// A chunk requested and not received yet. Positions of the file with the same content share it
+type chunkRequest struct {
+	indexes  []uint64
+	hash     []byte
+	holder   string
+	sent     time.Time
+	attempts int
+}
+
+// Requests the missing chunks of a download hop by hop, keeping a window of requests
+// outstanding spread over the peers that have them. Chunks are saved as they arrive
+type downloadScheduler struct {
+	gsspr    *Gossiper
+	request  DataRequest
+	download *FileDownload
+	// Hashes of the chunks to download by position
+	chunkHashes map[uint64][]byte
+	pending     []uint64
+	outstanding map[string]*chunkRequest
+	// Requests outstanding with each holder, and timeouts since its last reply
+	load     map[string]int
+	failures map[string]int
+	replies  chan *DataReply
+}
+
+func newDownloadScheduler(gsspr *Gossiper, request DataRequest, download *FileDownload) *downloadScheduler {
+	return &downloadScheduler{
+		gsspr:       gsspr,
+		request:     request,
+		download:    download,
+		outstanding: make(map[string]*chunkRequest),
+		load:        make(map[string]int),
+		failures:    make(map[string]int),
+		replies:     make(chan *DataReply, gsspr.downloadWindow),
+	}
+}
+
+// Download the missing chunks, given with their hash by position. Holders that timed out are
+// remembered from one call to the next. Returns an error if a chunk couldn't be received, the
+// download was cancelled or the gossiper was stopped
+func (ds *downloadScheduler) run(missing map[uint64][]byte) error {
+	if len(missing) == 0 {
+		return nil
+	}
+	if ds.request.HopLimit <= 1 {
+		return errors.New("hop limit too low")
+	}
+	ds.chunkHashes = missing
+	ds.pending = make([]uint64, 0, len(missing))
+	for index := range missing {
+		ds.pending = append(ds.pending, index)
+	}
+	sort.Slice(ds.pending, func(i, j int) bool {
+		return ds.pending[i] < ds.pending[j]
+	})
+	defer ds.stopListening()
+	ticker := time.NewTicker(DOWNLOAD_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		if ds.gsspr.fileDownloadsList.getStatus(ds.download) != DOWNLOAD_ACTIVE {
+			err := ds.pause()
+			if err != nil {
+				return err
+			}
+		}
+		ds.fillWindow()
+		if len(ds.pending) == 0 && len(ds.outstanding) == 0 {
+			return nil
+		}
+		select {
+		case <-ds.gsspr.quit:
+			return ErrGossiperStopped
+		case <-ds.download.wake:
+			// Status changed, checked at the start of the loop
+		case reply := <-ds.replies:
+			ds.receive(reply)
+		case <-ticker.C:
+			err := ds.retryExpired()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Wait until the download is resumed. Replies to the outstanding requests are kept and saved
+// once resumed, the requests still unanswered are given a new timeout
+func (ds *downloadScheduler) pause() error {
+	ds.gsspr.fileDownloadsList.SetSources(ds.download, nil)
+	if !ds.gsspr.waitWhilePaused(ds.download) {
+		return ds.gsspr.downloadInterruption(ds.download)
+	}
+	now := time.Now()
+	for _, request := range ds.outstanding {
+		request.sent = now
+	}
+	return nil
+}
+
+// Peers that have the chunk in position index: the origin the metadata assigns it to and
+// every peer that listed it in a search reply
+func (ds *downloadScheduler) holders(index uint64) []string {
+	return ds.gsspr.chunkHolders(&ds.download.metaData, index)
+}
+
+// Holder we can reach with the fewest outstanding requests, holders that timed out come last.
+// The excluded holder is only chosen if no other one can be reached
+func (ds *downloadScheduler) chooseHolder(index uint64, excluded string) string {
+	chosen := ""
+	bestScore := 0
+	reachable := false
+	for _, holder := range ds.holders(index) {
+		if holder == ds.gsspr.Name || ds.gsspr.routingTable.GetAddress(holder) == "" {
+			continue
+		}
+		if holder == excluded {
+			reachable = true
+			continue
+		}
+		score := ds.load[holder] + ds.failures[holder]*ds.gsspr.downloadWindow
+		if chosen == "" || score < bestScore {
+			chosen = holder
+			bestScore = score
+		}
+	}
+	if chosen == "" && reachable {
+		return excluded
+	}
+	return chosen
+}
+
+// Request pending chunks until the window is full. A chunk without a reachable holder counts
+// as sent, it is requested again when it times out
+func (ds *downloadScheduler) fillWindow() {
+	for len(ds.pending) > 0 && len(ds.outstanding) < ds.gsspr.downloadWindow {
+		index := ds.pending[0]
+		ds.pending = ds.pending[1:]
+		hash := ds.chunkHashes[index]
+		if request, exists := ds.outstanding[string(hash)]; exists {
+			request.indexes = append(request.indexes, index)
+			continue
+		}
+		request := &chunkRequest{
+			indexes: []uint64{index},
+			hash:    hash,
+		}
+		ds.outstanding[string(hash)] = request
+		ds.gsspr.listenForData(hash, ds.replies)
+		ds.send(request, ds.chooseHolder(index, ""))
+	}
+}
+
+func (ds *downloadScheduler) send(request *chunkRequest, holder string) {
+	request.holder = holder
+	request.sent = time.Now()
+	request.attempts++
+	ds.load[holder]++
+	nextHop := ds.gsspr.routingTable.GetAddress(holder)
+	if nextHop == "" {
+		// Sent again when it times out
+		return
+	}
+	ds.gsspr.queueGossip(&QueuedMessage{
+		packet: GossipPacket{
+			DataRequest: &DataRequest{
+				Origin:      ds.gsspr.Name,
+				Destination: holder,
+				HopLimit:    ds.request.HopLimit - 1,
+				FileName:    ds.request.FileName,
+				HashValue:   request.hash,
+			},
+		},
+		destination: nextHop,
+	})
+	logDownloadingChunk(ds.request.FileName, request.indexes[0]+1, holder)
+	ds.updateSources()
+}
+
+// Save a chunk we requested, replies that don't match the hash are ignored until the request
+// times out
+func (ds *downloadScheduler) receive(reply *DataReply) {
+	request, exists := ds.outstanding[string(reply.HashValue)]
+	if !exists {
+		return
+	}
+	hash := sha256.Sum256(reply.Data)
+	if !bytes.Equal(hash[:], request.hash) {
+		return
+	}
+	ds.load[request.holder]--
+	ds.failures[reply.Origin] = 0
+	if request.attempts == 1 && reply.Origin == request.holder {
+		ds.gsspr.originRtt.Sample(request.holder, time.Since(request.sent))
+	}
+	chunkData := make([]byte, len(reply.Data))
+	copy(chunkData, reply.Data)
+	for _, index := range request.indexes {
+		ds.gsspr.saveChunk(ds.download, index, chunkData)
+	}
+	delete(ds.outstanding, string(request.hash))
+	ds.gsspr.stopListeningForData(request.hash, ds.replies)
+	ds.updateSources()
+}
+
+// Request again the chunks that timed out, from another holder if there is one. Returns an
+// error if a chunk was requested too many times
+func (ds *downloadScheduler) retryExpired() error {
+	now := time.Now()
+	for _, request := range ds.outstanding {
+		timeout := retryTimeout(ds.gsspr.originRtt.Timeout(request.holder, DATA_REQUEST_TIMEOUT), request.attempts-1)
+		if now.Sub(request.sent) < timeout {
+			continue
+		}
+		ds.load[request.holder]--
+		ds.failures[request.holder]++
+		// Every holder gets the same number of attempts
+		holders := len(ds.holders(request.indexes[0]))
+		if holders == 0 {
+			holders = 1
+		}
+		if request.attempts >= MAX_REQUEST_ATTEMPTS*holders {
+			return fmt.Errorf("chunk %d not received after %d attempts", request.indexes[0]+1, request.attempts)
+		}
+		ds.send(request, ds.chooseHolder(request.indexes[0], request.holder))
+	}
+	return nil
+}
+
+// List the holders we are waiting for chunks from as the sources of the download
+func (ds *downloadScheduler) updateSources() {
+	sources := make([]string, 0)
+	for holder, load := range ds.load {
+		if load > 0 && holder != "" {
+			sources = append(sources, holder)
+		}
+	}
+	sort.Strings(sources)
+	ds.gsspr.fileDownloadsList.SetSources(ds.download, sources)
+}
+
+func (ds *downloadScheduler) stopListening() {
+	for _, request := range ds.outstanding {
+		ds.gsspr.stopListeningForData(request.hash, ds.replies)
+	}
+}
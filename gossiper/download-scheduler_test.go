@@ -0,0 +1,137 @@
+package gossiper
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Scheduler of a download of alice whose chunks are assigned to bob and carol in turn
+func newTestScheduler(t *testing.T, chunks int) (*downloadScheduler, map[uint64][]byte) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "")
+	alice.SetDownloadWindow(4)
+	alice.routingTable.RegisterNextHop("bob", "127.0.0.1:5001")
+	alice.routingTable.RegisterNextHop("carol", "127.0.0.1:5002")
+	request := DataRequest{
+		Origin:      "alice",
+		Destination: "bob",
+		HopLimit:    10,
+		FileName:    "file",
+	}
+	download := newFileDownload(request, false)
+	download.metaData = FileMetaData{
+		Origins:   []string{"bob", "carol"},
+		Name:      "file",
+		HashValue: []byte("metafile hash"),
+	}
+	missing := make(map[uint64][]byte)
+	for i := 0; i < chunks; i++ {
+		hash := sha256.Sum256([]byte(fmt.Sprintf("chunk %d", i)))
+		missing[uint64(i)] = hash[:]
+	}
+	ds := newDownloadScheduler(alice, request, download)
+	ds.chunkHashes = missing
+	for index := uint64(0); index < uint64(chunks); index++ {
+		ds.pending = append(ds.pending, index)
+	}
+	return ds, missing
+}
+
+func TestSchedulerSpreadsWindowOverHolders(t *testing.T) {
+	ds, _ := newTestScheduler(t, 10)
+	ds.fillWindow()
+	defer ds.stopListening()
+	if len(ds.outstanding) != 4 || len(ds.pending) != 6 {
+		t.Fatalf("%d chunks requested and %d pending with a window of 4", len(ds.outstanding), len(ds.pending))
+	}
+	if ds.load["bob"] != 2 || ds.load["carol"] != 2 {
+		t.Fatalf("requests spread as %v", ds.load)
+	}
+}
+
+func TestSchedulerRequestsSameContentOnce(t *testing.T) {
+	ds, missing := newTestScheduler(t, 3)
+	// The third position has the content of the first
+	missing[2] = missing[0]
+	ds.fillWindow()
+	defer ds.stopListening()
+	request := ds.outstanding[string(missing[0])]
+	if len(ds.outstanding) != 2 || request == nil || len(request.indexes) != 2 {
+		t.Fatalf("%d requests for 2 different chunks", len(ds.outstanding))
+	}
+}
+
+func TestSchedulerRetriesExpiredRequestWithAnotherHolder(t *testing.T) {
+	ds, missing := newTestScheduler(t, 1)
+	// Carol listed the chunk in a search reply
+	ds.gsspr.searchList.AddHolder(ds.download.metaData.HashValue, "carol", []uint64{1})
+	ds.fillWindow()
+	defer ds.stopListening()
+	request := ds.outstanding[string(missing[0])]
+	if request.holder != "bob" {
+		t.Fatalf("first chunk requested from %s", request.holder)
+	}
+	request.sent = time.Now().Add(-time.Hour)
+	err := ds.retryExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.holder != "carol" || request.attempts != 2 || ds.failures["bob"] != 1 {
+		t.Fatalf("retried from %s after %d attempts", request.holder, request.attempts)
+	}
+
+	// Every holder gets the same number of attempts
+	for attempt := request.attempts; attempt < 2*MAX_REQUEST_ATTEMPTS; attempt++ {
+		request.sent = time.Now().Add(-time.Hour)
+		if ds.retryExpired() != nil {
+			t.Fatalf("gave up after %d attempts with 2 holders", attempt)
+		}
+	}
+	request.sent = time.Now().Add(-time.Hour)
+	if ds.retryExpired() == nil {
+		t.Fatal("chunk requested forever")
+	}
+}
+
+func TestSchedulerIgnoresRepliesNotMatchingHash(t *testing.T) {
+	ds, missing := newTestScheduler(t, 1)
+	ds.fillWindow()
+	defer ds.stopListening()
+	ds.receive(&DataReply{
+		Origin:    "bob",
+		HashValue: missing[0],
+		Data:      []byte("forged chunk"),
+	})
+	if len(ds.outstanding) != 1 || ds.load["bob"] != 1 {
+		t.Fatal("chunk request answered by data with another hash")
+	}
+}
+
+func TestDataRepliesSentToEveryWaiter(t *testing.T) {
+	ds, missing := newTestScheduler(t, 1)
+	alice := ds.gsspr
+	ds.fillWindow()
+	// A search fetching the same data waits with the download
+	other := make(chan *DataReply, 1)
+	alice.listenForData(missing[0], other)
+	processDataReply(alice, DataReply{
+		Origin:      "bob",
+		Destination: "alice",
+		HashValue:   missing[0],
+		Data:        []byte("chunk 0"),
+	}, "127.0.0.1:5001")
+	if len(ds.replies) != 1 || len(other) != 1 {
+		t.Fatalf("reply given to %d of 2 waiters", len(ds.replies)+len(other))
+	}
+
+	ds.stopListening()
+	if len(alice.filesListening[string(missing[0])]) != 1 {
+		t.Fatal("other waiter removed with the download")
+	}
+	alice.stopListeningForData(missing[0], other)
+	if _, exists := alice.filesListening[string(missing[0])]; exists {
+		t.Fatal("hash still listened to without waiters")
+	}
+}
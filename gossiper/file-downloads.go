@@ -2,25 +2,103 @@ package gossiper
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
+	"github.com/dedis/protobuf"
+	"sort"
 	"sync"
+	"time"
 )
 
+var ErrDownloadCancelled = errors.New("download cancelled")
+var ErrGossiperStopped = errors.New("gossiper stopped")
+
+// Status of a download
+const DOWNLOAD_ACTIVE = "active"
+const DOWNLOAD_PAUSED = "paused"
+const DOWNLOAD_COMPLETED = "completed"
+const DOWNLOAD_FAILED = "failed"
+const DOWNLOAD_CANCELLED = "cancelled"
+
+// The transfer rate of a download is measured over this period
+const DOWNLOAD_RATE_PERIOD = 5 * time.Second
+
+// Number of finished downloads still listed
+const DOWNLOAD_HISTORY_SIZE = 32
+
 // Contains information related to a download that is in progress
 type FileDownload struct {
-	metaData  FileMetaData
-	Chunks    [][]byte
-	NextChunk uint64
+	request  DataRequest
+	metaData FileMetaData
+	// Number of chunks of the file, 0 until the metafile is known
+	chunkCount uint64
+	// Positions of the chunks saved to the chunk directory so far, in any order
+	received map[uint64]bool
+	status   string
+	started  time.Time
+	// Chunks received during the last DOWNLOAD_RATE_PERIOD
+	recent []receivedChunk
+	// Nodes we are waiting for chunks from
+	sources []string
+	// Signalled when the download is paused, resumed or cancelled
+	wake chan struct{}
+	// Closed once the download stopped, no chunk is saved for it after
+	done chan struct{}
+	// Kept to be resumed after a restart, the files of a folder are resumed with the folder
+	journaled bool
+	// For the download of a folder, the download of the file in progress and the number of
+	// files downloaded out of the files of the folder
+	child      *FileDownload
+	files      int
+	totalFiles int
+}
+
+type receivedChunk struct {
+	received time.Time
+	size     int
+}
+
+// State of a download, as shown to the client
+type DownloadInfo struct {
+	FileName       string
+	Hash           string
+	Status         string
+	Chunks         int
+	TotalChunks    uint64
+	BytesPerSecond float64
+	Sources        []string
+	Error          string
+	// Files downloaded and files of the folder, for folders
+	Files      int
+	TotalFiles int
+}
+
+func newFileDownload(request DataRequest, paused bool) *FileDownload {
+	status := DOWNLOAD_ACTIVE
+	if paused {
+		status = DOWNLOAD_PAUSED
+	}
+	return &FileDownload{
+		request:  request,
+		received: make(map[uint64]bool),
+		status:   status,
+		started:  time.Now(),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
 }
 
 // List of file downloads that are in progress
 type FileDownloadsList struct {
 	fileDownloads map[string]*FileDownload
+	finished      []DownloadInfo
 	mutex         *sync.Mutex
 }
 
 func NewFileDownloadsList() *FileDownloadsList {
 	return &FileDownloadsList{
 		fileDownloads: make(map[string]*FileDownload),
+		finished:      make([]DownloadInfo, 0),
 		mutex:         &sync.Mutex{},
 	}
 }
@@ -33,49 +111,395 @@ func (fdl *FileDownloadsList) GetByHash(hashValue []byte) *FileDownload {
 	return r
 }
 
-// Return the chunk by hashValue in the FileDownloadsList list
-func (fdl *FileDownloadsList) GetChunkByHash(hash []byte) *[]byte {
-	fdl.mutex.Lock()
-	for _, download := range fdl.fileDownloads {
-		// Check if the chunk is inside this download
-		index := download.metaData.GetPositionOfChunk(hash)
-		if index != nil {
-			// found the chunk
-			chunk := download.Chunks[*index]
-			fdl.mutex.Unlock()
-			return &chunk
-		}
-	}
-	fdl.mutex.Unlock()
-	return nil
-}
-
+// Add a download, returns false if the file is already being downloaded
 func (fdl *FileDownloadsList) Add(f *FileDownload) bool {
 	fdl.mutex.Lock()
-	if fdl.fileDownloads[string(f.metaData.HashValue)] != nil {
+	if fdl.fileDownloads[string(f.request.HashValue)] != nil {
 		// Already Exists
+		fdl.mutex.Unlock()
 		return false
 	}
 	// Add to file downloads
-	fdl.fileDownloads[string(f.metaData.HashValue)] = f
+	fdl.fileDownloads[string(f.request.HashValue)] = f
 	fdl.mutex.Unlock()
 	return true
 }
 
-func (fdl *FileDownloadsList) Remove(f *FileDownload) {
+// Set the metadata of a download once its metafile is known
+func (fdl *FileDownloadsList) SetMetaData(f *FileDownload, metaData FileMetaData, chunkCount uint64) {
+	fdl.mutex.Lock()
+	f.metaData = metaData
+	f.chunkCount = chunkCount
+	fdl.mutex.Unlock()
+}
+
+// Mark the chunk in position index of a download as saved. Only chunks transferred from a
+// peer count in its rate, not those we already had
+func (fdl *FileDownloadsList) AddChunk(f *FileDownload, index uint64, size int, transferred bool) {
+	fdl.mutex.Lock()
+	f.received[index] = true
+	if transferred {
+		f.recent = append(f.recent, receivedChunk{
+			received: time.Now(),
+			size:     size,
+		})
+	}
+	fdl.mutex.Unlock()
+}
+
+func (fdl *FileDownloadsList) SetSources(f *FileDownload, sources []string) {
 	fdl.mutex.Lock()
-	fdl.fileDownloads[string(f.metaData.HashValue)] = nil
+	f.sources = sources
 	fdl.mutex.Unlock()
 }
 
+// Set the download of the file a folder download is waiting for, nil once it ended
+func (fdl *FileDownloadsList) SetChild(f *FileDownload, child *FileDownload) {
+	fdl.mutex.Lock()
+	f.child = child
+	fdl.mutex.Unlock()
+}
+
+func (fdl *FileDownloadsList) SetFiles(f *FileDownload, files, totalFiles int) {
+	fdl.mutex.Lock()
+	f.files = files
+	f.totalFiles = totalFiles
+	fdl.mutex.Unlock()
+}
+
+func (fdl *FileDownloadsList) getStatus(f *FileDownload) string {
+	fdl.mutex.Lock()
+	defer fdl.mutex.Unlock()
+	return f.status
+}
+
+// Change the status of a running download and wake up its goroutine. Returns false if there is
+// no such download, or it can't go from its status to the new one
+func (fdl *FileDownloadsList) setStatus(hash []byte, from []string, status string) bool {
+	fdl.mutex.Lock()
+	defer fdl.mutex.Unlock()
+	download := fdl.fileDownloads[string(hash)]
+	return download != nil && download.changeStatus(from, status)
+}
+
+// Must be called with the lock of the list. The file a folder is downloading follows it
+func (f *FileDownload) changeStatus(from []string, status string) bool {
+	allowed := false
+	for _, fromStatus := range from {
+		allowed = allowed || f.status == fromStatus
+	}
+	if !allowed {
+		return false
+	}
+	f.status = status
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+	if f.child != nil {
+		f.child.changeStatus(from, status)
+	}
+	return true
+}
+
+// Remove a download that ended, it stays listed with its final status
+func (fdl *FileDownloadsList) Finish(f *FileDownload, status string, err error) {
+	fdl.mutex.Lock()
+	defer fdl.mutex.Unlock()
+	if fdl.fileDownloads[string(f.request.HashValue)] == f {
+		delete(fdl.fileDownloads, string(f.request.HashValue))
+	}
+	f.status = status
+	f.sources = nil
+	info := f.info(time.Now())
+	if err != nil {
+		info.Error = err.Error()
+	}
+	fdl.finished = append(fdl.finished, info)
+	if len(fdl.finished) > DOWNLOAD_HISTORY_SIZE {
+		fdl.finished = fdl.finished[len(fdl.finished)-DOWNLOAD_HISTORY_SIZE:]
+	}
+}
+
+// Downloads in progress by name, followed by the finished ones from the oldest
+func (fdl *FileDownloadsList) GetDownloads() []DownloadInfo {
+	fdl.mutex.Lock()
+	defer fdl.mutex.Unlock()
+	now := time.Now()
+	downloads := make([]DownloadInfo, 0, len(fdl.fileDownloads)+len(fdl.finished))
+	for _, download := range fdl.fileDownloads {
+		downloads = append(downloads, download.info(now))
+	}
+	sort.Slice(downloads, func(i, j int) bool {
+		return downloads[i].FileName < downloads[j].FileName
+	})
+	return append(downloads, fdl.finished...)
+}
+
+// Must be called with the lock of the list
+func (f *FileDownload) info(now time.Time) DownloadInfo {
+	for len(f.recent) > 0 && now.Sub(f.recent[0].received) > DOWNLOAD_RATE_PERIOD {
+		f.recent = f.recent[1:]
+	}
+	received := 0
+	for _, chunk := range f.recent {
+		received += chunk.size
+	}
+	// Measured since the start if the download is younger than the period
+	period := DOWNLOAD_RATE_PERIOD
+	if now.Sub(f.started) < period {
+		period = now.Sub(f.started)
+	}
+	rate := 0.0
+	if f.status == DOWNLOAD_ACTIVE && period > 0 {
+		rate = float64(received) / period.Seconds()
+	}
+	return DownloadInfo{
+		FileName:       f.request.FileName,
+		Hash:           hex.EncodeToString(f.request.HashValue),
+		Status:         f.status,
+		Chunks:         len(f.received),
+		TotalChunks:    f.chunkCount,
+		BytesPerSecond: rate,
+		Sources:        append([]string{}, f.sources...),
+		Files:          f.files,
+		TotalFiles:     f.totalFiles,
+	}
+}
+
 func (fdl *FileDownloadsList) AddChunkNumberToMetaData(hash []byte, chunkNumber uint64) {
 	fdl.mutex.Lock()
 	for i, download := range fdl.fileDownloads {
 		if bytes.Equal(download.metaData.HashValue, hash) {
-			fdl.fileDownloads[i].metaData.ChunkMap = append(fdl.fileDownloads[i].metaData.ChunkMap, chunkNumber)
+			fdl.fileDownloads[i].metaData.ChunkMap = insertChunkNumber(fdl.fileDownloads[i].metaData.ChunkMap, chunkNumber)
 			fdl.mutex.Unlock()
 			return
 		}
 	}
 	fdl.mutex.Unlock()
 }
+
+func (fdl *FileDownloadsList) RemoveChunkNumberFromMetaData(hash []byte, chunkNumber uint64) {
+	fdl.mutex.Lock()
+	for i, download := range fdl.fileDownloads {
+		if bytes.Equal(download.metaData.HashValue, hash) {
+			fdl.fileDownloads[i].metaData.ChunkMap = removeChunkNumber(fdl.fileDownloads[i].metaData.ChunkMap, chunkNumber)
+		}
+	}
+	fdl.mutex.Unlock()
+}
+
+// Time between two checks for the routes of the downloads to resume
+const DOWNLOAD_RESUME_INTERVAL = time.Second
+
+// Time a download waits for routes before it is listed paused, for the user to resume it
+const DOWNLOAD_RESUME_TIMEOUT = 5 * time.Minute
+
+// A download kept in the store until it ends
+type storedDownload struct {
+	Request DataRequest
+	Paused  bool
+}
+
+func downloadStoreKey(hash []byte) string {
+	return STORE_DOWNLOAD_PREFIX + hex.EncodeToString(hash)
+}
+
+// Remember a download until it ends, so it is resumed if we stop before
+func (gsspr *Gossiper) journalDownload(request DataRequest, paused bool) {
+	if gsspr.store == nil {
+		return
+	}
+	checkStoreError(gsspr.store.Put(downloadStoreKey(request.HashValue), &storedDownload{
+		Request: request,
+		Paused:  paused,
+	}))
+}
+
+// Whether the download of the file was paused before we stopped
+func (gsspr *Gossiper) isDownloadJournaledPaused(hash []byte) bool {
+	stored := storedDownload{}
+	return gsspr.store != nil && gsspr.store.Get(downloadStoreKey(hash), &stored) && stored.Paused
+}
+
+// Hashes of the files of the downloads kept to be resumed
+func (gsspr *Gossiper) journaledDownloads() [][]byte {
+	hashes := make([][]byte, 0)
+	if gsspr.store == nil {
+		return hashes
+	}
+	for _, value := range gsspr.store.Scan(STORE_DOWNLOAD_PREFIX) {
+		stored := storedDownload{}
+		if protobuf.Decode(value, &stored) == nil {
+			hashes = append(hashes, stored.Request.HashValue)
+		}
+	}
+	return hashes
+}
+
+func (gsspr *Gossiper) forgetDownload(hash []byte) {
+	if gsspr.store == nil {
+		return
+	}
+	checkStoreError(gsspr.store.Delete(downloadStoreKey(hash)))
+}
+
+// Check that a download can progress: the node it asks first can be reached if we don't have
+// its metafile yet, otherwise one holder of each missing chunk can be reached
+func (gsspr *Gossiper) canRouteDownload(request DataRequest) bool {
+	metaData := gsspr.metaDataList.GetByHash(request.HashValue)
+	if metaData == nil {
+		return request.Destination == "" || gsspr.routingTable.GetAddress(request.Destination) != ""
+	}
+	chunkCount := GetChunkNumber(metaData.MetaFile, gsspr.hashSize)
+	// The chunk map is sorted
+	next := 0
+	for chunkNumber := uint64(1); chunkNumber <= chunkCount; chunkNumber++ {
+		if next < len(metaData.ChunkMap) && metaData.ChunkMap[next] == chunkNumber {
+			next++
+			continue
+		}
+		reachable := false
+		for _, holder := range gsspr.chunkHolders(metaData, chunkNumber-1) {
+			reachable = reachable || gsspr.routingTable.GetAddress(holder) != ""
+		}
+		if !reachable {
+			return false
+		}
+	}
+	return true
+}
+
+// Peers that have the chunk in position index: the origin the metadata assigns it to and
+// every peer that listed it in a search reply
+func (gsspr *Gossiper) chunkHolders(metaData *FileMetaData, index uint64) []string {
+	holders := gsspr.searchList.GetHolders(metaData.HashValue, index+1)
+	if len(metaData.Origins) > 0 {
+		origin := metaData.Origins[index%uint64(len(metaData.Origins))]
+		known := origin == ""
+		for _, holder := range holders {
+			known = known || holder == origin
+		}
+		if !known {
+			holders = append([]string{origin}, holders...)
+		}
+	}
+	return holders
+}
+
+// List a download paused once it waited DOWNLOAD_RESUME_TIMEOUT for routes, the user resumes it
+func (gsspr *Gossiper) pauseUnroutableDownload(request DataRequest) {
+	gsspr.journalDownload(request, true)
+	logDownloadUnroutable(request.FileName)
+	go StartFileDownload(gsspr, request)
+}
+
+// Restart the downloads that were not complete when we stopped, each one once it can be
+// routed, or listed paused after DOWNLOAD_RESUME_TIMEOUT. Paused downloads are listed again right away. The chunks kept in the chunk
+// directory are not requested again
+func (gsspr *Gossiper) StartResumingDownloads(wait *sync.WaitGroup) {
+	go func() {
+		defer wait.Done()
+		if gsspr.store == nil {
+			return
+		}
+		pending := make([]DataRequest, 0)
+		for _, value := range gsspr.store.Scan(STORE_DOWNLOAD_PREFIX) {
+			stored := storedDownload{}
+			if protobuf.Decode(value, &stored) != nil {
+				continue
+			}
+			if stored.Paused {
+				go StartFileDownload(gsspr, stored.Request)
+			} else {
+				pending = append(pending, stored.Request)
+			}
+		}
+		ticker := time.NewTicker(DOWNLOAD_RESUME_INTERVAL)
+		defer ticker.Stop()
+		start := time.Now()
+		for len(pending) > 0 && gsspr.waitTick(ticker) {
+			if time.Since(start) > DOWNLOAD_RESUME_TIMEOUT {
+				for _, request := range pending {
+					gsspr.pauseUnroutableDownload(request)
+				}
+				return
+			}
+			waiting := make([]DataRequest, 0, len(pending))
+			for _, request := range pending {
+				if gsspr.canRouteDownload(request) {
+					go StartFileDownload(gsspr, request)
+				} else {
+					waiting = append(waiting, request)
+				}
+			}
+			pending = waiting
+		}
+	}()
+}
+
+// Block while a download is paused, returns false if it was cancelled or the gossiper stopped
+func (gsspr *Gossiper) waitWhilePaused(download *FileDownload) bool {
+	for {
+		switch gsspr.fileDownloadsList.getStatus(download) {
+		case DOWNLOAD_CANCELLED:
+			return false
+		case DOWNLOAD_PAUSED:
+			select {
+			case <-download.wake:
+			case <-gsspr.quit:
+				return false
+			}
+		default:
+			return true
+		}
+	}
+}
+
+// State of the downloads in progress, then of the last ones that ended
+func (gsspr *Gossiper) GetDownloads() []DownloadInfo {
+	return gsspr.fileDownloadsList.GetDownloads()
+}
+
+// Stop requesting the chunks of a download until it is resumed, also after a restart.
+// Returns false if the file is not being downloaded
+func (gsspr *Gossiper) PauseDownload(hash []byte) bool {
+	download := gsspr.fileDownloadsList.GetByHash(hash)
+	if download == nil || !gsspr.fileDownloadsList.setStatus(hash, []string{DOWNLOAD_ACTIVE}, DOWNLOAD_PAUSED) {
+		return false
+	}
+	if download.journaled {
+		gsspr.journalDownload(download.request, true)
+	}
+	logDownloadPaused(download.request.FileName)
+	return true
+}
+
+func (gsspr *Gossiper) ResumeDownload(hash []byte) bool {
+	download := gsspr.fileDownloadsList.GetByHash(hash)
+	if download == nil || !gsspr.fileDownloadsList.setStatus(hash, []string{DOWNLOAD_PAUSED}, DOWNLOAD_ACTIVE) {
+		return false
+	}
+	if download.journaled {
+		gsspr.journalDownload(download.request, false)
+	}
+	logDownloadResumed(download.request.FileName)
+	return true
+}
+
+// Stop a download for good, the chunks already received are kept
+func (gsspr *Gossiper) CancelDownload(hash []byte) bool {
+	return gsspr.fileDownloadsList.setStatus(hash, []string{DOWNLOAD_ACTIVE, DOWNLOAD_PAUSED}, DOWNLOAD_CANCELLED)
+}
+
+// Cancel a download and wait until it stopped, so that it doesn't save chunks anymore
+func (gsspr *Gossiper) cancelDownloadAndWait(hash []byte) {
+	download := gsspr.fileDownloadsList.GetByHash(hash)
+	if download == nil || !gsspr.CancelDownload(hash) {
+		return
+	}
+	select {
+	case <-download.done:
+	case <-gsspr.quit:
+	}
+}
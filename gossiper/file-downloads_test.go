@@ -0,0 +1,151 @@
+package gossiper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadRoutableWithOneHolderPerMissingChunk(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "")
+	metaFile := make([]byte, 0)
+	for i := 0; i < 3; i++ {
+		hash := sha256.Sum256([]byte{byte(i)})
+		metaFile = append(metaFile, hash[:]...)
+	}
+	metaFileHash := sha256.Sum256(metaFile)
+	alice.metaDataList.Add(FileMetaData{
+		Origins:   []string{"bob", "carol", "dave"},
+		Name:      "file",
+		MetaFile:  metaFile,
+		HashValue: metaFileHash[:],
+		ChunkMap:  []uint64{1},
+	})
+	request := DataRequest{
+		Destination: "bob",
+		HashValue:   metaFileHash[:],
+		FileName:    "file",
+	}
+
+	alice.routingTable.RegisterNextHop("carol", "127.0.0.1:5002")
+	if alice.canRouteDownload(request) {
+		t.Fatal("routable without a holder of the third chunk")
+	}
+	// Another peer listed the third chunk in a search reply, bob is still not reachable
+	alice.searchList.AddHolder(metaFileHash[:], "erin", []uint64{3})
+	alice.routingTable.RegisterNextHop("erin", "127.0.0.1:5004")
+	if !alice.canRouteDownload(request) {
+		t.Fatal("not routable with a holder of each missing chunk")
+	}
+}
+
+// Download info listed by the GUI for the file with the given hash, nil if it isn't listed
+func listedDownload(t *testing.T, gsspr *Gossiper, hash []byte) *DownloadInfo {
+	downloads := []DownloadInfo{}
+	requestGUI(t, gsspr, "GET", "/download", "", &downloads)
+	for _, download := range downloads {
+		if download.Hash == hex.EncodeToString(hash) {
+			return &download
+		}
+	}
+	return nil
+}
+
+func TestDownloadPausedResumedAndCancelled(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "")
+	// Bob never answers, the download waits for its metafile
+	bob, _ := network.NewTransport("127.0.0.1:5001")
+	defer bob.Close()
+	alice.routingTable.RegisterNextHop("bob", "127.0.0.1:5001")
+	hash := sha256.Sum256([]byte("metafile"))
+	ended := make(chan error, 1)
+	go func() {
+		ended <- downloadFile(alice, DataRequest{
+			Origin:      "alice",
+			Destination: "bob",
+			HopLimit:    10,
+			HashValue:   hash[:],
+			FileName:    "file",
+		}, nil)
+	}()
+	for alice.fileDownloadsList.GetByHash(hash[:]) == nil {
+		time.Sleep(time.Millisecond)
+	}
+	if download := listedDownload(t, alice, hash[:]); download == nil || download.Status != DOWNLOAD_ACTIVE ||
+		download.FileName != "file" {
+		t.Fatalf("download listed as %+v", download)
+	}
+
+	body := hex.EncodeToString(hash[:])
+	for _, transition := range []struct {
+		path   string
+		code   int
+		status string
+	}{
+		{"/download/resume", http.StatusNotFound, DOWNLOAD_ACTIVE},
+		{"/download/pause", http.StatusOK, DOWNLOAD_PAUSED},
+		{"/download/pause", http.StatusNotFound, DOWNLOAD_PAUSED},
+		{"/download/resume", http.StatusOK, DOWNLOAD_ACTIVE},
+		{"/download/pause", http.StatusOK, DOWNLOAD_PAUSED},
+		{"/download/cancel", http.StatusOK, DOWNLOAD_CANCELLED},
+		{"/download/cancel", http.StatusNotFound, DOWNLOAD_CANCELLED},
+	} {
+		if code := requestGUI(t, alice, "POST", transition.path, body, nil); code != transition.code {
+			t.Fatalf("%s answered %d instead of %d", transition.path, code, transition.code)
+		}
+		if transition.status == DOWNLOAD_CANCELLED && transition.code == http.StatusOK {
+			if err := <-ended; err != ErrDownloadCancelled {
+				t.Fatalf("download ended with %v", err)
+			}
+		}
+		if download := listedDownload(t, alice, hash[:]); download == nil || download.Status != transition.status {
+			t.Fatalf("download listed as %+v after %s instead of %s", download, transition.path, transition.status)
+		}
+	}
+	if code := requestGUI(t, alice, "POST", "/download/pause", "not hex", nil); code != http.StatusBadRequest {
+		t.Fatalf("invalid hash answered %d", code)
+	}
+}
+
+func TestDownloadProgressListed(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "")
+	bob := newTestGossiper(t, network, "bob", "127.0.0.1:5001", "")
+	var wait sync.WaitGroup
+	wait.Add(2)
+	alice.StartListeningGossip(&wait)
+	bob.StartListeningGossip(&wait)
+	alice.routingTable.RegisterNextHop("bob", "127.0.0.1:5001")
+	bob.routingTable.RegisterNextHop("alice", "127.0.0.1:5000")
+	os.MkdirAll(bob.chunkFilesDir, 0755)
+	os.MkdirAll(alice.chunkFilesDir, 0755)
+	content := bytes.Repeat([]byte("progress "), 3000)
+	shared, err := bob.indexContent(bytes.NewReader(content), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = downloadFile(alice, DataRequest{
+		Origin:      "alice",
+		Destination: "bob",
+		HopLimit:    10,
+		HashValue:   shared.HashValue,
+		FileName:    "file",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := GetChunkNumber(shared.MetaFile, bob.hashSize)
+	download := listedDownload(t, alice, shared.HashValue)
+	if download == nil || download.Status != DOWNLOAD_COMPLETED || download.TotalChunks != chunks ||
+		uint64(download.Chunks) != chunks {
+		t.Fatalf("completed download of %d chunks listed as %+v", chunks, download)
+	}
+}
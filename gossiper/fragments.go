@@ -0,0 +1,161 @@
+package gossiper
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Largest datagram sent without fragmentation, below the 65507 bytes limit of UDP over IPv4
+const MAX_DATAGRAM_SIZE = 60000
+const FRAGMENT_TIMEOUT = 10 * time.Second
+const MAX_PENDING_REASSEMBLIES = 256
+
+// Fragments start with 0xFF, which is never the first byte of an encoded GossipPacket,
+// so peers that don't fragment just fail to decode them
+var fragmentMagic = [2]byte{0xFF, 0xF7}
+
+// magic (2 bytes) + packet id (8 bytes) + fragment index (2 bytes) + fragment count (2 bytes)
+const FRAGMENT_HEADER_SIZE = 14
+const MAX_FRAGMENT_COUNT = 0xFFFF
+
+type partialPacket struct {
+	fragments  [][]byte
+	received   int
+	lastUpdate time.Time
+}
+
+// Transport that splits datagrams bigger than maxDatagramSize into fragments
+// and reassembles them on the receiving side
+type FragmentingTransport struct {
+	inner           Transport
+	maxDatagramSize int
+	timeout         time.Duration
+	nextId          uint64
+	pending         map[string]*partialPacket
+	mutex           *sync.Mutex
+}
+
+func NewFragmentingTransport(inner Transport, maxDatagramSize int, timeout time.Duration) *FragmentingTransport {
+	return &FragmentingTransport{
+		inner:           inner,
+		maxDatagramSize: maxDatagramSize,
+		timeout:         timeout,
+		nextId:          uint64(rand.Int63()),
+		pending:         make(map[string]*partialPacket),
+		mutex:           &sync.Mutex{},
+	}
+}
+
+func (ft *FragmentingTransport) Send(data []byte, address string) error {
+	if len(data) <= ft.maxDatagramSize {
+		return ft.inner.Send(data, address)
+	}
+	payloadSize := ft.maxDatagramSize - FRAGMENT_HEADER_SIZE
+	count := (len(data) + payloadSize - 1) / payloadSize
+	if count > MAX_FRAGMENT_COUNT {
+		return ErrPacketTooBig
+	}
+	id := atomic.AddUint64(&ft.nextId, 1)
+	for index := 0; index < count; index++ {
+		end := (index + 1) * payloadSize
+		if end > len(data) {
+			end = len(data)
+		}
+		fragment := make([]byte, FRAGMENT_HEADER_SIZE, FRAGMENT_HEADER_SIZE+end-index*payloadSize)
+		copy(fragment, fragmentMagic[:])
+		binary.BigEndian.PutUint64(fragment[2:10], id)
+		binary.BigEndian.PutUint16(fragment[10:12], uint16(index))
+		binary.BigEndian.PutUint16(fragment[12:14], uint16(count))
+		fragment = append(fragment, data[index*payloadSize:end]...)
+		err := ft.inner.Send(fragment, address)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Block until a complete packet arrives, fragments are kept until all the others arrive or they expire
+func (ft *FragmentingTransport) Receive() ([]byte, string, error) {
+	for {
+		data, source, err := ft.inner.Receive()
+		if err != nil {
+			return nil, "", err
+		}
+		if !isFragment(data) {
+			return data, source, nil
+		}
+		packet := ft.addFragment(data, source)
+		if packet != nil {
+			return packet, source, nil
+		}
+	}
+}
+
+func (ft *FragmentingTransport) LocalAddress() string {
+	return ft.inner.LocalAddress()
+}
+
+func (ft *FragmentingTransport) Close() error {
+	return ft.inner.Close()
+}
+
+func isFragment(data []byte) bool {
+	return len(data) >= FRAGMENT_HEADER_SIZE && data[0] == fragmentMagic[0] && data[1] == fragmentMagic[1]
+}
+
+// Store a fragment, returns the whole packet if it was the last one missing
+func (ft *FragmentingTransport) addFragment(data []byte, source string) []byte {
+	index := int(binary.BigEndian.Uint16(data[10:12]))
+	count := int(binary.BigEndian.Uint16(data[12:14]))
+	if count == 0 || index >= count {
+		return nil
+	}
+	key := source + "/" + string(data[2:10])
+
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	now := time.Now()
+	ft.removeExpired(now)
+	partial, exists := ft.pending[key]
+	if !exists {
+		if len(ft.pending) >= MAX_PENDING_REASSEMBLIES {
+			return nil
+		}
+		partial = &partialPacket{
+			fragments: make([][]byte, count),
+		}
+		ft.pending[key] = partial
+	}
+	if len(partial.fragments) != count {
+		// Inconsistent header, drop the whole packet
+		delete(ft.pending, key)
+		return nil
+	}
+	partial.lastUpdate = now
+	if partial.fragments[index] == nil {
+		partial.fragments[index] = append([]byte{}, data[FRAGMENT_HEADER_SIZE:]...)
+		partial.received++
+	}
+	if partial.received < count {
+		return nil
+	}
+	delete(ft.pending, key)
+	packet := make([]byte, 0)
+	for _, fragment := range partial.fragments {
+		packet = append(packet, fragment...)
+	}
+	return packet
+}
+
+// Drop partial packets that didn't receive any fragment for longer than the timeout
+func (ft *FragmentingTransport) removeExpired(now time.Time) {
+	for key, partial := range ft.pending {
+		if now.Sub(partial.lastUpdate) > ft.timeout {
+			delete(ft.pending, key)
+		}
+	}
+}
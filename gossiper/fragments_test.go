@@ -0,0 +1,164 @@
+package gossiper
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// Transport keeping the datagrams sent through it
+type recordingTransport struct {
+	sent [][]byte
+}
+
+func (rt *recordingTransport) Send(data []byte, address string) error {
+	rt.sent = append(rt.sent, append([]byte{}, data...))
+	return nil
+}
+
+func (rt *recordingTransport) Receive() ([]byte, string, error) {
+	return nil, "", ErrTransportClosed
+}
+
+func (rt *recordingTransport) LocalAddress() string {
+	return "127.0.0.1:5000"
+}
+
+func (rt *recordingTransport) Close() error {
+	return nil
+}
+
+func randomPacket(size int) []byte {
+	packet := make([]byte, size)
+	rand.Read(packet)
+	// Packets never start with the magic of fragments
+	packet[0] = 0
+	return packet
+}
+
+func TestFragmentsReassembledOverNetwork(t *testing.T) {
+	network := NewMemoryNetwork()
+	senderInner, _ := network.NewTransport("127.0.0.1:5000")
+	receiverInner, _ := network.NewTransport("127.0.0.1:5001")
+	sender := NewFragmentingTransport(senderInner, 100, FRAGMENT_TIMEOUT)
+	receiver := NewFragmentingTransport(receiverInner, 100, FRAGMENT_TIMEOUT)
+	defer sender.Close()
+	defer receiver.Close()
+
+	for _, size := range []int{1, 100, 101, 1000, 4321} {
+		packet := randomPacket(size)
+		err := sender.Send(packet, "127.0.0.1:5001")
+		if err != nil {
+			t.Fatal(err)
+		}
+		received, source, err := receiver.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if source != "127.0.0.1:5000" || !bytes.Equal(received, packet) {
+			t.Errorf("packet of %d bytes received as %d bytes from %s", size, len(received), source)
+		}
+	}
+}
+
+func TestFragmentsOutOfOrderAndDuplicated(t *testing.T) {
+	recorder := &recordingTransport{}
+	sender := NewFragmentingTransport(recorder, 64, FRAGMENT_TIMEOUT)
+	packet := randomPacket(1000)
+	sender.Send(packet, "127.0.0.1:5001")
+	fragments := recorder.sent
+	if len(fragments) != (1000+63-FRAGMENT_HEADER_SIZE)/(64-FRAGMENT_HEADER_SIZE) {
+		t.Fatalf("%d fragments sent", len(fragments))
+	}
+	for _, fragment := range fragments {
+		if len(fragment) > 64 {
+			t.Fatalf("fragment of %d bytes", len(fragment))
+		}
+	}
+
+	receiver := NewFragmentingTransport(&recordingTransport{}, 64, FRAGMENT_TIMEOUT)
+	order := rand.Perm(len(fragments))
+	for i, index := range order {
+		reassembled := receiver.addFragment(fragments[index], "127.0.0.1:5000")
+		if i < len(order)-1 {
+			if reassembled != nil {
+				t.Fatalf("packet reassembled after %d of %d fragments", i+1, len(order))
+			}
+			// A duplicate doesn't count as a new fragment
+			if receiver.addFragment(fragments[index], "127.0.0.1:5000") != nil {
+				t.Fatal("packet reassembled from a duplicate fragment")
+			}
+			continue
+		}
+		if !bytes.Equal(reassembled, packet) {
+			t.Fatal("reassembled packet differs from the one sent")
+		}
+	}
+	if len(receiver.pending) != 0 {
+		t.Errorf("%d partial packets left", len(receiver.pending))
+	}
+}
+
+func TestFragmentsOfDifferentSourcesKeptApart(t *testing.T) {
+	recorder := &recordingTransport{}
+	sender := NewFragmentingTransport(recorder, 64, FRAGMENT_TIMEOUT)
+	sender.Send(randomPacket(200), "127.0.0.1:5001")
+	fragments := recorder.sent
+
+	receiver := NewFragmentingTransport(&recordingTransport{}, 64, FRAGMENT_TIMEOUT)
+	for i, fragment := range fragments {
+		// Same packet id from another source
+		source := "127.0.0.1:5000"
+		if i == len(fragments)-1 {
+			source = "127.0.0.1:5002"
+		}
+		if receiver.addFragment(fragment, source) != nil {
+			t.Fatal("packet reassembled from fragments of two sources")
+		}
+	}
+}
+
+func TestIncompletePacketsExpire(t *testing.T) {
+	recorder := &recordingTransport{}
+	sender := NewFragmentingTransport(recorder, 64, FRAGMENT_TIMEOUT)
+	packet := randomPacket(200)
+	sender.Send(packet, "127.0.0.1:5001")
+	fragments := recorder.sent
+
+	receiver := NewFragmentingTransport(&recordingTransport{}, 64, 10*time.Millisecond)
+	for _, fragment := range fragments[1:] {
+		receiver.addFragment(fragment, "127.0.0.1:5000")
+	}
+	time.Sleep(50 * time.Millisecond)
+	// The other fragments expired, the first one starts a new packet
+	if receiver.addFragment(fragments[0], "127.0.0.1:5000") != nil {
+		t.Fatal("packet reassembled with expired fragments")
+	}
+	if len(receiver.pending) != 1 {
+		t.Errorf("%d partial packets kept", len(receiver.pending))
+	}
+}
+
+func TestInconsistentFragmentCountDropsPacket(t *testing.T) {
+	recorder := &recordingTransport{}
+	sender := NewFragmentingTransport(recorder, 64, FRAGMENT_TIMEOUT)
+	sender.Send(randomPacket(200), "127.0.0.1:5001")
+	fragments := recorder.sent
+
+	receiver := NewFragmentingTransport(&recordingTransport{}, 64, FRAGMENT_TIMEOUT)
+	receiver.addFragment(fragments[0], "127.0.0.1:5000")
+	forged := append([]byte{}, fragments[1]...)
+	forged[13]++
+	if receiver.addFragment(forged, "127.0.0.1:5000") != nil || len(receiver.pending) != 0 {
+		t.Fatal("fragment with another count kept with the packet")
+	}
+}
+
+func TestPacketTooBig(t *testing.T) {
+	sender := NewFragmentingTransport(&recordingTransport{}, FRAGMENT_HEADER_SIZE+1, FRAGMENT_TIMEOUT)
+	err := sender.Send(randomPacket(MAX_FRAGMENT_COUNT+1), "127.0.0.1:5001")
+	if err != ErrPacketTooBig {
+		t.Fatalf("got %v instead of ErrPacketTooBig", err)
+	}
+}
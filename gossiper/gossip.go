@@ -1,20 +1,15 @@
 package gossiper
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"github.com/dedis/protobuf"
 	"github.com/eliasmpw/Peerster/common"
-	"io/ioutil"
 	"math/rand"
-	"net"
-	"os"
 	"path/filepath"
 	"strconv"
 	"time"
 )
 
-func onMessageReceived(gsspr *Gossiper, message []byte, sourceAddr *net.UDPAddr, isClient bool) {
+func onMessageReceived(gsspr *Gossiper, message []byte, sourceAddr string, isClient bool) {
 	// Decode message
 	var packetReceived = GossipPacket{}
 	protobuf.Decode(message, &packetReceived)
@@ -25,105 +20,70 @@ func onMessageReceived(gsspr *Gossiper, message []byte, sourceAddr *net.UDPAddr,
 	}
 }
 
-func handleClientMessage(gsspr *Gossiper, packetReceived *GossipPacket, sourceAddr *net.UDPAddr) {
+func handleClientMessage(gsspr *Gossiper, packetReceived *GossipPacket, sourceAddr string) {
 	// Handle a message received from the client
 	if packetReceived.Simple != nil {
 		if packetReceived.Simple.OriginalName == "file" && packetReceived.Simple.RelayPeerAddr == "file" {
 			// If it has values of "file" in OriginalName and RelayPeerAddress,
 			// handle it as a file index/share request
 			fileName := filepath.Base(packetReceived.Simple.Contents)
-			absPath, err := filepath.Abs("")
-			common.CheckError(err)
-			path := absPath +
-				string(os.PathSeparator) +
-				gsspr.sharedFilesDir +
-				fileName
-			// Read the file
-			fileContent, err := ioutil.ReadFile(path)
-			common.CheckError(err)
-			fileSize := uint64(len(fileContent))
-			// Divide the file into chunks
-			chunks := SplitToChunks(fileContent, gsspr.chunkSize)
-			// Create hashes for chunks
-			hashes := CreateChunkHashes(chunks)
-			// Create MetaFile of all hashes
-			var metaFile []byte
-			for _, hash := range hashes {
-				metaFile = append(metaFile, hash...)
+			metaData, err := gsspr.indexSharedEntry(fileName)
+			if err != nil {
+				// A missing file or a folder too big to share doesn't stop the gossiper
+				logSharedFileIndexFailed(fileName, err.Error())
+				return
 			}
-			// Create hash of metafile
-			h := sha256.New()
-			h.Write(metaFile)
-			hashValue := h.Sum(nil)
-			chunkCount := GetChunkNumber(metaFile)
-			completeChunkMap := make([]uint64, chunkCount)
-			for i := uint64(0); i < chunkCount; i++ {
-				completeChunkMap[i] = uint64(i + 1)
-			}
-			// Add to the MetaData List
-			fmdAux := FileMetaData{
-				Origins:   []string{gsspr.Name},
-				Name:      fileName,
-				Size:      fileSize,
-				MetaFile:  metaFile,
-				HashValue: hashValue,
-				ChunkMap:  completeChunkMap,
-			}
-			gsspr.metaDataList.Add(fmdAux)
-
-			// Store the file in the disk
-			downloadDir := absPath + string(os.PathSeparator) + gsspr.sharedFilesDir
-			// Store the file
-			WriteFileOnDisk(fileContent, downloadDir, fileName)
-			// Store the chunks
-			WriteChunksOnDisk(*chunks, gsspr.chunkFilesDir, fileName)
-			processTransactionReceived(gsspr, TxPublish{
-				File: File{
-					Name: fileName,
-					Size: int64(fileSize),
-					MetafileHash: hashValue,
-				},
-				HopLimit: uint32(gsspr.hopLimit), // Set to 10 by default
-			}, "")
-			logFileShared(fileName, hex.EncodeToString(hashValue))
-			broadcastNewFile(gsspr, File{
-				Name:         fmdAux.Name,
-				Size:         int64(fmdAux.Size),
-				MetafileHash: fmdAux.HashValue,
-			})
+			gsspr.publishSharedFile(*metaData)
 		} else {
 			// Else handle as a gossip message
-			newPackage := GossipPacket{
-				Rumor: &RumorMessage{
-					Origin: gsspr.Name,
-					ID:     gsspr.Vc.GetNextId(gsspr.Name),
-					Text:   packetReceived.Simple.Contents,
-				},
-			}
-			ok := gsspr.Vc.Update(newPackage.Rumor.Origin, newPackage.Rumor.ID)
-			if ok {
-				gsspr.addToAllRumorMessagesList(*newPackage.Rumor)
-				logClientMessage(*packetReceived)
-				randomPeer := GetRandomPeer(gsspr, "")
-				if randomPeer != "" {
-					RumorMonger(gsspr, randomPeer, newPackage)
-				}
-			}
+			logClientMessage(*packetReceived)
+			publishRumor(gsspr, packetReceived.Simple.Contents, "")
 		}
 	}
+	if packetReceived.Rumor != nil && packetReceived.Rumor.Text != "" {
+		// Handle gossip message with a topic, we subscribe to the topics we publish in
+		gsspr.Subscribe(packetReceived.Rumor.Topic)
+		logClientTopicMessage(*packetReceived.Rumor)
+		publishRumor(gsspr, packetReceived.Rumor.Text, packetReceived.Rumor.Topic)
+	}
 	if packetReceived.Private != nil {
 		// Handle private message
 		newPackage := GossipPacket{
 			Private: &PrivateMessage{
 				Origin:      gsspr.Name,
-				ID:          0,
+				ID:          gsspr.privateMessages.NextId(packetReceived.Private.Destination),
 				Text:        packetReceived.Private.Text,
 				Destination: packetReceived.Private.Destination,
 				HopLimit:    packetReceived.Private.HopLimit,
 			},
 		}
 		gsspr.addToAllPrivateMessagesList(*newPackage.Private)
-		RoutePrivateMessage(gsspr, newPackage)
+		go sendPrivateMessageReliably(gsspr, *newPackage.Private, time.Now().Add(MAILBOX_TTL))
+	}
+	if packetReceived.Group != nil && packetReceived.Group.Group != "" {
+		groupMessage := packetReceived.Group
+		if groupMessage.Text == "" {
+			// Create the group, or change its members
+			gsspr.groups.Set(groupMessage.Group, append(groupMessage.Members, gsspr.Name))
+		} else {
+			// Handle group message, sent to the known members of the group if none are given
+			members := groupMessage.Members
+			if len(members) == 0 {
+				members = gsspr.groups.GetMembers(groupMessage.Group)
+			}
+			hopLimit := groupMessage.HopLimit
+			if hopLimit == 0 {
+				hopLimit = uint32(gsspr.hopLimit)
+			}
+			sendGroupMessage(gsspr, GroupMessage{
+				Origin:   gsspr.Name,
+				ID:       gsspr.groups.NextId(),
+				Group:    groupMessage.Group,
+				Members:  members,
+				HopLimit: hopLimit,
+				Text:     groupMessage.Text,
+			})
+		}
 	}
 	if packetReceived.DataRequest != nil {
 		// Handle download request
@@ -147,36 +107,71 @@ func handleClientMessage(gsspr *Gossiper, packetReceived *GossipPacket, sourceAd
 	}
 }
 
-func handleMessage(gsspr *Gossiper, packetReceived *GossipPacket, sourceAddr *net.UDPAddr) {
+// Create a rumor from our client and start mongering it
+func publishRumor(gsspr *Gossiper, text, topic string) {
+	newPackage := GossipPacket{
+		Rumor: gsspr.newRumor(text, topic),
+	}
+	if topic != "" {
+		gsspr.topics.Add(*newPackage.Rumor)
+	}
+	randomPeer := GetRandomPeer(gsspr, "")
+	if randomPeer != "" {
+		RumorMonger(gsspr, randomPeer, newPackage)
+	}
+}
+
+func handleMessage(gsspr *Gossiper, packetReceived *GossipPacket, sourceAddr string) {
 	// Handle a message received from a peer
 	if packetReceived.Rumor != nil {
-		addPeerToList(gsspr, sourceAddr.String())
+		if !gsspr.keyStore.VerifyRumor(packetReceived.Rumor, gsspr.unsignedRumorPolicy) {
+			// Drop rumors that don't come from the origin they claim
+			return
+		}
+		if packetReceived.Rumor.Signature != nil && packetReceived.Rumor.Origin != gsspr.Name &&
+			!gsspr.keyStore.RegisterEncryptionKey(packetReceived.Rumor.Origin, packetReceived.Rumor.EncryptionKey) {
+			// Signed by the origin, but with another encryption key than the one we pinned
+			logEncryptionKeyConflict(packetReceived.Rumor.Origin, sourceAddr)
+			return
+		}
+		addPeerToList(gsspr, sourceAddr)
 		ok := gsspr.Vc.Update(packetReceived.Rumor.Origin, packetReceived.Rumor.ID)
 		if ok {
-			if packetReceived.Rumor.Origin != gsspr.Name && sourceAddr.String() != gsspr.addressStr {
-				gsspr.routingTable.RegisterNextHop(packetReceived.Rumor.Origin, sourceAddr.String())
+			if packetReceived.Rumor.Origin != gsspr.Name && sourceAddr != gsspr.addressStr {
+				gsspr.routingTable.RegisterNextHop(packetReceived.Rumor.Origin, sourceAddr)
+				// The origin is reachable, deliver what we kept for it
+				deliverMailbox(gsspr, packetReceived.Rumor.Origin)
+			}
+			// Rumors of topics we are not subscribed to are only kept in memory to relay them
+			if packetReceived.Rumor.Topic == "" || gsspr.topics.Add(*packetReceived.Rumor) {
+				gsspr.addToAllRumorMessagesList(*packetReceived.Rumor)
+				if packetReceived.Rumor.Text != "" {
+					logRumorMessage(*packetReceived, sourceAddr)
+				}
 			}
-			gsspr.addToAllRumorMessagesList(*packetReceived.Rumor)
 			if packetReceived.Rumor.Text != "" {
-				logRumorMessage(*packetReceived, sourceAddr.String())
 				logPeers(gsspr)
 			}
 			newPackage := GossipPacket{
-				Status: gsspr.Vc.MakeCopy(),
+				Status: gsspr.newStatus(),
 			}
-			gsspr.sendGossipQueue <- &QueuedMessage{
+			gsspr.queueGossip(&QueuedMessage{
 				packet:      newPackage,
-				destination: sourceAddr.String(),
-			}
+				destination: sourceAddr,
+			})
 		}
 	}
 	if packetReceived.Status != nil {
-		addPeerToList(gsspr, sourceAddr.String())
-		logStatusMessage(*packetReceived, sourceAddr.String())
+		if !gsspr.keyStore.VerifyStatus(packetReceived.Status, gsspr.unsignedRumorPolicy) {
+			// Drop status packets that don't come from the node they claim
+			return
+		}
+		addPeerToList(gsspr, sourceAddr)
+		logStatusMessage(*packetReceived, sourceAddr)
 		logPeers(gsspr)
 		for _, status := range packetReceived.Status.Want {
 			// Check if there are status that we were waiting for
-			channelListenId := generateChannelListenId(sourceAddr.String(), status.Identifier, status.NextID)
+			channelListenId := generateChannelListenId(sourceAddr, status.Identifier, status.NextID)
 			gsspr.mutex.Lock()
 			channel, exists := gsspr.channelsListening[channelListenId]
 			if exists && channel != nil {
@@ -188,39 +183,68 @@ func handleMessage(gsspr *Gossiper, packetReceived *GossipPacket, sourceAddr *ne
 			gsspr.mutex.Unlock()
 		}
 
-		CompareVectorClocks(gsspr, sourceAddr.String(), *packetReceived.Status)
+		CompareVectorClocks(gsspr, sourceAddr, *packetReceived.Status)
 	}
 	if packetReceived.Private != nil {
 		if packetReceived.Private.Destination == gsspr.Name {
+			originKey := gsspr.keyStore.GetEncryptionKey(packetReceived.Private.Origin)
+			if packetReceived.Private.Sealed != nil {
+				// Drop messages that can't be opened with the key of their origin
+				err := openPrivateMessage(gsspr.keys, originKey, packetReceived.Private)
+				if err != nil {
+					return
+				}
+			} else if originKey != nil {
+				// The origin seals its messages, a relay replaced the sealed text
+				return
+			}
+			if packetReceived.Private.ID != 0 && !gsspr.privateMessages.AddReceived(packetReceived.Private.Origin, packetReceived.Private.ID) {
+				// Already received, our acknowledgment was probably lost
+				sendPrivateAck(gsspr, *packetReceived.Private, false)
+				return
+			}
 			logPrivateMessage(*packetReceived)
 			gsspr.addToAllPrivateMessagesList(*packetReceived.Private)
+			sendPrivateAck(gsspr, *packetReceived.Private, false)
 		} else {
 			RoutePrivateMessage(gsspr, *packetReceived)
 		}
 	}
 	if packetReceived.DataRequest != nil {
 		// Handle data request
-		ProcessDataRequest(gsspr, *packetReceived.DataRequest, sourceAddr.String())
+		ProcessDataRequest(gsspr, *packetReceived.DataRequest, sourceAddr)
 	}
 	if packetReceived.DataReply != nil {
 		// Handle data reply
-		processDataReply(gsspr, *packetReceived.DataReply, sourceAddr.String())
+		processDataReply(gsspr, *packetReceived.DataReply, sourceAddr)
 	}
 	if packetReceived.SearchRequest != nil {
 		// Handle search request
-		ProcessSearchRequest(gsspr, *packetReceived.SearchRequest, sourceAddr.String())
+		ProcessSearchRequest(gsspr, *packetReceived.SearchRequest, sourceAddr)
 	}
 	if packetReceived.SearchReply != nil {
 		// Handle data reply
-		processSearchReply(gsspr, *packetReceived.SearchReply, sourceAddr.String())
+		processSearchReply(gsspr, *packetReceived.SearchReply, sourceAddr)
 	}
 	if packetReceived.TxPublish != nil {
 		// Handle transaction received
-		processTransactionReceived(gsspr, *packetReceived.TxPublish, sourceAddr.String())
+		processTransactionReceived(gsspr, *packetReceived.TxPublish, sourceAddr)
 	}
 	if packetReceived.BlockPublish != nil {
 		// Handle block publish received
-		processBlockPublishReceived(gsspr, *packetReceived.BlockPublish, sourceAddr.String())
+		processBlockPublishReceived(gsspr, *packetReceived.BlockPublish, sourceAddr)
+	}
+	if packetReceived.PrivateAck != nil {
+		// Handle acknowledgment of a private message
+		processPrivateAck(gsspr, *packetReceived.PrivateAck)
+	}
+	if packetReceived.Group != nil {
+		// Handle group message
+		processGroupMessage(gsspr, *packetReceived.Group)
+	}
+	if packetReceived.MailboxDeposit != nil {
+		// Handle private message to keep until its destination is reachable
+		processMailboxDeposit(gsspr, *packetReceived.MailboxDeposit, sourceAddr)
 	}
 }
 
@@ -237,12 +261,16 @@ func GetRandomPeer(gsspr *Gossiper, ignore string) string {
 	return randomPeer
 }
 
+// Time to wait for the status answering a rumor, until the round-trip time of the peer is measured
+const RUMOR_STATUS_TIMEOUT = 1000 * time.Millisecond
+
 func RumorMonger(gsspr *Gossiper, destPeer string, packet GossipPacket) {
 	// Start mongering with a peer
-	gsspr.sendGossipQueue <- &QueuedMessage{
+	sent := time.Now()
+	gsspr.queueGossip(&QueuedMessage{
 		packet:      packet,
 		destination: destPeer,
-	}
+	})
 	logMongering(destPeer)
 	channelId := generateChannelListenId(destPeer, packet.Rumor.Origin, packet.Rumor.ID+1)
 	channelListen := make(chan *PeerStatus)
@@ -259,10 +287,11 @@ func RumorMonger(gsspr *Gossiper, destPeer string, packet GossipPacket) {
 	gsspr.mutex.Unlock()
 
 	go func() {
-		timer := time.NewTimer(1000 * time.Millisecond)
+		timer := time.NewTimer(gsspr.peerRtt.Timeout(destPeer, RUMOR_STATUS_TIMEOUT))
 		select {
 		case <-channelListen:
 			timer.Stop()
+			gsspr.peerRtt.Sample(destPeer, time.Since(sent))
 			gsspr.mutex.Lock()
 			close(channelListen)
 			gsspr.channelsListening[channelId] = nil
@@ -320,9 +349,9 @@ func RoutePrivateMessage(gsspr *Gossiper, packet GossipPacket) {
 	nextHop := gsspr.routingTable.GetAddress(packet.Private.Destination)
 
 	if packet.Private.HopLimit > 0 && nextHop != "" {
-		gsspr.sendGossipQueue <- &QueuedMessage{
+		gsspr.queueGossip(&QueuedMessage{
 			packet:      packet,
 			destination: nextHop,
-		}
+		})
 	}
 }
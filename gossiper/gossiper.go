@@ -10,9 +10,9 @@ import (
 )
 
 type Gossiper struct {
-	address                *net.UDPAddr
-	conn                   *net.UDPConn
+	transport              Transport
 	Name                   string
+	uiHost                 string
 	uiPort                 string
 	uiConn                 *net.UDPConn
 	addressStr             string
@@ -33,7 +33,8 @@ type Gossiper struct {
 	hashSize               uint
 	chunkSize              uint
 	metaDataList           MetaDataList
-	filesListening         map[string]chan *DataReply
+	chunkStore             ChunkStore
+	filesListening         map[string][]chan *DataReply
 	filesMutex             *sync.Mutex
 	fileDownloadsList      FileDownloadsList
 	searchList             SearchList
@@ -47,9 +48,33 @@ type Gossiper struct {
 	currentFork				[]Block
 	miningBlock            Block
 	blockMutex             *sync.Mutex
+	privateMessages        PrivateMessagesTracker
+	mailbox                Mailbox
+	mailboxReplicas        int
+	downloadWindow         int
+	sharedFilesWatch       int
+	scrubRepair            bool
+	// Round-trip times of our neighbours by address, and of the nodes we send requests to by name
+	peerRtt   RttEstimator
+	originRtt RttEstimator
+	groups                 GroupList
+	topics                 TopicList
+	store                  *MessageStore
+	// Next ID of our rumors when the store was loaded, our route rumors before it were replaced
+	// in the store and are signed again when a peer asks for them
+	loadedNextId           uint32
+	keys                   *KeyPair
+	keyStore               KeyStore
+	unsignedRumorPolicy    UnsignedRumorPolicy
+	streamAddress          string
+	streamListener         net.Listener
+	streamPeers            StreamPeers
+	quit                   chan struct{}
+	stopOnce               *sync.Once
 }
 
 func NewGossiper(
+	uiHost,
 	uiPort,
 	addressStr,
 	name string,
@@ -59,26 +84,83 @@ func NewGossiper(
 	sharedFilesDir string,
 	chunkFilesDir string,
 	downloadedFilesDir string,
+	storePath string,
 	hopLimit uint,
 	hashSize uint,
 	chunkSize uint,
 	maxSearchBudget int,
 	searchMatchesThreshold int,
 ) *Gossiper {
-	udpAddr, err := net.ResolveUDPAddr("udp4", addressStr)
+	udpTransport, err := NewUDPTransport(addressStr)
 	common.CheckError(err)
-	udpConn, err := net.ListenUDP("udp4", udpAddr)
+	return NewGossiperWithTransport(
+		udpTransport,
+		uiHost,
+		uiPort,
+		addressStr,
+		name,
+		peersList,
+		isSimple,
+		rTimer,
+		sharedFilesDir,
+		chunkFilesDir,
+		downloadedFilesDir,
+		storePath,
+		hopLimit,
+		hashSize,
+		chunkSize,
+		maxSearchBudget,
+		searchMatchesThreshold,
+	)
+}
+
+// Create a gossiper that exchanges packets with its peers through the given transport,
+// addressStr is the gossip address the transport is bound to
+func NewGossiperWithTransport(
+	transport Transport,
+	uiHost,
+	uiPort,
+	addressStr,
+	name string,
+	peersList []string,
+	isSimple bool,
+	rTimer int,
+	sharedFilesDir string,
+	chunkFilesDir string,
+	downloadedFilesDir string,
+	storePath string,
+	hopLimit uint,
+	hashSize uint,
+	chunkSize uint,
+	maxSearchBudget int,
+	searchMatchesThreshold int,
+) *Gossiper {
+	uiPort, uiUdpConn := common.StartLocalConnection(uiHost, uiPort)
+	keys, err := NewKeyPair()
 	common.CheckError(err)
-	uiPort, uiUdpConn := common.StartLocalConnection(uiPort)
-	return &Gossiper{
-		address:                udpAddr,
-		conn:                   udpConn,
+	// Store peers the same way the transport reports source addresses
+	canonicalPeers := make([]string, 0, len(peersList))
+	for _, peer := range peersList {
+		canonicalPeer, err := common.CanonicalAddress(peer)
+		if err != nil {
+			canonicalPeer = peer
+		}
+		canonicalPeers = append(canonicalPeers, canonicalPeer)
+	}
+	// The transport may be bound to a wildcard address, peers reach us at the configured one
+	canonicalAddress, err := common.CanonicalAddress(addressStr)
+	if err != nil {
+		canonicalAddress = transport.LocalAddress()
+	}
+	gsspr := &Gossiper{
+		transport:              NewFragmentingTransport(transport, MAX_DATAGRAM_SIZE, FRAGMENT_TIMEOUT),
 		Name:                   name,
+		uiHost:                 uiHost,
 		uiPort:                 uiPort,
 		uiConn:                 uiUdpConn,
-		addressStr:             addressStr,
+		addressStr:             canonicalAddress,
 		isSimple:               isSimple,
-		peersList:              peersList,
+		peersList:              canonicalPeers,
 		allPrivateMessages:     []PrivateMessage{},
 		allRumorMessages:       []RumorMessage{},
 		Vc:                     *NewStatusPacket(name),
@@ -94,9 +176,13 @@ func NewGossiper(
 		hashSize:               hashSize,
 		chunkSize:              chunkSize,
 		metaDataList:           *NewMetaDataList(),
-		filesListening:         make(map[string]chan *DataReply),
+		chunkStore:             *NewChunkStore(),
+		filesListening:         make(map[string][]chan *DataReply),
 		filesMutex:             &sync.Mutex{},
 		fileDownloadsList:      *NewFileDownloadsList(),
+		downloadWindow:         DEFAULT_DOWNLOAD_WINDOW,
+		peerRtt:                *NewRttEstimator(),
+		originRtt:              *NewRttEstimator(),
 		searchList:             *NewSearchList(),
 		searchesListening:      make(chan *SearchReply),
 		searchesMutex:          &sync.Mutex{},
@@ -108,7 +194,24 @@ func NewGossiper(
 		currentFork:			 []Block{},
 		miningBlock:            Block{},
 		blockMutex:             &sync.Mutex{},
+		privateMessages:        *NewPrivateMessagesTracker(),
+		mailbox:                *NewMailbox(),
+		groups:                 *NewGroupList(),
+		topics:                 *NewTopicList(),
+		keys:                   keys,
+		keyStore:               *NewKeyStore(),
+		streamPeers:            *NewStreamPeers(),
+		quit:                   make(chan struct{}),
+		stopOnce:               &sync.Once{},
+	}
+	if storePath != "" {
+		gsspr.store, err = OpenMessageStore(storePath)
+		common.CheckError(err)
+		gsspr.loadStore()
+		gsspr.metaDataList.store = gsspr.store
+		gsspr.loadFileIndex()
 	}
+	return gsspr
 }
 
 func (gsspr *Gossiper) Serve() {
@@ -116,121 +219,204 @@ func (gsspr *Gossiper) Serve() {
 	var wait sync.WaitGroup
 	if gsspr.isSimple {
 		wait.Add(3)
-		gsspr.StartListeningClientSimple(wait)
-		gsspr.StartListeningPeersSimple(wait)
-		gsspr.StartGossipSender(wait)
+		gsspr.StartListeningClientSimple(&wait)
+		gsspr.StartListeningPeersSimple(&wait)
+		gsspr.StartGossipSender(&wait)
 		wait.Wait()
 	} else {
-		wait.Add(7)
-		gsspr.StartListeningClient(wait)
-		gsspr.StartListeningGossip(wait)
-		gsspr.StartGossipSender(wait)
-		gsspr.StartRouteRumoring(wait)
-		gsspr.StartServingGUI(wait)
-		gsspr.StartAntiEntropy(wait)
-		gsspr.StartMining(wait)
+		wait.Add(11)
+		gsspr.StartListeningClient(&wait)
+		gsspr.StartListeningGossip(&wait)
+		gsspr.StartGossipSender(&wait)
+		gsspr.StartRouteRumoring(&wait)
+		gsspr.StartServingGUI(&wait)
+		gsspr.StartAntiEntropy(&wait)
+		gsspr.StartMining(&wait)
+		gsspr.StartMailboxCleaner(&wait)
+		gsspr.StartResumingDownloads(&wait)
+		gsspr.StartWatchingSharedFiles(&wait)
+		gsspr.StartScrubbingChunks(&wait)
 		wait.Wait()
 	}
 }
 
-func (gsspr *Gossiper) StartListeningClientSimple(wait sync.WaitGroup) {
+// Replace the keys generated at creation, e.g. by long-term keys loaded from disk
+func (gsspr *Gossiper) SetKeyPair(keys *KeyPair) {
+	gsspr.keys = keys
+}
+
+// Choose what to do with rumors that carry no signature
+func (gsspr *Gossiper) SetUnsignedRumorPolicy(policy UnsignedRumorPolicy) {
+	gsspr.unsignedRumorPolicy = policy
+}
+
+// Number of neighbours that also keep our private messages for unreachable destinations
+func (gsspr *Gossiper) SetMailboxReplicas(replicas int) {
+	gsspr.mailboxReplicas = replicas
+}
+
+// Number of chunk requests each download keeps outstanding
+func (gsspr *Gossiper) SetDownloadWindow(window int) {
+	if window > 0 {
+		gsspr.downloadWindow = window
+	}
+}
+
+// Stop the goroutines of the gossiper and close its connections
+func (gsspr *Gossiper) Stop() {
+	gsspr.stopOnce.Do(func() {
+		close(gsspr.quit)
+		gsspr.transport.Close()
+		gsspr.uiConn.Close()
+		if gsspr.streamListener != nil {
+			gsspr.streamListener.Close()
+		}
+		if gsspr.store != nil {
+			gsspr.store.Close()
+		}
+	})
+}
+
+func (gsspr *Gossiper) isStopped() bool {
+	select {
+	case <-gsspr.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait for the next tick, returns false if the gossiper was stopped meanwhile
+func (gsspr *Gossiper) waitTick(ticker *time.Ticker) bool {
+	select {
+	case <-gsspr.quit:
+		return false
+	case <-ticker.C:
+		return true
+	}
+}
+
+// Handle a packet as if it had been sent by the client of this gossiper
+func (gsspr *Gossiper) HandleClientPacket(packet *GossipPacket) {
+	handleClientMessage(gsspr, packet, gsspr.addressStr)
+}
+
+func (gsspr *Gossiper) StartListeningClientSimple(wait *sync.WaitGroup) {
 	go func() {
 		defer wait.Done()
 		defer gsspr.uiConn.Close()
 		for {
 			buffer := make([]byte, common.BUFFER_SIZE)
 			n, sourceAddr, err := gsspr.uiConn.ReadFromUDP(buffer)
+			if gsspr.isStopped() {
+				return
+			}
 			common.CheckError(err)
-			onSimpleMessageReceived(gsspr, buffer[:n], sourceAddr, true)
+			onSimpleMessageReceived(gsspr, buffer[:n], sourceAddr.String(), true)
 		}
 	}()
 }
 
-func (gsspr *Gossiper) StartListeningPeersSimple(wait sync.WaitGroup) {
+func (gsspr *Gossiper) StartListeningPeersSimple(wait *sync.WaitGroup) {
 	go func() {
 		defer wait.Done()
-		defer gsspr.conn.Close()
+		defer gsspr.transport.Close()
 		for {
-			buffer := make([]byte, common.BUFFER_SIZE)
-			n, sourceAddr, err := gsspr.conn.ReadFromUDP(buffer)
+			message, sourceAddr, err := gsspr.transport.Receive()
+			if gsspr.isStopped() {
+				return
+			}
 			common.CheckError(err)
-			onSimpleMessageReceived(gsspr, buffer[:n], sourceAddr, false)
+			onSimpleMessageReceived(gsspr, message, sourceAddr, false)
 		}
 	}()
 }
 
-func (gsspr *Gossiper) StartListeningClient(wait sync.WaitGroup) {
+func (gsspr *Gossiper) StartListeningClient(wait *sync.WaitGroup) {
 	go func() {
 		defer wait.Done()
 		defer gsspr.uiConn.Close()
 		for {
 			buffer := make([]byte, common.BUFFER_SIZE)
 			n, sourceAddr, err := gsspr.uiConn.ReadFromUDP(buffer)
+			if gsspr.isStopped() {
+				return
+			}
 			common.CheckError(err)
-			onMessageReceived(gsspr, buffer[:n], sourceAddr, true)
+			onMessageReceived(gsspr, buffer[:n], sourceAddr.String(), true)
 		}
 	}()
 }
 
-func (gsspr *Gossiper) StartListeningGossip(wait sync.WaitGroup) {
+func (gsspr *Gossiper) StartListeningGossip(wait *sync.WaitGroup) {
 	go func() {
 		defer wait.Done()
-		defer gsspr.conn.Close()
+		defer gsspr.transport.Close()
 		for {
-			buffer := make([]byte, common.BUFFER_SIZE)
-			n, sourceAddr, err := gsspr.conn.ReadFromUDP(buffer)
+			message, sourceAddr, err := gsspr.transport.Receive()
+			if gsspr.isStopped() {
+				return
+			}
 			common.CheckError(err)
-			onMessageReceived(gsspr, buffer[:n], sourceAddr, false)
+			onMessageReceived(gsspr, message, sourceAddr, false)
 		}
 	}()
 }
 
-func (gsspr *Gossiper) StartAntiEntropy(wait sync.WaitGroup) {
+func (gsspr *Gossiper) StartAntiEntropy(wait *sync.WaitGroup) {
 	go func() {
 		defer wait.Done()
 		ticker := time.NewTicker(1000 * time.Millisecond)
 		defer ticker.Stop()
-		for range ticker.C {
+		for gsspr.waitTick(ticker) {
 			randomPeer := GetRandomPeer(gsspr, "")
 			if randomPeer != "" {
 				logAntiEntropy(randomPeer)
 				newPackage := GossipPacket{
-					Status: gsspr.Vc.MakeCopy(),
+					Status: gsspr.newStatus(),
 				}
-				gsspr.sendGossipQueue <- &QueuedMessage{
+				gsspr.queueGossip(&QueuedMessage{
 					packet:      newPackage,
 					destination: randomPeer,
-				}
+				})
 			}
 		}
 	}()
 }
 
-func (gsspr *Gossiper) StartMining(wait sync.WaitGroup) {
+func (gsspr *Gossiper) StartMining(wait *sync.WaitGroup) {
 	go func() {
 		defer wait.Done()
 		startMining(gsspr)
 	}()
 }
 
-func (gsspr *Gossiper) StartServingGUI(wait sync.WaitGroup) {
+func (gsspr *Gossiper) StartServingGUI(wait *sync.WaitGroup) {
 	go func() {
-		router := createRouteHandlers(gsspr)
-
-		http.Handle("/", router)
-
-		http.ListenAndServe(":"+gsspr.uiPort, router)
+		http.ListenAndServe(net.JoinHostPort(gsspr.uiHost, gsspr.uiPort), gsspr.GUIHandler())
 	}()
 }
 
+// Get the HTTP handler of the GUI of this gossiper, to serve it from an embedding program
+func (gsspr *Gossiper) GUIHandler() http.Handler {
+	return createRouteHandlers(gsspr)
+}
+
 func (gsspr *Gossiper) addToAllRumorMessagesList(packetReceived RumorMessage) {
 	// Store rumor in the list
 	messageToSave := RumorMessage{
-		Origin: packetReceived.Origin,
-		ID:     packetReceived.ID,
-		Text:   packetReceived.Text,
+		Origin:        packetReceived.Origin,
+		ID:            packetReceived.ID,
+		Text:          packetReceived.Text,
+		Topic:         packetReceived.Topic,
+		EncryptionKey: packetReceived.EncryptionKey,
+		SigningKey:    packetReceived.SigningKey,
+		Signature:     packetReceived.Signature,
 	}
+	gsspr.mutex.Lock()
 	gsspr.allRumorMessages = append(gsspr.allRumorMessages, messageToSave)
+	gsspr.mutex.Unlock()
+	gsspr.storeRumor(messageToSave)
 }
 
 func (gsspr *Gossiper) addToAllPrivateMessagesList(packetReceived PrivateMessage) {
@@ -242,29 +428,68 @@ func (gsspr *Gossiper) addToAllPrivateMessagesList(packetReceived PrivateMessage
 		Destination: packetReceived.Destination,
 		HopLimit:    packetReceived.HopLimit,
 	}
+	gsspr.mutex.Lock()
+	index := len(gsspr.allPrivateMessages)
 	gsspr.allPrivateMessages = append(gsspr.allPrivateMessages, messageToSave)
+	gsspr.mutex.Unlock()
+	gsspr.storePrivateMessage(index, messageToSave)
+}
+
+// Create the next rumor originated by this gossiper, it carries our public keys and is signed.
+// The rumor takes the next ID of our clock and is kept with the other rumors
+func (gsspr *Gossiper) newRumor(text, topic string) *RumorMessage {
+	for {
+		rumor := &RumorMessage{
+			Origin:        gsspr.Name,
+			ID:            gsspr.Vc.GetNextId(gsspr.Name),
+			Text:          text,
+			Topic:         topic,
+			EncryptionKey: gsspr.keys.EncryptionPublicKey(),
+		}
+		signRumor(gsspr.keys, rumor)
+		// Another rumor may have taken the ID meanwhile
+		if gsspr.Vc.Update(gsspr.Name, rumor.ID) {
+			gsspr.addToAllRumorMessagesList(*rumor)
+			return rumor
+		}
+	}
+}
+
+// Copy of our vector clock signed with our key, sent as a status packet
+func (gsspr *Gossiper) newStatus() *StatusPacket {
+	status := gsspr.Vc.MakeCopy()
+	signStatus(gsspr.keys, gsspr.Name, status)
+	return status
 }
 
 func (gsspr *Gossiper) FindFromAllRumorMessages(origin string, id uint32) *RumorMessage {
+	gsspr.mutex.Lock()
+	defer gsspr.mutex.Unlock()
 	for _, rumor := range gsspr.allRumorMessages {
 		if rumor.Origin == origin && rumor.ID == id {
 			return &rumor
 		}
 	}
-	return nil
+	if origin == gsspr.Name && id < gsspr.loadedNextId {
+		// Only carried our keys, the same rumor is signed again
+		rumor := &RumorMessage{
+			Origin:        gsspr.Name,
+			ID:            id,
+			EncryptionKey: gsspr.keys.EncryptionPublicKey(),
+		}
+		signRumor(gsspr.keys, rumor)
+		return rumor
+	}
+	return gsspr.topics.GetRelayed(origin, id)
 }
 
-func (gsspr *Gossiper) StartRouteRumoring(wait sync.WaitGroup) {
+func (gsspr *Gossiper) StartRouteRumoring(wait *sync.WaitGroup) {
 	go func() {
 		defer wait.Done()
 		if gsspr.routeRumorTimer != 0 {
 			for _, peer := range gsspr.peersList {
 				newPackage := GossipPacket{
-					Rumor: &RumorMessage{
-						Origin: gsspr.Name,
-						ID:     gsspr.Vc.GetNextId(gsspr.Name),
-						Text:   "",
-					},
+					Rumor: gsspr.newRumor("", ""),
 				}
 				if peer != gsspr.addressStr {
 					RumorMonger(gsspr, peer, newPackage)
@@ -272,15 +497,11 @@ func (gsspr *Gossiper) StartRouteRumoring(wait sync.WaitGroup) {
 			}
 			ticker := time.NewTicker(time.Duration(gsspr.routeRumorTimer) * time.Second)
 			defer ticker.Stop()
-			for range ticker.C {
+			for gsspr.waitTick(ticker) {
 				randomPeer := GetRandomPeer(gsspr, "")
 				if randomPeer != "" {
 					newPackage := GossipPacket{
-						Rumor: &RumorMessage{
-							Origin: gsspr.Name,
-							ID:     gsspr.Vc.GetNextId(gsspr.Name),
-							Text:   "",
-						},
+						Rumor: gsspr.newRumor("", ""),
 					}
 					RumorMonger(gsspr, randomPeer, newPackage)
 				}
@@ -289,19 +510,36 @@ func (gsspr *Gossiper) StartRouteRumoring(wait sync.WaitGroup) {
 	}()
 }
 
-func (gsspr *Gossiper) StartGossipSender(wait sync.WaitGroup) {
+func (gsspr *Gossiper) StartGossipSender(wait *sync.WaitGroup) {
 	go func() {
 		defer wait.Done()
-		for qMessage := range gsspr.sendGossipQueue {
+		for {
+			var qMessage *QueuedMessage
+			select {
+			case <-gsspr.quit:
+				return
+			case qMessage = <-gsspr.sendGossipQueue:
+			}
 			packet := qMessage.packet
 			destination := qMessage.destination
 
 			// Send gossip packet to destination
 			content, err := protobuf.Encode(&packet)
 			common.CheckError(err)
-			addressToSend, err := net.ResolveUDPAddr("udp4", destination)
-			common.CheckError(err)
-			gsspr.conn.WriteToUDP(content, addressToSend)
+			gsspr.transport.Send(content, destination)
 		}
 	}()
 }
+
+// Queue a packet for the gossip sender, dropped if the gossiper is stopped
+func (gsspr *Gossiper) queueGossip(message *QueuedMessage) {
+	select {
+	case gsspr.sendGossipQueue <- message:
+	case <-gsspr.quit:
+	}
+}
+
+// Get the address of the next hop towards the peer with the given name
+func (gsspr *Gossiper) GetNextHop(name string) string {
+	return gsspr.routingTable.GetAddress(name)
+}
@@ -0,0 +1,73 @@
+package gossiper
+
+import (
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+)
+
+// Directory under which the gossipers of the tests keep their files
+const TEST_DIR = "./_Test/"
+
+// Gossiper attached to an in-memory network, it is stopped and its files removed at the end of
+// the test. Only its gossip sender is started. storePath is relative to the directory of the gossiper
+func newTestGossiper(t *testing.T, network *MemoryNetwork, name, address, storePath string) *Gossiper {
+	transport, err := network.NewTransport(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := TEST_DIR + name + "/"
+	if storePath != "" {
+		storePath = dir + storePath
+	}
+	gsspr := NewGossiperWithTransport(transport, "127.0.0.1", "0", address, name, nil, false, 0,
+		dir+"_SharedFiles/", dir+"_SharedFiles/Chunks/", dir+"_Downloads/", storePath,
+		10, 256, 8192, 32, 2)
+	var wait sync.WaitGroup
+	wait.Add(1)
+	gsspr.StartGossipSender(&wait)
+	t.Cleanup(func() {
+		gsspr.Stop()
+		wait.Wait()
+		os.RemoveAll(dir)
+	})
+	return gsspr
+}
+
+func TestPeersStoredWithCanonicalAddresses(t *testing.T) {
+	network := NewMemoryNetwork()
+	transport, err := network.NewTransport("[::1]:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := TEST_DIR + "alice/"
+	defer os.RemoveAll(dir)
+	alice := NewGossiperWithTransport(transport, "127.0.0.1", "0", "[0:0::1]:5000", "alice",
+		[]string{"localhost:5001", "[0:0::1]:5002"}, false, 0,
+		dir+"_SharedFiles/", dir+"_SharedFiles/Chunks/", dir+"_Downloads/", "",
+		10, 256, 8192, 32, 2)
+	defer alice.Stop()
+	if alice.addressStr != "[::1]:5000" {
+		t.Fatalf("gossip address stored as %s", alice.addressStr)
+	}
+	expected := []string{"127.0.0.1:5001", "[::1]:5002"}
+	for i, peer := range expected {
+		if alice.peersList[i] != peer {
+			t.Fatalf("peers stored as %v instead of %v", alice.peersList, expected)
+		}
+	}
+
+	// Peers added from the GUI are stored the same way, once
+	for _, node := range []string{"[::1]:5002", "[0:0::1]:5003", "[::1]:5003"} {
+		if code := requestGUI(t, alice, "POST", "/node", node, nil); code != http.StatusOK {
+			t.Fatalf("node %s refused with %d", node, code)
+		}
+	}
+	if code := requestGUI(t, alice, "POST", "/node", "[::1]", nil); code != http.StatusBadRequest {
+		t.Fatalf("node without port answered with %d", code)
+	}
+	if len(alice.peersList) != 3 || alice.peersList[2] != "[::1]:5003" {
+		t.Fatalf("peers stored as %v", alice.peersList)
+	}
+}
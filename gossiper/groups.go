@@ -0,0 +1,219 @@
+package gossiper
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A named group and the messages exchanged in it
+type Group struct {
+	Name     string
+	Members  []string
+	Messages []GroupMessage
+}
+
+// Groups we belong to, by name. History is kept apart from the private messages
+type GroupList struct {
+	groups map[string]*Group
+	nextId uint32
+	mutex  *sync.Mutex
+}
+
+func NewGroupList() *GroupList {
+	return &GroupList{
+		groups: make(map[string]*Group),
+		// Random start so IDs are not reused after a restart
+		nextId: rand.Uint32(),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+// Sorted members without duplicates or empty names
+func normalizeMembers(members []string) []string {
+	unique := make(map[string]bool)
+	for _, member := range members {
+		member = strings.TrimSpace(member)
+		if member != "" {
+			unique[member] = true
+		}
+	}
+	normalized := make([]string, 0, len(unique))
+	for member := range unique {
+		normalized = append(normalized, member)
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// Create a group or replace its members
+func (gl *GroupList) Set(name string, members []string) {
+	members = normalizeMembers(members)
+	gl.mutex.Lock()
+	defer gl.mutex.Unlock()
+	group, exists := gl.groups[name]
+	if !exists {
+		group = &Group{
+			Name: name,
+		}
+		gl.groups[name] = group
+	}
+	group.Members = members
+}
+
+func (gl *GroupList) GetMembers(name string) []string {
+	gl.mutex.Lock()
+	defer gl.mutex.Unlock()
+	group, exists := gl.groups[name]
+	if !exists {
+		return nil
+	}
+	return append([]string{}, group.Members...)
+}
+
+func (gl *GroupList) NextId() uint32 {
+	gl.mutex.Lock()
+	gl.nextId++
+	id := gl.nextId
+	gl.mutex.Unlock()
+	return id
+}
+
+// Add a message to the history of its group, the group is created or updated with the
+// members of the message. Returns false if the message was already in the history
+func (gl *GroupList) AddMessage(message GroupMessage) bool {
+	gl.mutex.Lock()
+	defer gl.mutex.Unlock()
+	group, exists := gl.groups[message.Group]
+	if !exists {
+		group = &Group{
+			Name: message.Group,
+		}
+		gl.groups[message.Group] = group
+	}
+	for _, known := range group.Messages {
+		if known.Origin == message.Origin && known.ID == message.ID {
+			return false
+		}
+	}
+	group.Members = normalizeMembers(message.Members)
+	message.Copies = nil
+	group.Messages = append(group.Messages, message)
+	return true
+}
+
+// Copy of every group, sorted by name
+func (gl *GroupList) GetGroups() []Group {
+	gl.mutex.Lock()
+	defer gl.mutex.Unlock()
+	groups := make([]Group, 0, len(gl.groups))
+	for _, group := range gl.groups {
+		groups = append(groups, Group{
+			Name:     group.Name,
+			Members:  append([]string{}, group.Members...),
+			Messages: append([]GroupMessage{}, group.Messages...),
+		})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
+// Data authenticated along the text of a copy, so a relay can't move it to another group
+func groupCopyAdditionalData(message *GroupMessage, destination string) []byte {
+	return []byte(fmt.Sprintf("%s\x00%s\x00%d\x00%s\x00%s", message.Origin, destination, message.ID,
+		message.Group, strings.Join(message.Members, ",")))
+}
+
+// Send a message written by our client to every member of its group
+func sendGroupMessage(gsspr *Gossiper, message GroupMessage) {
+	message.Members = normalizeMembers(append(message.Members, gsspr.Name))
+	message.Copies = nil
+	for _, member := range message.Members {
+		if member == gsspr.Name {
+			continue
+		}
+		// Seal the text for each member, members that don't advertise a key get no copy
+		memberKey := gsspr.keyStore.GetEncryptionKey(member)
+		if memberKey == nil {
+			logNoEncryptionKey(member)
+			continue
+		}
+		nonce, sealed, err := sealText(gsspr.keys, memberKey, message.Origin, member,
+			[]byte(message.Text), groupCopyAdditionalData(&message, member))
+		if err != nil {
+			continue
+		}
+		message.Copies = append(message.Copies, GroupCopy{
+			Destination: member,
+			Nonce:       nonce,
+			Sealed:      sealed,
+		})
+	}
+	gsspr.groups.AddMessage(message)
+	message.Text = ""
+	routeGroupMessage(gsspr, message)
+}
+
+// Send the copies of a group message on their way, copies that share a next hop travel together
+func routeGroupMessage(gsspr *Gossiper, message GroupMessage) {
+	if message.HopLimit <= 1 {
+		return
+	}
+	message.HopLimit--
+	copiesByHop := make(map[string][]GroupCopy)
+	for _, groupCopy := range message.Copies {
+		nextHop := gsspr.routingTable.GetAddress(groupCopy.Destination)
+		if nextHop != "" {
+			copiesByHop[nextHop] = append(copiesByHop[nextHop], groupCopy)
+		}
+	}
+	for nextHop, copies := range copiesByHop {
+		hopMessage := message
+		hopMessage.Copies = copies
+		gsspr.queueGossip(&QueuedMessage{
+			packet: GossipPacket{
+				Group: &hopMessage,
+			},
+			destination: nextHop,
+		})
+	}
+}
+
+// Read our copy of a group message, if any, and relay the others
+func processGroupMessage(gsspr *Gossiper, message GroupMessage) {
+	remaining := make([]GroupCopy, 0, len(message.Copies))
+	for _, groupCopy := range message.Copies {
+		if groupCopy.Destination != gsspr.Name {
+			remaining = append(remaining, groupCopy)
+			continue
+		}
+		text := []byte(groupCopy.Text)
+		originKey := gsspr.keyStore.GetEncryptionKey(message.Origin)
+		if groupCopy.Sealed == nil && originKey != nil {
+			// The origin seals its copies, a relay replaced the sealed text
+			continue
+		}
+		if groupCopy.Sealed != nil {
+			// Drop copies that can't be opened with the key of their origin
+			var err error
+			text, err = openText(gsspr.keys, originKey, message.Origin, gsspr.Name,
+				groupCopy.Nonce, groupCopy.Sealed, groupCopyAdditionalData(&message, gsspr.Name))
+			if err != nil {
+				continue
+			}
+		}
+		received := message
+		received.Text = string(text)
+		if gsspr.groups.AddMessage(received) {
+			logGroupMessage(received)
+		}
+	}
+	if len(remaining) > 0 {
+		message.Copies = remaining
+		routeGroupMessage(gsspr, message)
+	}
+}
@@ -0,0 +1,71 @@
+package gossiper
+
+import (
+	"github.com/dedis/protobuf"
+	"testing"
+)
+
+func TestGroupCopiesSealedForMembersWithKeys(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "")
+	bob := newTestGossiper(t, network, "bob", "127.0.0.1:5001", "")
+	alice.keyStore.RegisterEncryptionKey("bob", bob.keys.EncryptionPublicKey())
+	bob.keyStore.RegisterEncryptionKey("alice", alice.keys.EncryptionPublicKey())
+	alice.routingTable.RegisterNextHop("bob", "127.0.0.1:5001")
+	alice.routingTable.RegisterNextHop("carol", "127.0.0.1:5001")
+
+	// Carol never advertised a key, she gets no copy
+	sendGroupMessage(alice, GroupMessage{
+		Origin:   "alice",
+		ID:       1,
+		Group:    "friends",
+		Members:  []string{"bob", "carol"},
+		HopLimit: 10,
+		Text:     "dinner at eight",
+	})
+	content, _, err := bob.transport.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := GossipPacket{}
+	err = protobuf.Decode(content, &packet)
+	if err != nil || packet.Group == nil {
+		t.Fatal("no group message received")
+	}
+	if packet.Group.Text != "" || len(packet.Group.Copies) != 1 {
+		t.Fatalf("received %+v", packet.Group)
+	}
+	groupCopy := packet.Group.Copies[0]
+	if groupCopy.Destination != "bob" || groupCopy.Text != "" || groupCopy.Sealed == nil {
+		t.Fatalf("copy for bob not sealed: %+v", groupCopy)
+	}
+
+	processGroupMessage(bob, *packet.Group)
+	groups := bob.groups.GetGroups()
+	if len(groups) != 1 || len(groups[0].Messages) != 1 || groups[0].Messages[0].Text != "dinner at eight" {
+		t.Fatalf("group message not read by bob: %+v", groups)
+	}
+}
+
+func TestUnsealedGroupCopyFromKnownOriginDropped(t *testing.T) {
+	network := NewMemoryNetwork()
+	bob := newTestGossiper(t, network, "bob", "127.0.0.1:5001", "")
+	alice := newTestKeyPair(t)
+	bob.keyStore.RegisterEncryptionKey("alice", alice.EncryptionPublicKey())
+
+	// A relay replaced the sealed copy of alice by its own text
+	processGroupMessage(bob, GroupMessage{
+		Origin:   "alice",
+		ID:       1,
+		Group:    "friends",
+		Members:  []string{"alice", "bob"},
+		HopLimit: 9,
+		Copies: []GroupCopy{{
+			Destination: "bob",
+			Text:        "forged by a relay",
+		}},
+	})
+	if len(bob.groups.GetGroups()) != 0 {
+		t.Fatal("unsealed copy accepted")
+	}
+}
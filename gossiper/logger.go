@@ -11,6 +11,10 @@ func logClientMessage(packetReceived GossipPacket) {
 	fmt.Printf("CLIENT MESSAGE %s\n", packetReceived.Simple.Contents)
 }
 
+func logClientTopicMessage(rumor RumorMessage) {
+	fmt.Printf("CLIENT MESSAGE %s topic %s\n", rumor.Text, rumor.Topic)
+}
+
 func logSimpleMessage(packetReceived GossipPacket, sourceAddr string) {
 	fmt.Printf("SIMPLE MESSAGE origin %s from %s contents %s\n",
 		packetReceived.Simple.OriginalName,
@@ -69,18 +73,83 @@ func logPrivateMessage(packetReceived GossipPacket) {
 		packetReceived.Private.Text)
 }
 
+func logEncryptionKeyConflict(origin, relayAddr string) {
+	fmt.Printf("KEY CONFLICT rumor of %s from %s carries another encryption key, dropped\n", origin, relayAddr)
+}
+
+func logNoEncryptionKey(destination string) {
+	fmt.Printf("NO KEY for %s, message not sent\n", destination)
+}
+
+func logInvalidPrivateAck(origin string) {
+	fmt.Printf("INVALID ACK from %s, dropped\n", origin)
+}
+
+func logGroupMessage(message GroupMessage) {
+	fmt.Printf("GROUP %s origin %s hop-limit %d contents %s\n",
+		message.Group, message.Origin, message.HopLimit, message.Text)
+}
+
 func logFileShared(fileName, hash string) {
 	fmt.Printf("SHARING file %s with hash %s\n", fileName, hash)
 }
 
+func logFileUnshared(fileName, hash string) {
+	fmt.Printf("UNSHARING file %s with hash %s\n", fileName, hash)
+}
+
+func logChunksEvicted(count int) {
+	fmt.Printf("EVICTED %d chunks from the chunk directory\n", count)
+}
+
+func logChunkQuarantined(hash string) {
+	fmt.Printf("QUARANTINED corrupt chunk %s\n", hash)
+}
+
+func logScrubFinished(chunks, corrupt, damaged int) {
+	fmt.Printf("SCRUBBED %d chunks, %d corrupt, %d files damaged\n", chunks, corrupt, damaged)
+}
+
+func logSharedFileIndexFailed(fileName, reason string) {
+	fmt.Printf("INDEXING FAILED %s: %s\n", fileName, reason)
+}
+
 func logDownloadingMetaFile(fileName, peerName string) {
 	fmt.Printf("DOWNLOADING metafile of %s from %s\n", fileName, peerName)
 }
 
+func logDownloadingMetaFileNode(fileName, peerName string) {
+	fmt.Printf("DOWNLOADING metafile node of %s from %s\n", fileName, peerName)
+}
+
 func logDownloadingChunk(fileName string, chunkIndex uint64, peerName string) {
 	fmt.Printf("DOWNLOADING %s chunk %d from %s\n", fileName, chunkIndex, peerName)
 }
 
+func logResumingDownload(fileName string, chunks, chunkCount int) {
+	fmt.Printf("RESUMING %s with %d of %d chunks\n", fileName, chunks, chunkCount)
+}
+
+func logDownloadPaused(fileName string) {
+	fmt.Printf("PAUSED download of %s\n", fileName)
+}
+
+func logDownloadUnroutable(fileName string) {
+	fmt.Printf("PAUSED download of %s, no route to the nodes that have it\n", fileName)
+}
+
+func logDownloadResumed(fileName string) {
+	fmt.Printf("RESUMED download of %s\n", fileName)
+}
+
+func logDownloadCancelled(fileName string) {
+	fmt.Printf("CANCELLED download of %s\n", fileName)
+}
+
+func logDownloadFailed(fileName, reason string) {
+	fmt.Printf("DOWNLOAD FAILED %s: %s\n", fileName, reason)
+}
+
 func logFileReconstructed(fileName string) {
 	fmt.Printf("RECONSTRUCTED file %s\n", fileName)
 }
@@ -0,0 +1,210 @@
+package gossiper
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// How long a private message is kept waiting for its destination
+const MAILBOX_TTL = 24 * time.Hour
+
+// Maximum number of messages kept for one destination, and for all destinations together
+const MAILBOX_QUOTA = 32
+const MAILBOX_CAPACITY = 1024
+const MAILBOX_CLEAN_INTERVAL = 10 * time.Second
+
+type mailboxEntry struct {
+	message PrivateMessage
+	expires time.Time
+}
+
+// Private messages kept until their destination becomes reachable, by destination
+type Mailbox struct {
+	messages map[string][]mailboxEntry
+	// Number of messages kept for all destinations
+	size  int
+	mutex *sync.Mutex
+}
+
+func NewMailbox() *Mailbox {
+	return &Mailbox{
+		messages: make(map[string][]mailboxEntry),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// Keep a message until expires, returns false if the quota of its destination or the capacity
+// of the mailbox is reached
+func (mb *Mailbox) Deposit(message PrivateMessage, expires time.Time) bool {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	entries := mb.messages[message.Destination]
+	for i, entry := range entries {
+		if entry.message.Origin == message.Origin && entry.message.ID == message.ID {
+			// Already kept, e.g. replicated by several peers
+			entries[i].message = message
+			return true
+		}
+	}
+	if len(entries) >= MAILBOX_QUOTA || mb.size >= MAILBOX_CAPACITY {
+		return false
+	}
+	mb.messages[message.Destination] = append(entries, mailboxEntry{
+		message: message,
+		expires: expires,
+	})
+	mb.size++
+	return true
+}
+
+// Remove and return the messages that didn't expire yet for a destination
+func (mb *Mailbox) Take(destination string) []mailboxEntry {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	entries := mb.messages[destination]
+	delete(mb.messages, destination)
+	mb.size -= len(entries)
+	now := time.Now()
+	valid := make([]mailboxEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.expires.After(now) {
+			valid = append(valid, entry)
+		}
+	}
+	return valid
+}
+
+// Remove a message that was delivered by other means
+func (mb *Mailbox) Remove(destination, origin string, id uint32) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	entries := mb.messages[destination]
+	for i, entry := range entries {
+		if entry.message.Origin == origin && entry.message.ID == id {
+			mb.messages[destination] = append(entries[:i], entries[i+1:]...)
+			mb.size--
+			break
+		}
+	}
+	if len(mb.messages[destination]) == 0 {
+		delete(mb.messages, destination)
+	}
+}
+
+// Remove and return the messages that expired
+func (mb *Mailbox) RemoveExpired() []PrivateMessage {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	now := time.Now()
+	var expired []PrivateMessage
+	for destination, entries := range mb.messages {
+		valid := entries[:0]
+		for _, entry := range entries {
+			if entry.expires.After(now) {
+				valid = append(valid, entry)
+			} else {
+				expired = append(expired, entry.message)
+				mb.size--
+			}
+		}
+		if len(valid) == 0 {
+			delete(mb.messages, destination)
+		} else {
+			mb.messages[destination] = valid
+		}
+	}
+	return expired
+}
+
+// Keep a private message in our mailbox until its destination is reachable. Our own sealed
+// messages are also replicated to some neighbours, so they can be delivered while we are offline.
+// A message to a node we never got a signed rumor from can't be sealed yet, it is only kept here
+// and sealed when the route rumor of the destination brings its key
+func depositPrivateMessage(gsspr *Gossiper, message PrivateMessage, expires time.Time) {
+	own := message.Origin == gsspr.Name
+	if !gsspr.mailbox.Deposit(message, expires) {
+		if own {
+			gsspr.privateMessages.setStatus(message.ID, PRIVATE_FAILED)
+		}
+		return
+	}
+	if !own {
+		return
+	}
+	gsspr.privateMessages.setStatus(message.ID, PRIVATE_STORED)
+	// Only sealed messages leave our mailbox, neighbours must not read them
+	if message.Sealed != nil {
+		replicateToMailboxes(gsspr, message)
+	}
+}
+
+// Send a copy of a message to the mailbox of up to mailboxReplicas random neighbours
+func replicateToMailboxes(gsspr *Gossiper, message PrivateMessage) {
+	peers := append([]string{}, gsspr.peersList...)
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	replicas := 0
+	for _, peer := range peers {
+		if replicas >= gsspr.mailboxReplicas {
+			break
+		}
+		if peer == gsspr.addressStr {
+			continue
+		}
+		replica := message
+		replica.HopLimit = uint32(gsspr.hopLimit)
+		gsspr.queueGossip(&QueuedMessage{
+			packet: GossipPacket{
+				MailboxDeposit: &replica,
+			},
+			destination: peer,
+		})
+		replicas++
+	}
+}
+
+// Keep a message a neighbour asked us to hold for its destination
+func processMailboxDeposit(gsspr *Gossiper, message PrivateMessage, sourceAddr string) {
+	if message.Destination == gsspr.Name {
+		handleMessage(gsspr, &GossipPacket{Private: &message}, sourceAddr)
+		return
+	}
+	if message.Origin == gsspr.Name || message.Sealed == nil {
+		return
+	}
+	// Our route to the destination may be stale, wait for its next rumor before sending it
+	gsspr.mailbox.Deposit(message, time.Now().Add(MAILBOX_TTL))
+}
+
+// Send the messages kept for a destination we just got a route to
+func deliverMailbox(gsspr *Gossiper, destination string) {
+	for _, entry := range gsspr.mailbox.Take(destination) {
+		if entry.message.Origin == gsspr.Name {
+			// Ours, keep retrying until it is acknowledged or kept again
+			go sendPrivateMessageReliably(gsspr, entry.message, entry.expires)
+		} else {
+			message := entry.message
+			RoutePrivateMessage(gsspr, GossipPacket{
+				Private: &message,
+			})
+		}
+	}
+}
+
+// Periodically drop the expired messages of the mailbox
+func (gsspr *Gossiper) StartMailboxCleaner(wait *sync.WaitGroup) {
+	go func() {
+		defer wait.Done()
+		ticker := time.NewTicker(MAILBOX_CLEAN_INTERVAL)
+		defer ticker.Stop()
+		for gsspr.waitTick(ticker) {
+			for _, message := range gsspr.mailbox.RemoveExpired() {
+				if message.Origin == gsspr.Name {
+					gsspr.privateMessages.setStatus(message.ID, PRIVATE_FAILED)
+				}
+			}
+		}
+	}()
+}
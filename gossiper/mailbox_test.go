@@ -0,0 +1,61 @@
+package gossiper
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMailboxQuotaPerDestination(t *testing.T) {
+	mailbox := NewMailbox()
+	expires := time.Now().Add(MAILBOX_TTL)
+	for id := uint32(1); id <= MAILBOX_QUOTA; id++ {
+		if !mailbox.Deposit(PrivateMessage{Origin: "alice", ID: id, Destination: "bob"}, expires) {
+			t.Fatalf("message %d refused below the quota", id)
+		}
+	}
+	if mailbox.Deposit(PrivateMessage{Origin: "alice", ID: MAILBOX_QUOTA + 1, Destination: "bob"}, expires) {
+		t.Fatal("message kept over the quota of its destination")
+	}
+	// Replicas of a message we already keep don't count twice
+	if !mailbox.Deposit(PrivateMessage{Origin: "alice", ID: 1, Destination: "bob"}, expires) {
+		t.Fatal("replica of a kept message refused")
+	}
+	if !mailbox.Deposit(PrivateMessage{Origin: "alice", ID: 1, Destination: "carol"}, expires) {
+		t.Fatal("message refused for another destination")
+	}
+}
+
+func TestMailboxCapacity(t *testing.T) {
+	mailbox := NewMailbox()
+	expires := time.Now().Add(MAILBOX_TTL)
+	// Deposits spread over invented destinations
+	for i := 0; i < MAILBOX_CAPACITY; i++ {
+		destination := fmt.Sprintf("node%d", i)
+		if !mailbox.Deposit(PrivateMessage{Origin: "mallory", ID: 1, Destination: destination}, expires) {
+			t.Fatalf("message %d refused below the capacity", i)
+		}
+	}
+	if mailbox.Deposit(PrivateMessage{Origin: "mallory", ID: 1, Destination: "one more"}, expires) {
+		t.Fatal("message kept over the capacity of the mailbox")
+	}
+
+	// Room is made by delivered, removed and expired messages
+	if len(mailbox.Take("node0")) != 1 {
+		t.Fatal("kept message not taken")
+	}
+	mailbox.Remove("node1", "mallory", 1)
+	if !mailbox.Deposit(PrivateMessage{Origin: "alice", ID: 1, Destination: "bob"}, time.Now()) ||
+		!mailbox.Deposit(PrivateMessage{Origin: "alice", ID: 2, Destination: "bob"}, expires) {
+		t.Fatal("messages refused after others left the mailbox")
+	}
+	if len(mailbox.RemoveExpired()) != 1 {
+		t.Fatal("expired message not removed")
+	}
+	if !mailbox.Deposit(PrivateMessage{Origin: "alice", ID: 3, Destination: "bob"}, expires) {
+		t.Fatal("message refused after another expired")
+	}
+	if mailbox.Deposit(PrivateMessage{Origin: "alice", ID: 4, Destination: "bob"}, expires) {
+		t.Fatal("message kept over the capacity of the mailbox")
+	}
+}
@@ -0,0 +1,200 @@
+package gossiper
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dedis/protobuf"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A shared folder is described by a manifest, shared as a file named after the folder with a
+// trailing slash. Its content is this line followed by the protobuf encoded Manifest
+var manifestMagic = []byte("PEERSTER MANIFEST 1\n")
+
+// Largest manifest read into memory, about 100000 entries
+const MANIFEST_MAX_SIZE = 16 << 20
+
+// Files of a shared folder, with their path relative to the folder separated by slashes
+type Manifest struct {
+	Entries []ManifestEntry
+}
+
+type ManifestEntry struct {
+	Path         string
+	Size         uint64
+	MetafileHash []byte
+}
+
+// Content of the manifest file of a folder
+func EncodeManifest(manifest Manifest) ([]byte, error) {
+	encoded, err := protobuf.Encode(&manifest)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, manifestMagic...), encoded...), nil
+}
+
+// Decode the content of a file, returns nil if it isn't a manifest
+func DecodeManifest(content []byte) (*Manifest, error) {
+	if !bytes.HasPrefix(content, manifestMagic) {
+		return nil, nil
+	}
+	manifest := Manifest{}
+	err := protobuf.Decode(content[len(manifestMagic):], &manifest)
+	if err != nil {
+		return nil, errors.New("invalid manifest: " + err.Error())
+	}
+	for _, entry := range manifest.Entries {
+		if cleanManifestPath(entry.Path) == "" {
+			return nil, errors.New("invalid path in manifest: " + entry.Path)
+		}
+	}
+	return &manifest, nil
+}
+
+// Path of an entry of a manifest, or "" if it could point out of the folder
+func cleanManifestPath(entryPath string) string {
+	cleaned := path.Clean(entryPath)
+	if entryPath == "" || path.IsAbs(cleaned) || cleaned == "." || cleaned == ".." ||
+		strings.HasPrefix(cleaned, "../") || strings.Contains(cleaned, "\\") {
+		return ""
+	}
+	return cleaned
+}
+
+// Name of a download relative to the downloads directory, with the trailing slash of a folder,
+// or "" if it could point out of the directory
+func cleanDownloadName(fileName string) string {
+	cleaned := cleanManifestPath(strings.TrimSuffix(fileName, "/"))
+	if cleaned == "" || !strings.HasSuffix(fileName, "/") {
+		return cleaned
+	}
+	return cleaned + "/"
+}
+
+// Share every file of a folder of the shared files directory, then the manifest listing them.
+// Returns the metadata of the manifest
+func (gsspr *Gossiper) shareDirectory(dirPath, dirName string) (*FileMetaData, error) {
+	manifest := Manifest{
+		Entries: make([]ManifestEntry, 0),
+	}
+	chunkDir, err := filepath.Abs(gsspr.chunkFilesDir)
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.Walk(dirPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && filePath == chunkDir {
+			// The chunks of the shared files are not shared as files
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(dirPath, filePath)
+		if err != nil {
+			return err
+		}
+		entryPath := filepath.ToSlash(relativePath)
+		metaData, err := gsspr.indexFile(filePath, dirName+"/"+entryPath)
+		if err != nil {
+			return err
+		}
+		manifest.Entries = append(manifest.Entries, ManifestEntry{
+			Path:         entryPath,
+			Size:         metaData.Size,
+			MetafileHash: metaData.HashValue,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Sorted by path, so a folder always gets the same manifest
+	sort.Slice(manifest.Entries, func(i, j int) bool {
+		return manifest.Entries[i].Path < manifest.Entries[j].Path
+	})
+	content, err := EncodeManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return gsspr.indexContent(bytes.NewReader(content), dirName+"/")
+}
+
+// Read the manifest of a folder from the chunk directory. Folders are only told apart from files
+// by the trailing slash of their name, the content of other files is never read as a manifest
+func (gsspr *Gossiper) readManifest(metaData FileMetaData) (*Manifest, error) {
+	content := make([]byte, 0)
+	for segment := uint64(0); segment < metaData.SegmentCount(gsspr.hashSize); segment++ {
+		chunkHashes, err := metaData.SegmentHashes(segment, gsspr.hashSize, gsspr.readMetaFileNode)
+		if err != nil {
+			return nil, err
+		}
+		for _, chunkHash := range chunkHashes {
+			chunk := gsspr.readChunkFile(chunkHash)
+			if chunk == nil {
+				return nil, errors.New("manifest chunk missing from the chunk directory")
+			}
+			if len(content)+len(chunk) > MANIFEST_MAX_SIZE {
+				return nil, errors.New("manifest larger than the limit")
+			}
+			content = append(content, chunk...)
+		}
+	}
+	manifest, err := DecodeManifest(content)
+	if err == nil && manifest == nil {
+		err = errors.New("not a manifest")
+	}
+	return manifest, err
+}
+
+// Download the files of a folder one after the other, under a directory named after the folder
+func downloadManifestFiles(gsspr *Gossiper, request DataRequest, folder *FileDownload,
+	metaData FileMetaData, manifest *Manifest) error {
+	folderName := strings.TrimSuffix(request.FileName, "/")
+	// The files are asked to the node we got the manifest from
+	destination := request.Destination
+	for _, origin := range metaData.Origins {
+		if destination == "" && origin != "" {
+			destination = origin
+		}
+	}
+	// Created even if the folder is empty
+	absPath, err := filepath.Abs("")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Join(absPath, gsspr.downloadedFilesDir, filepath.FromSlash(folderName)), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	entries := manifest.Entries
+	gsspr.fileDownloadsList.SetFiles(folder, 0, len(entries))
+	for i, entry := range entries {
+		if !gsspr.waitWhilePaused(folder) {
+			return gsspr.downloadInterruption(folder)
+		}
+		err := downloadFile(gsspr, DataRequest{
+			Origin:      gsspr.Name,
+			Destination: destination,
+			HopLimit:    request.HopLimit,
+			HashValue:   entry.MetafileHash,
+			FileName:    folderName + "/" + cleanManifestPath(entry.Path),
+		}, folder)
+		if err == ErrGossiperStopped || err == ErrDownloadCancelled {
+			return gsspr.downloadInterruption(folder)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", entry.Path, err)
+		}
+		gsspr.fileDownloadsList.SetFiles(folder, i+1, len(entries))
+	}
+	return nil
+}
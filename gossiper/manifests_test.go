@@ -0,0 +1,131 @@
+package gossiper
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestReadManifest(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "")
+	os.MkdirAll(alice.chunkFilesDir, 0755)
+	content, err := EncodeManifest(Manifest{
+		Entries: []ManifestEntry{{Path: "a/b.txt", Size: 1, MetafileHash: make([]byte, 32)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder, err := alice.indexContent(bytes.NewReader(content), "folder/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := alice.readManifest(*folder)
+	if err != nil || len(manifest.Entries) != 1 || manifest.Entries[0].Path != "a/b.txt" {
+		t.Fatalf("manifest read as %+v: %v", manifest, err)
+	}
+
+	file, _ := alice.indexContent(bytes.NewReader([]byte("not a manifest")), "file/")
+	if _, err = alice.readManifest(*file); err == nil {
+		t.Fatal("file read as a manifest")
+	}
+
+	huge := append(append([]byte{}, manifestMagic...), make([]byte, MANIFEST_MAX_SIZE)...)
+	hugeFolder, _ := alice.indexContent(bytes.NewReader(huge), "huge/")
+	if _, err = alice.readManifest(*hugeFolder); err == nil {
+		t.Fatal("manifest larger than the limit read")
+	}
+}
+
+func TestDownloadNamesKeptInDownloadsDirectory(t *testing.T) {
+	for name, cleaned := range map[string]string{
+		"file.txt":          "file.txt",
+		"folder/":           "folder/",
+		"a/./b/../c.txt":    "a/c.txt",
+		"../outside":        "",
+		"../":               "",
+		"folder/../../etc/": "",
+		"/etc/passwd":       "",
+		"a\\..\\b":          "",
+		"":                  "",
+		"/":                 "",
+	} {
+		if cleanDownloadName(name) != cleaned {
+			t.Errorf("%q cleaned to %q", name, cleanDownloadName(name))
+		}
+	}
+}
+
+func TestDownloadWithNameOutOfDownloadsDirectoryFails(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "")
+	err := downloadFile(alice, DataRequest{
+		Origin:      "alice",
+		Destination: "bob",
+		HopLimit:    10,
+		HashValue:   make([]byte, 32),
+		FileName:    "../../outside/",
+	}, nil)
+	if err == nil || len(alice.fileDownloadsList.fileDownloads) != 0 {
+		t.Fatal("download out of the downloads directory started")
+	}
+}
+
+func TestFolderWithEmptyFileDownloaded(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "")
+	bob := newTestGossiper(t, network, "bob", "127.0.0.1:5001", "")
+	var wait sync.WaitGroup
+	wait.Add(2)
+	alice.StartListeningGossip(&wait)
+	bob.StartListeningGossip(&wait)
+	alice.routingTable.RegisterNextHop("bob", "127.0.0.1:5001")
+	bob.routingTable.RegisterNextHop("alice", "127.0.0.1:5000")
+
+	os.MkdirAll(alice.sharedFilesDir+"folder", 0755)
+	os.MkdirAll(alice.chunkFilesDir, 0755)
+	content := bytes.Repeat([]byte("shared "), 2000)
+	ioutil.WriteFile(alice.sharedFilesDir+"folder/file.txt", content, 0644)
+	ioutil.WriteFile(alice.sharedFilesDir+"folder/empty.txt", nil, 0644)
+	folder, err := alice.indexSharedEntry("folder")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.MkdirAll(bob.chunkFilesDir, 0755)
+	err = downloadFile(bob, DataRequest{
+		Origin:      "bob",
+		Destination: "alice",
+		HopLimit:    10,
+		HashValue:   folder.HashValue,
+		FileName:    "folder/",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, err := ioutil.ReadFile(bob.downloadedFilesDir + "folder/empty.txt")
+	if err != nil || len(empty) != 0 {
+		t.Fatalf("empty file downloaded with %d bytes: %v", len(empty), err)
+	}
+	downloaded, err := ioutil.ReadFile(bob.downloadedFilesDir + "folder/file.txt")
+	if err != nil || !bytes.Equal(downloaded, content) {
+		t.Fatalf("file downloaded with %d bytes instead of %d: %v", len(downloaded), len(content), err)
+	}
+}
+
+func TestSharingMissingFileLogged(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "")
+	handleClientMessage(alice, &GossipPacket{
+		Simple: &SimpleMessage{
+			OriginalName:  "file",
+			RelayPeerAddr: "file",
+			Contents:      "missing.txt",
+		},
+	}, alice.addressStr)
+	if len(alice.metaDataList.metaDataFiles) != 0 {
+		t.Fatal("missing file shared")
+	}
+}
@@ -11,6 +11,13 @@ type RumorMessage struct {
 	Origin string
 	ID     uint32
 	Text   string
+	// Public key used to seal private messages for the origin
+	EncryptionKey []byte
+	// Signature by the origin of the other fields, checked with SigningKey
+	SigningKey []byte
+	Signature  []byte
+	// Optional topic, only subscribers of the topic keep and show the rumor
+	Topic string
 }
 
 type PeerStatus struct {
@@ -24,6 +31,41 @@ type PrivateMessage struct {
 	Text        string
 	Destination string
 	HopLimit    uint32
+	// Text encrypted for the destination, Text is empty when set
+	Nonce  []byte
+	Sealed []byte
+}
+
+// Message to every member of a named group
+type GroupMessage struct {
+	Origin   string
+	ID       uint32
+	Group    string
+	Members  []string
+	HopLimit uint32
+	// Text as written or read by a member, only Copies travel between peers
+	Text string
+	// One copy of the text for each member still to reach, relays split them by next hop
+	Copies []GroupCopy
+}
+
+type GroupCopy struct {
+	Destination string
+	Text        string
+	// Text encrypted for the destination, Text is empty when set
+	Nonce  []byte
+	Sealed []byte
+}
+
+// Sent back by the destination of a private message when it receives it, and again when it is read
+type PrivateAck struct {
+	Origin      string
+	Destination string
+	HopLimit    uint32
+	ID          uint32
+	Read        bool
+	// Signature of the acknowledgment by its origin, so relays can't forge it
+	Signature []byte
 }
 
 // Structs for file download
@@ -41,6 +83,8 @@ type DataReply struct {
 	HopLimit    uint32
 	HashValue   []byte
 	Data        []byte
+	// Address where the origin accepts stream connections, empty if it doesn't
+	StreamAddress string
 }
 
 // Structs for search
@@ -99,6 +143,10 @@ type GossipPacket struct {
 	SearchReply   *SearchReply
 	TxPublish     *TxPublish
 	BlockPublish  *BlockPublish
+	PrivateAck    *PrivateAck
+	// Private message to keep in our mailbox for its destination
+	MailboxDeposit *PrivateMessage
+	Group          *GroupMessage
 }
 
 // QueuedMessage
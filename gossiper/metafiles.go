@@ -3,14 +3,35 @@ package gossiper
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/dedis/protobuf"
 	"github.com/eliasmpw/Peerster/common"
+	"io"
+	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 )
 
+// Files with more chunks than this get a tree metafile, whose nodes list the hashes of this many
+// chunks or nodes. Files with less chunks keep a flat metafile, the list of their chunk hashes
+const METAFILE_FANOUT = 1024
+
+// The root of a tree metafile starts with "MTRE", the depth of the tree in 4 bytes and the number
+// of chunks in 8 bytes, big endian, followed by the hashes of the nodes of the level below.
+// Other nodes are kept in the chunk directory, and fetched with DataRequests as chunks are
+const METAFILE_TREE_HEADER_SIZE = 16
+
+// Deepest tree metafile accepted, for files of up to METAFILE_FANOUT^(METAFILE_MAX_DEPTH+1) chunks
+const METAFILE_MAX_DEPTH = 4
+
+var metaFileTreeMagic = []byte("MTRE")
+
 type FileMetaData struct {
 	Origins   []string
 	Name      string
@@ -20,27 +41,81 @@ type FileMetaData struct {
 	ChunkMap  []uint64
 }
 
-// Get the hash of a chunk in position i
-func (fmd FileMetaData) GetChunkHash(i uint64) []byte {
-	return fmd.ChunkHashes()[i]
+// Get the hash of a chunk in position i of a flat metafile
+func (fmd FileMetaData) GetChunkHash(i uint64, hashSize uint) []byte {
+	return fmd.ChunkHashes(hashSize)[i]
+}
+
+// Get a slice with all hashes of the chunks of a flat metafile, hashSize is in bits
+func (fmd FileMetaData) ChunkHashes(hashSize uint) [][]byte {
+	return splitHashes(fmd.MetaFile, hashSize)
+}
+
+// Number of segments of METAFILE_FANOUT chunks of the file, the last one can be shorter
+func (fmd FileMetaData) SegmentCount(hashSize uint) uint64 {
+	chunkNumber := GetChunkNumber(fmd.MetaFile, hashSize)
+	return (chunkNumber + METAFILE_FANOUT - 1) / METAFILE_FANOUT
 }
 
-// Get a slice with all hashes of the chunks
-func (fmd FileMetaData) ChunkHashes() [][]byte {
-	hashSizeInBytes := int(myGossiper.hashSize) / 8
-	arrayHashes := make([][]byte, 0)
-	for i := 0; i < len(fmd.MetaFile); i += hashSizeInBytes {
-		hash := fmd.MetaFile[i : i+hashSizeInBytes]
-		aux := make([]byte, len(hash))
-		copy(aux, hash)
-		arrayHashes = append(arrayHashes, aux)
+// Get the hashes of the chunks of a segment. The nodes of a tree metafile are got with getNode
+// and each one is checked against its hash in the parent node, so the nodes from the root down
+// to a segment are the proof of its chunk hashes
+func (fmd FileMetaData) SegmentHashes(segment uint64, hashSize uint,
+	getNode func(hash []byte) ([]byte, error)) ([][]byte, error) {
+	hashSizeInBytes := uint64(hashSize / 8)
+	if !isTreeMetaFile(fmd.MetaFile, hashSize) {
+		chunkNumber := GetChunkNumber(fmd.MetaFile, hashSize)
+		first := segment * METAFILE_FANOUT
+		if first >= chunkNumber {
+			return nil, errors.New("segment out of the metafile")
+		}
+		last := first + METAFILE_FANOUT
+		if last > chunkNumber {
+			last = chunkNumber
+		}
+		return splitHashes(fmd.MetaFile[first*hashSizeInBytes:last*hashSizeInBytes], hashSize), nil
 	}
-	return arrayHashes
+
+	// The depth and the size of the root were checked against the chunk count by isTreeMetaFile
+	depth := binary.BigEndian.Uint32(fmd.MetaFile[4:8])
+	chunkCount := GetChunkNumber(fmd.MetaFile, hashSize)
+	segmentCount := fmd.SegmentCount(hashSize)
+	if segment >= segmentCount {
+		return nil, errors.New("segment out of the metafile")
+	}
+	entries := splitHashes(fmd.MetaFile[METAFILE_TREE_HEADER_SIZE:], hashSize)
+	// Segments under each entry of the current level, and the first segment under the current node
+	span := uint64(1)
+	for level := uint32(1); level < depth; level++ {
+		span *= METAFILE_FANOUT
+	}
+	first := uint64(0)
+	for level := depth; level >= 1; level-- {
+		position := (segment - first) / span
+		node, err := getNode(entries[position])
+		if err != nil {
+			return nil, err
+		}
+		nodeHash := sha256.Sum256(node)
+		first += position * span
+		// A node lists the hashes of all the chunks or nodes under it, the last ones can be shorter
+		expected := min64(chunkCount-first*METAFILE_FANOUT, METAFILE_FANOUT)
+		if level > 1 {
+			childSpan := span / METAFILE_FANOUT
+			expected = (min64(segmentCount-first, span) + childSpan - 1) / childSpan
+		}
+		if !bytes.Equal(nodeHash[:], entries[position]) || uint64(len(node)) != expected*hashSizeInBytes {
+			return nil, errors.New("invalid metafile node " + hex.EncodeToString(entries[position]))
+		}
+		entries = splitHashes(node, hashSize)
+		span /= METAFILE_FANOUT
+	}
+	return entries, nil
 }
 
 // Return the index position of a chunk
-func (fmd FileMetaData) GetPositionOfChunk(chunkHash []byte) *int {
-	allHashes := fmd.ChunkHashes()
+func (fmd FileMetaData) GetPositionOfChunk(chunkHash []byte, hashSize uint) *int {
+	allHashes := fmd.ChunkHashes(hashSize)
 	for i := 0; i < len(allHashes); i++ {
 		if bytes.Equal(chunkHash, allHashes[i]) {
 			return &i
@@ -49,9 +124,12 @@ func (fmd FileMetaData) GetPositionOfChunk(chunkHash []byte) *int {
 	return nil
 }
 
-func GetChunkNumber(metaFile []byte) uint64 {
+func GetChunkNumber(metaFile []byte, hashSize uint) uint64 {
+	if isTreeMetaFile(metaFile, hashSize) {
+		return binary.BigEndian.Uint64(metaFile[8:METAFILE_TREE_HEADER_SIZE])
+	}
 	dataLen := uint64(len(metaFile))
-	hashSizeInBytes := uint64(myGossiper.hashSize / 8)
+	hashSizeInBytes := uint64(hashSize / 8)
 
 	division := float64(dataLen) / float64(hashSizeInBytes)
 	return uint64(math.Ceil(division))
@@ -60,12 +138,17 @@ func GetChunkNumber(metaFile []byte) uint64 {
 // Structure containing slice of meta data files and a mutex
 type MetaDataList struct {
 	metaDataFiles []FileMetaData
-	mutex         *sync.Mutex
+	// Where every change is saved, if set
+	store *MessageStore
+	// Number of chunk records written for each file since its record was last written
+	chunkRecords map[string]int
+	mutex        *sync.Mutex
 }
 
 func NewMetaDataList() *MetaDataList {
 	return &MetaDataList{
 		metaDataFiles: make([]FileMetaData, 0),
+		chunkRecords:  make(map[string]int),
 		mutex:         &sync.Mutex{},
 	}
 }
@@ -90,6 +173,7 @@ func (mdl *MetaDataList) Add(fmd FileMetaData) {
 	}
 	mdl.mutex.Lock()
 	mdl.metaDataFiles = append(mdl.metaDataFiles, fmd)
+	mdl.persist(fmd)
 	mdl.mutex.Unlock()
 }
 
@@ -108,19 +192,342 @@ func (mdl *MetaDataList) GetByHash(hash []byte) *FileMetaData {
 
 // Add a chunk number we received to the chunk map
 func (mdl *MetaDataList) AddChunkNumberToMap(hash []byte, chunkNumber uint64) {
+	mdl.updateChunkMap(hash, chunkNumber, true)
+}
+
+// Remove a chunk number from the chunk map once the chunk is no longer in the chunk directory
+func (mdl *MetaDataList) RemoveChunkNumberFromMap(hash []byte, chunkNumber uint64) {
+	mdl.updateChunkMap(hash, chunkNumber, false)
+}
+
+// Add or remove a chunk number. Only the change is saved, as a chunk record, the record of the
+// file is rewritten once it has more chunk records than chunks in its chunk map
+func (mdl *MetaDataList) updateChunkMap(hash []byte, chunkNumber uint64, present bool) {
 	mdl.mutex.Lock()
+	defer mdl.mutex.Unlock()
 	for i, fmd := range mdl.metaDataFiles {
 		if bytes.Equal(fmd.HashValue, hash) {
-			mdl.metaDataFiles[i].ChunkMap = append(mdl.metaDataFiles[i].ChunkMap, chunkNumber)
-			mdl.mutex.Unlock()
+			if present {
+				mdl.metaDataFiles[i].ChunkMap = insertChunkNumber(fmd.ChunkMap, chunkNumber)
+			} else {
+				mdl.metaDataFiles[i].ChunkMap = removeChunkNumber(fmd.ChunkMap, chunkNumber)
+			}
+			mdl.persistChunk(mdl.metaDataFiles[i], chunkNumber, present)
 			return
 		}
 	}
+}
+
+// Remove a FileMetaData, its metafile is no longer served and it isn't found by searches
+func (mdl *MetaDataList) Remove(hash []byte) *FileMetaData {
+	mdl.mutex.Lock()
+	for i, fmd := range mdl.metaDataFiles {
+		if bytes.Equal(fmd.HashValue, hash) {
+			mdl.metaDataFiles = append(mdl.metaDataFiles[:i], mdl.metaDataFiles[i+1:]...)
+			if mdl.store != nil {
+				checkStoreError(mdl.store.Delete(fileStoreKey(hash)))
+				checkStoreError(mdl.store.DeletePrefix(chunkStorePrefix(hash)))
+				delete(mdl.chunkRecords, fileStoreKey(hash))
+			}
+			mdl.mutex.Unlock()
+			return &fmd
+		}
+	}
 	mdl.mutex.Unlock()
+	return nil
+}
+
+func fileStoreKey(hash []byte) string {
+	return STORE_FILE_PREFIX + hex.EncodeToString(hash)
+}
+
+func chunkStorePrefix(hash []byte) string {
+	return STORE_CHUNK_PREFIX + hex.EncodeToString(hash) + "/"
+}
+
+// Write the record of a file, which replaces its chunk records. The mutex must be held
+func (mdl *MetaDataList) persist(fmd FileMetaData) {
+	if mdl.store == nil {
+		return
+	}
+	checkStoreError(mdl.store.Put(fileStoreKey(fmd.HashValue), &fmd))
+	checkStoreError(mdl.store.DeletePrefix(chunkStorePrefix(fmd.HashValue)))
+	delete(mdl.chunkRecords, fileStoreKey(fmd.HashValue))
+}
+
+// Write the change of one chunk of the chunk map of a file. The mutex must be held
+func (mdl *MetaDataList) persistChunk(fmd FileMetaData, chunkNumber uint64, present bool) {
+	if mdl.store == nil {
+		return
+	}
+	if mdl.chunkRecords[fileStoreKey(fmd.HashValue)] >= len(fmd.ChunkMap) {
+		mdl.persist(fmd)
+		return
+	}
+	err := mdl.store.Put(chunkStorePrefix(fmd.HashValue)+fmt.Sprint(chunkNumber), &storedChunkChange{
+		HashValue: fmd.HashValue,
+		Number:    chunkNumber,
+		Present:   present,
+	})
+	checkStoreError(err)
+	mdl.chunkRecords[fileStoreKey(fmd.HashValue)]++
+}
+
+// Reload the files we shared or downloaded before a restart. Chunks whose file is missing
+// from the chunk directory are removed from the chunk map, the content of the others is checked
+// by the scrub that follows at startup
+func (gsspr *Gossiper) loadFileIndex() {
+	chunkChanges := make(map[string][]storedChunkChange)
+	for _, value := range gsspr.store.Scan(STORE_CHUNK_PREFIX) {
+		change := storedChunkChange{}
+		if protobuf.Decode(value, &change) == nil {
+			key := fileStoreKey(change.HashValue)
+			chunkChanges[key] = append(chunkChanges[key], change)
+		}
+	}
+	// Chunk records are merged into the records of their files, or dropped with them
+	defer func() {
+		checkStoreError(gsspr.store.DeletePrefix(STORE_CHUNK_PREFIX))
+	}()
+	for _, value := range gsspr.store.Scan(STORE_FILE_PREFIX) {
+		fmd := FileMetaData{}
+		if protobuf.Decode(value, &fmd) != nil {
+			continue
+		}
+		metaFileHash := sha256.Sum256(fmd.MetaFile)
+		if !bytes.Equal(metaFileHash[:], fmd.HashValue) || !validMetaFile(fmd.MetaFile, gsspr.hashSize) {
+			checkStoreError(gsspr.store.Delete(fileStoreKey(fmd.HashValue)))
+			continue
+		}
+		changes := chunkChanges[fileStoreKey(fmd.HashValue)]
+		for _, change := range changes {
+			if change.Present {
+				fmd.ChunkMap = insertChunkNumber(fmd.ChunkMap, change.Number)
+			} else {
+				fmd.ChunkMap = removeChunkNumber(fmd.ChunkMap, change.Number)
+			}
+		}
+		chunkMap := gsspr.verifiedChunkMap(fmd, func(chunkHash []byte) bool {
+			_, exists := gsspr.chunkFileSize(chunkHash)
+			return exists
+		})
+		damaged := len(chunkMap) != len(fmd.ChunkMap)
+		fmd.ChunkMap = chunkMap
+		gsspr.metaDataList.mutex.Lock()
+		gsspr.metaDataList.metaDataFiles = append(gsspr.metaDataList.metaDataFiles, fmd)
+		if damaged || len(changes) > 0 {
+			gsspr.metaDataList.persist(fmd)
+		}
+		gsspr.metaDataList.mutex.Unlock()
+		if damaged {
+			gsspr.chunkStore.MarkDamaged(fmd.HashValue)
+		}
+		gsspr.registerChunks(fmd)
+	}
+}
+
+// The chunk numbers of the chunk map of a file whose chunk passes check. Chunks under a missing
+// node of a tree metafile can't be checked and are left out
+func (gsspr *Gossiper) verifiedChunkMap(fmd FileMetaData, check func(chunkHash []byte) bool) []uint64 {
+	chunkCount := GetChunkNumber(fmd.MetaFile, gsspr.hashSize)
+	chunkMap := make([]uint64, 0, len(fmd.ChunkMap))
+	// The chunk map is sorted, the hashes of each segment are read once
+	segment := uint64(0)
+	var segmentHashes [][]byte
+	for _, chunkNumber := range fmd.ChunkMap {
+		if chunkNumber < 1 || chunkNumber > chunkCount {
+			continue
+		}
+		if segmentHashes == nil || (chunkNumber-1)/METAFILE_FANOUT != segment {
+			segment = (chunkNumber - 1) / METAFILE_FANOUT
+			segmentHashes, _ = fmd.SegmentHashes(segment, gsspr.hashSize, gsspr.readMetaFileNode)
+		}
+		if segmentHashes != nil && check(segmentHashes[(chunkNumber-1)%METAFILE_FANOUT]) {
+			chunkMap = append(chunkMap, chunkNumber)
+		}
+	}
+	return chunkMap
+}
+
+// Read a chunk from the chunk directory, nil if it is missing or doesn't match its hash
+func (gsspr *Gossiper) readChunkFile(chunkHash []byte) []byte {
+	chunk, err := ioutil.ReadFile(gsspr.chunkFilesDir + GetChunkFilename(chunkHash, gsspr.hashSize))
+	if err != nil {
+		return nil
+	}
+	hash := sha256.Sum256(chunk)
+	if !bytes.Equal(hash[:], chunkHash) {
+		return nil
+	}
+	return chunk
+}
+
+// Read a node of a tree metafile from the chunk directory
+func (gsspr *Gossiper) readMetaFileNode(hash []byte) ([]byte, error) {
+	node := gsspr.readChunkFile(hash)
+	if node == nil {
+		return nil, errors.New("metafile node " + hex.EncodeToString(hash) + " missing from the chunk directory")
+	}
+	return node, nil
 }
 
 // Helper functions
 
+// Insert a chunk number in a sorted chunk map, chunks can be received in any order. The chunk
+// map is copied, copies of the metadata share it
+func insertChunkNumber(chunkMap []uint64, chunkNumber uint64) []uint64 {
+	position := sort.Search(len(chunkMap), func(i int) bool {
+		return chunkMap[i] >= chunkNumber
+	})
+	if position < len(chunkMap) && chunkMap[position] == chunkNumber {
+		return chunkMap
+	}
+	inserted := make([]uint64, 0, len(chunkMap)+1)
+	inserted = append(inserted, chunkMap[:position]...)
+	inserted = append(inserted, chunkNumber)
+	return append(inserted, chunkMap[position:]...)
+}
+
+// Remove a chunk number from a sorted chunk map
+func removeChunkNumber(chunkMap []uint64, chunkNumber uint64) []uint64 {
+	position := sort.Search(len(chunkMap), func(i int) bool {
+		return chunkMap[i] >= chunkNumber
+	})
+	if position == len(chunkMap) || chunkMap[position] != chunkNumber {
+		return chunkMap
+	}
+	removed := make([]uint64, 0, len(chunkMap)-1)
+	removed = append(removed, chunkMap[:position]...)
+	return append(removed, chunkMap[position+1:]...)
+}
+
+// Split a list of hashes
+func splitHashes(data []byte, hashSize uint) [][]byte {
+	hashSizeInBytes := int(hashSize) / 8
+	hashes := make([][]byte, 0, len(data)/hashSizeInBytes)
+	for i := 0; i+hashSizeInBytes <= len(data); i += hashSizeInBytes {
+		hash := make([]byte, hashSizeInBytes)
+		copy(hash, data[i:i+hashSizeInBytes])
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+func hasTreeHeader(metaFile []byte) bool {
+	return len(metaFile) > METAFILE_TREE_HEADER_SIZE &&
+		bytes.Equal(metaFile[:len(metaFileTreeMagic)], metaFileTreeMagic)
+}
+
+// Check the header of a tree metafile, which comes from the peer that sent it. The tree has
+// ceil(log1024(chunkCount)) levels counting the root, the depth counts those below the root,
+// and the root lists one hash for each node of the level below
+func isTreeMetaFile(metaFile []byte, hashSize uint) bool {
+	if !hasTreeHeader(metaFile) || (len(metaFile)-METAFILE_TREE_HEADER_SIZE)%int(hashSize/8) != 0 {
+		return false
+	}
+	depth := binary.BigEndian.Uint32(metaFile[4:8])
+	chunkCount := binary.BigEndian.Uint64(metaFile[8:METAFILE_TREE_HEADER_SIZE])
+	if depth < 1 || depth > METAFILE_MAX_DEPTH {
+		return false
+	}
+	// Chunks under each entry of the root
+	span := uint64(METAFILE_FANOUT)
+	for level := uint32(1); level < depth; level++ {
+		span *= METAFILE_FANOUT
+	}
+	if chunkCount <= span || chunkCount > span*METAFILE_FANOUT {
+		return false
+	}
+	entries := (chunkCount + span - 1) / span
+	return uint64(len(metaFile)-METAFILE_TREE_HEADER_SIZE) == entries*uint64(hashSize/8)
+}
+
+// Check a metafile we received: a flat list of at most METAFILE_FANOUT hashes, empty for an
+// empty file, or the root of a tree metafile with a valid header
+func validMetaFile(metaFile []byte, hashSize uint) bool {
+	if hasTreeHeader(metaFile) {
+		return isTreeMetaFile(metaFile, hashSize)
+	}
+	hashSizeInBytes := int(hashSize / 8)
+	return len(metaFile)%hashSizeInBytes == 0 && len(metaFile)/hashSizeInBytes <= METAFILE_FANOUT
+}
+
+func min64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Builds the metafile of a file from its chunk hashes in order. The nodes of a tree metafile are
+// given to writeNode as soon as they are complete, so the hashes of a big file are never all kept
+type metaFileBuilder struct {
+	hashSize  uint
+	writeNode func(node []byte)
+	// Hashes of the node being filled at each level, level 0 lists chunk hashes
+	levels     [][]byte
+	chunkCount uint64
+}
+
+func newMetaFileBuilder(hashSize uint, writeNode func(node []byte)) *metaFileBuilder {
+	return &metaFileBuilder{
+		hashSize:  hashSize,
+		writeNode: writeNode,
+		levels:    [][]byte{make([]byte, 0)},
+	}
+}
+
+func (mfb *metaFileBuilder) AddChunkHash(hash []byte) {
+	mfb.chunkCount++
+	mfb.add(0, hash)
+}
+
+// Nodes are only closed when one more hash arrives, files of METAFILE_FANOUT chunks stay flat
+func (mfb *metaFileBuilder) add(level int, hash []byte) {
+	if level == len(mfb.levels) {
+		mfb.levels = append(mfb.levels, make([]byte, 0))
+	}
+	if len(mfb.levels[level]) == METAFILE_FANOUT*int(mfb.hashSize/8) {
+		mfb.closeNode(level)
+	}
+	mfb.levels[level] = append(mfb.levels[level], hash...)
+}
+
+// Write the node being filled at level and add its hash to the level above
+func (mfb *metaFileBuilder) closeNode(level int) {
+	node := mfb.levels[level]
+	mfb.levels[level] = make([]byte, 0)
+	if mfb.writeNode != nil {
+		mfb.writeNode(node)
+	}
+	hash := sha256.Sum256(node)
+	mfb.add(level+1, hash[:])
+}
+
+// The flat metafile, or the root of the tree once its last nodes are written
+func (mfb *metaFileBuilder) MetaFile() []byte {
+	if len(mfb.levels) == 1 {
+		return mfb.levels[0]
+	}
+	for level := 0; level < len(mfb.levels)-1; level++ {
+		mfb.closeNode(level)
+	}
+	root := make([]byte, METAFILE_TREE_HEADER_SIZE)
+	copy(root, metaFileTreeMagic)
+	binary.BigEndian.PutUint32(root[4:8], uint32(len(mfb.levels)-1))
+	binary.BigEndian.PutUint64(root[8:METAFILE_TREE_HEADER_SIZE], mfb.chunkCount)
+	return append(root, mfb.levels[len(mfb.levels)-1]...)
+}
+
+// Metafile of a file with the given chunk hashes, without writing the nodes of a tree metafile
+func BuildMetaFile(chunkHashes [][]byte, hashSize uint) []byte {
+	builder := newMetaFileBuilder(hashSize, nil)
+	for _, hash := range chunkHashes {
+		builder.AddChunkHash(hash)
+	}
+	return builder.MetaFile()
+}
+
 // Split a byte slice of a file to chunks
 func SplitToChunks(data []byte, chunkSize uint) *[][]byte {
 	length := len(data)
@@ -154,15 +561,16 @@ func CreateChunkHashes(chunks *[][]byte) [][]byte {
 	return chunkHashes
 }
 
-// Write file bytes on disk
+// Write file bytes on disk, under a temporary name renamed once written so the file is never
+// read half written
 func WriteFileOnDisk(data []byte, dir, fileName string) {
 	os.MkdirAll(dir, os.ModePerm)
-	fullPath := dir + fileName
-	file, err := os.Create(fullPath)
+	file, err := ioutil.TempFile(dir, fileName+".tmp")
 	common.CheckError(err)
-	defer file.Close()
 	_, err = file.Write(data)
 	file.Sync()
+	file.Close()
+	os.Rename(file.Name(), dir+fileName)
 }
 
 func ChunkFileName(chunk []byte) string {
@@ -188,17 +596,162 @@ func WriteChunksOnDisk(chunks [][]byte, dir, fileName string) {
 	}
 }
 
-func ReconstructFromChunks(chunks *[][]byte) *[]byte {
-	completeFile := make([]byte, 0)
-	for i := 0; i < len(*chunks); i++ {
-		completeFile = append(completeFile, (*chunks)[i]...)
+// Hash a file chunk by chunk and write every chunk to the chunk directory as it is read, the
+// file is never loaded whole. The nodes of a tree metafile are written there too. Returns the
+// metafile and the size of the file
+func IndexFileChunks(path string, chunkSize, hashSize uint, chunkDir string) ([]byte, uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
 	}
+	defer file.Close()
+	return IndexChunks(file, chunkSize, hashSize, chunkDir)
+}
+
+// Same as IndexFileChunks for content read from reader
+func IndexChunks(reader io.Reader, chunkSize, hashSize uint, chunkDir string) ([]byte, uint64, error) {
+	builder := newMetaFileBuilder(hashSize, func(node []byte) {
+		WriteChunksOnDisk([][]byte{node}, chunkDir, "")
+	})
+	size := uint64(0)
+	chunk := make([]byte, chunkSize)
+	for {
+		read, err := io.ReadFull(reader, chunk)
+		if read > 0 {
+			hash := sha256.Sum256(chunk[:read])
+			builder.AddChunkHash(hash[:])
+			size += uint64(read)
+			WriteChunksOnDisk([][]byte{chunk[:read]}, chunkDir, "")
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return builder.MetaFile(), size, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// Index a file or folder at the top of the shared files directory, a folder is shared with the
+// manifest of its files
+func (gsspr *Gossiper) indexSharedEntry(name string) (*FileMetaData, error) {
+	absPath, err := filepath.Abs("")
+	if err != nil {
+		return nil, err
+	}
+	path := absPath +
+		string(os.PathSeparator) +
+		gsspr.sharedFilesDir +
+		name
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return gsspr.shareDirectory(path, name)
+	}
+	return gsspr.indexFile(path, name)
+}
 
-	return &completeFile
+// Index a file of the shared files directory under the given name, its chunks are written to
+// the chunk directory
+func (gsspr *Gossiper) indexFile(path, name string) (*FileMetaData, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return gsspr.indexContent(file, name)
+}
+
+// Index content read from reader as a file we share under the given name
+func (gsspr *Gossiper) indexContent(reader io.Reader, name string) (*FileMetaData, error) {
+	// Hash the file chunk by chunk, storing the chunks as they are read
+	metaFile, fileSize, err := IndexChunks(reader, gsspr.chunkSize, gsspr.hashSize, gsspr.chunkFilesDir)
+	if err != nil {
+		return nil, err
+	}
+	// Create hash of metafile
+	hashValue := sha256.Sum256(metaFile)
+	chunkCount := GetChunkNumber(metaFile, gsspr.hashSize)
+	completeChunkMap := make([]uint64, chunkCount)
+	for i := uint64(0); i < chunkCount; i++ {
+		completeChunkMap[i] = uint64(i + 1)
+	}
+	// Add to the MetaData List
+	metaData := FileMetaData{
+		Origins:   []string{gsspr.Name},
+		Name:      name,
+		Size:      fileSize,
+		MetaFile:  metaFile,
+		HashValue: hashValue[:],
+		ChunkMap:  completeChunkMap,
+	}
+	gsspr.metaDataList.Add(metaData)
+	gsspr.registerChunks(metaData)
+	return &metaData, nil
+}
+
+// Publish the name of a file we share in the blockchain and tell our peers about it
+func (gsspr *Gossiper) publishSharedFile(metaData FileMetaData) {
+	processTransactionReceived(gsspr, TxPublish{
+		File: File{
+			Name:         metaData.Name,
+			Size:         int64(metaData.Size),
+			MetafileHash: metaData.HashValue,
+		},
+		HopLimit: uint32(gsspr.hopLimit), // Set to 10 by default
+	}, "")
+	logFileShared(metaData.Name, hex.EncodeToString(metaData.HashValue))
+	broadcastNewFile(gsspr, File{
+		Name:         metaData.Name,
+		Size:         int64(metaData.Size),
+		MetafileHash: metaData.HashValue,
+	})
+}
+
+// Write a file made of the chunks of metaData, read one by one from the chunk directory. The
+// file is written under a temporary name and renamed once complete
+func (gsspr *Gossiper) reconstructFromChunkFiles(metaData FileMetaData, dir, fileName string) error {
+	if cleanDownloadName(filepath.ToSlash(fileName)) == "" {
+		return errors.New("invalid file name " + fileName)
+	}
+	filePath := filepath.Join(dir, fileName)
+	// The files of a folder are in its subdirectories
+	err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	partialPath := filePath + ".part"
+	file, err := os.Create(partialPath)
+	if err != nil {
+		return err
+	}
+	for segment := uint64(0); segment < metaData.SegmentCount(gsspr.hashSize) && err == nil; segment++ {
+		var chunkHashes [][]byte
+		chunkHashes, err = metaData.SegmentHashes(segment, gsspr.hashSize, gsspr.readMetaFileNode)
+		for index := 0; index < len(chunkHashes) && err == nil; index++ {
+			chunk := gsspr.readChunkFile(chunkHashes[index])
+			if chunk == nil {
+				err = fmt.Errorf("chunk %d missing from the chunk directory", segment*METAFILE_FANOUT+uint64(index)+1)
+				break
+			}
+			_, err = file.Write(chunk)
+		}
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(partialPath)
+		return err
+	}
+	return os.Rename(partialPath, filePath)
 }
 
-func GetChunkFilename(hash []byte) string {
-	offset := myGossiper.hashSize / 8
+func GetChunkFilename(hash []byte, hashSize uint) string {
+	offset := hashSize / 8
 
 	hashString := hex.EncodeToString(hash[:offset])
 	// Limit chunk filename size
@@ -0,0 +1,215 @@
+package gossiper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func testChunkHash(i uint64) []byte {
+	hash := make([]byte, 32)
+	binary.BigEndian.PutUint64(hash, i)
+	return hash
+}
+
+// Build the metafile of chunkCount chunks, keeping the nodes of a tree metafile to get them back
+func buildTestMetaFile(chunkCount uint64) (FileMetaData, func(hash []byte) ([]byte, error)) {
+	nodes := make(map[string][]byte)
+	builder := newMetaFileBuilder(256, func(node []byte) {
+		hash := sha256.Sum256(node)
+		nodes[string(hash[:])] = append([]byte{}, node...)
+	})
+	for i := uint64(0); i < chunkCount; i++ {
+		builder.AddChunkHash(testChunkHash(i))
+	}
+	metaFile := builder.MetaFile()
+	getNode := func(hash []byte) ([]byte, error) {
+		node, exists := nodes[string(hash)]
+		if !exists {
+			return nil, errors.New("missing node")
+		}
+		return node, nil
+	}
+	return FileMetaData{MetaFile: metaFile}, getNode
+}
+
+func checkSegments(t *testing.T, fmd FileMetaData, getNode func(hash []byte) ([]byte, error), chunkCount uint64) {
+	if GetChunkNumber(fmd.MetaFile, 256) != chunkCount {
+		t.Fatalf("%d chunks in a metafile of %d", GetChunkNumber(fmd.MetaFile, 256), chunkCount)
+	}
+	next := uint64(0)
+	for segment := uint64(0); segment < fmd.SegmentCount(256); segment++ {
+		hashes, err := fmd.SegmentHashes(segment, 256, getNode)
+		if err != nil {
+			t.Fatalf("segment %d of %d chunks: %v", segment, chunkCount, err)
+		}
+		for _, hash := range hashes {
+			if !bytes.Equal(hash, testChunkHash(next)) {
+				t.Fatalf("chunk %d of %d out of place", next, chunkCount)
+			}
+			next++
+		}
+	}
+	if next != chunkCount {
+		t.Fatalf("%d chunk hashes in the segments of %d chunks", next, chunkCount)
+	}
+}
+
+func TestMetaFileBuilderAroundFanout(t *testing.T) {
+	for _, chunkCount := range []uint64{1, METAFILE_FANOUT - 1, METAFILE_FANOUT, METAFILE_FANOUT + 1} {
+		fmd, getNode := buildTestMetaFile(chunkCount)
+		tree := isTreeMetaFile(fmd.MetaFile, 256)
+		if tree != (chunkCount > METAFILE_FANOUT) || !validMetaFile(fmd.MetaFile, 256) {
+			t.Fatalf("metafile of %d chunks built as a tree: %v", chunkCount, tree)
+		}
+		checkSegments(t, fmd, getNode, chunkCount)
+	}
+}
+
+func TestMetaFileBuilderAroundSecondLevel(t *testing.T) {
+	for _, chunkCount := range []uint64{METAFILE_FANOUT * METAFILE_FANOUT, METAFILE_FANOUT*METAFILE_FANOUT + 1} {
+		fmd, getNode := buildTestMetaFile(chunkCount)
+		depth := binary.BigEndian.Uint32(fmd.MetaFile[4:8])
+		if !isTreeMetaFile(fmd.MetaFile, 256) || (depth == 2) != (chunkCount > METAFILE_FANOUT*METAFILE_FANOUT) {
+			t.Fatalf("metafile of %d chunks with depth %d", chunkCount, depth)
+		}
+		checkSegments(t, fmd, getNode, chunkCount)
+	}
+}
+
+func TestTreeMetaFileHeaderChecked(t *testing.T) {
+	fmd, _ := buildTestMetaFile(METAFILE_FANOUT + 1)
+	forge := func(depth uint32, chunkCount uint64) []byte {
+		metaFile := append([]byte{}, fmd.MetaFile...)
+		binary.BigEndian.PutUint32(metaFile[4:8], depth)
+		binary.BigEndian.PutUint64(metaFile[8:METAFILE_TREE_HEADER_SIZE], chunkCount)
+		return metaFile
+	}
+	for _, forged := range [][]byte{
+		// Depths whose tree can't hold the chunk count, 8 used to overflow the span
+		forge(2, METAFILE_FANOUT+1),
+		forge(8, METAFILE_FANOUT+1),
+		// Chunk counts the root doesn't have a hash for
+		forge(1, 3*METAFILE_FANOUT),
+		forge(1, 1<<62),
+		forge(1, METAFILE_FANOUT),
+	} {
+		if isTreeMetaFile(forged, 256) || validMetaFile(forged, 256) {
+			t.Fatalf("tree metafile with depth %d and %d chunks accepted",
+				binary.BigEndian.Uint32(forged[4:8]), binary.BigEndian.Uint64(forged[8:16]))
+		}
+	}
+}
+
+func TestSegmentNodeWithWrongHashCountRejected(t *testing.T) {
+	fmd, getNode := buildTestMetaFile(METAFILE_FANOUT + 1)
+	// The last segment has one chunk, a node listing two doesn't match the header
+	last := make([]byte, 0)
+	last = append(last, testChunkHash(METAFILE_FANOUT)...)
+	last = append(last, testChunkHash(METAFILE_FANOUT+1)...)
+	lastHash := sha256.Sum256(last)
+	copy(fmd.MetaFile[METAFILE_TREE_HEADER_SIZE+32:], lastHash[:])
+	_, err := fmd.SegmentHashes(1, 256, func(hash []byte) ([]byte, error) {
+		if bytes.Equal(hash, lastHash[:]) {
+			return last, nil
+		}
+		return getNode(hash)
+	})
+	if err == nil {
+		t.Fatal("segment node with more hashes than the header counts accepted")
+	}
+	if _, err = fmd.SegmentHashes(0, 256, getNode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Reader generating size bytes of content, which keeps the largest read asked from it
+type generatedContent struct {
+	remaining int
+	next      byte
+	largest   int
+}
+
+func (gc *generatedContent) Read(buffer []byte) (int, error) {
+	if len(buffer) > gc.largest {
+		gc.largest = len(buffer)
+	}
+	if gc.remaining == 0 {
+		return 0, io.EOF
+	}
+	read := len(buffer)
+	if read > gc.remaining {
+		read = gc.remaining
+	}
+	for i := 0; i < read; i++ {
+		buffer[i] = gc.next
+		gc.next = gc.next*31 + 7
+	}
+	gc.remaining -= read
+	return read, nil
+}
+
+// Hash of content read from reader, without keeping it
+func streamHash(t *testing.T, reader io.Reader) []byte {
+	h := sha256.New()
+	if _, err := io.Copy(h, reader); err != nil {
+		t.Fatal(err)
+	}
+	return h.Sum(nil)
+}
+
+func TestFileIndexedAndReconstructedChunkByChunk(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "")
+	os.MkdirAll(alice.chunkFilesDir, 0755)
+	// Small chunks, so the file gets a tree metafile whose nodes are in the chunk directory
+	const chunkSize = 64
+	const size = (METAFILE_FANOUT+300)*chunkSize + 10
+
+	content := &generatedContent{remaining: size}
+	metaFile, indexedSize, err := IndexChunks(content, chunkSize, alice.hashSize, alice.chunkFilesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexedSize != size || GetChunkNumber(metaFile, alice.hashSize) != METAFILE_FANOUT+301 {
+		t.Fatalf("%d bytes indexed in %d chunks", indexedSize, GetChunkNumber(metaFile, alice.hashSize))
+	}
+	if content.largest > chunkSize {
+		t.Fatalf("%d bytes read at once for chunks of %d", content.largest, chunkSize)
+	}
+
+	// Indexing the file on disk gives the same metafile
+	path := alice.sharedFilesDir + "file"
+	os.MkdirAll(alice.sharedFilesDir, 0755)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(file, &generatedContent{remaining: size})
+	file.Close()
+	fileMetaFile, _, err := IndexFileChunks(path, chunkSize, alice.hashSize, alice.chunkFilesDir)
+	if err != nil || !bytes.Equal(fileMetaFile, metaFile) {
+		t.Fatalf("file on disk indexed with another metafile: %v", err)
+	}
+
+	metaData := FileMetaData{
+		Name:     "file",
+		MetaFile: metaFile,
+	}
+	err = alice.reconstructFromChunkFiles(metaData, alice.downloadedFilesDir, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reconstructed, err := os.Open(alice.downloadedFilesDir + "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reconstructed.Close()
+	if !bytes.Equal(streamHash(t, reconstructed), streamHash(t, &generatedContent{remaining: size})) {
+		t.Fatal("reconstructed file differs from the indexed one")
+	}
+}
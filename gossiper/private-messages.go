@@ -0,0 +1,278 @@
+package gossiper
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Delivery status of the private messages we send
+const PRIVATE_PENDING = "pending"
+const PRIVATE_DELIVERED = "delivered"
+const PRIVATE_READ = "read"
+const PRIVATE_FAILED = "failed"
+
+// Not sent because the destination advertised no encryption key
+const PRIVATE_NO_KEY = "no key"
+
+// Kept in the mailbox until the destination is reachable
+const PRIVATE_STORED = "stored"
+
+// First wait for an acknowledgment until the round-trip time of the destination is measured,
+// doubled after every attempt
+const PRIVATE_RETRY_TIMEOUT = 1000 * time.Millisecond
+const PRIVATE_MAX_ATTEMPTS = 6
+
+// Keeps the status of the private messages we sent and which received ones were already acknowledged
+type PrivateMessagesTracker struct {
+	nextId   uint32
+	statuses map[uint32]string
+	// Destination of each message we sent, the only node whose acknowledgments we accept
+	destinations map[uint32]string
+	acks         map[uint32]chan *PrivateAck
+	// Received messages by origin and ID, true once they have been read
+	received map[string]bool
+	mutex    *sync.Mutex
+}
+
+func NewPrivateMessagesTracker() *PrivateMessagesTracker {
+	return &PrivateMessagesTracker{
+		// Random start so IDs are not reused after a restart
+		nextId:       rand.Uint32(),
+		statuses:     make(map[uint32]string),
+		destinations: make(map[uint32]string),
+		acks:         make(map[uint32]chan *PrivateAck),
+		received:     make(map[string]bool),
+		mutex:        &sync.Mutex{},
+	}
+}
+
+// Get a new ID for a private message we send to destination, 0 is kept for messages without
+// acknowledgments
+func (pmt *PrivateMessagesTracker) NextId(destination string) uint32 {
+	pmt.mutex.Lock()
+	pmt.nextId++
+	if pmt.nextId == 0 {
+		pmt.nextId++
+	}
+	id := pmt.nextId
+	pmt.statuses[id] = PRIVATE_PENDING
+	pmt.destinations[id] = destination
+	pmt.mutex.Unlock()
+	return id
+}
+
+func (pmt *PrivateMessagesTracker) GetStatus(id uint32) string {
+	pmt.mutex.Lock()
+	status := pmt.statuses[id]
+	pmt.mutex.Unlock()
+	return status
+}
+
+func (pmt *PrivateMessagesTracker) setStatus(id uint32, status string) {
+	pmt.mutex.Lock()
+	// A read message stays read even if a late delivery acknowledgment arrives
+	if pmt.statuses[id] != PRIVATE_READ {
+		pmt.statuses[id] = status
+	}
+	pmt.mutex.Unlock()
+}
+
+// Register a received message, returns false if we already received it
+func (pmt *PrivateMessagesTracker) AddReceived(origin string, id uint32) bool {
+	key := origin + "," + strconv.Itoa(int(id))
+	pmt.mutex.Lock()
+	defer pmt.mutex.Unlock()
+	if _, exists := pmt.received[key]; exists {
+		return false
+	}
+	pmt.received[key] = false
+	return true
+}
+
+// Mark a received message as read, returns false if it already was
+func (pmt *PrivateMessagesTracker) MarkRead(origin string, id uint32) bool {
+	key := origin + "," + strconv.Itoa(int(id))
+	pmt.mutex.Lock()
+	defer pmt.mutex.Unlock()
+	read, exists := pmt.received[key]
+	if !exists || read {
+		return false
+	}
+	pmt.received[key] = true
+	return true
+}
+
+// Pass an acknowledgment to the goroutine waiting for it. Returns false if it doesn't come from
+// the destination of the message it acknowledges
+func (pmt *PrivateMessagesTracker) Acknowledge(ack *PrivateAck) bool {
+	pmt.mutex.Lock()
+	destination, exists := pmt.destinations[ack.ID]
+	pmt.mutex.Unlock()
+	if !exists || destination != ack.Origin {
+		return false
+	}
+	if ack.Read {
+		pmt.setStatus(ack.ID, PRIVATE_READ)
+	}
+	pmt.mutex.Lock()
+	channel := pmt.acks[ack.ID]
+	if channel != nil {
+		select {
+		case channel <- ack:
+		default:
+		}
+	}
+	pmt.mutex.Unlock()
+	if channel == nil && !ack.Read {
+		// Delivered from a mailbox, nobody is waiting for it anymore
+		pmt.setStatus(ack.ID, PRIVATE_DELIVERED)
+	}
+	return true
+}
+
+// Send a private message until the destination acknowledges it, waiting twice as long after
+// every attempt. The message is kept in the mailbox until expires if the destination is
+// unknown or doesn't acknowledge it after PRIVATE_MAX_ATTEMPTS attempts. Texts are never sent
+// in clear, a message to a destination whose key we don't know waits in our mailbox for the
+// route rumor that brings it, or fails if we already have a route
+func sendPrivateMessageReliably(gsspr *Gossiper, message PrivateMessage, expires time.Time) {
+	tracker := &gsspr.privateMessages
+	routable := gsspr.routingTable.GetAddress(message.Destination) != ""
+	if message.Sealed == nil {
+		destinationKey := gsspr.keyStore.GetEncryptionKey(message.Destination)
+		if destinationKey == nil && routable {
+			tracker.setStatus(message.ID, PRIVATE_NO_KEY)
+			logNoEncryptionKey(message.Destination)
+			return
+		}
+		if destinationKey != nil {
+			err := sealPrivateMessage(gsspr.keys, destinationKey, &message)
+			if err != nil {
+				tracker.setStatus(message.ID, PRIVATE_FAILED)
+				return
+			}
+		}
+	}
+	if !routable {
+		depositPrivateMessage(gsspr, message, expires)
+		return
+	}
+	tracker.setStatus(message.ID, PRIVATE_PENDING)
+	ackChannel := make(chan *PrivateAck, 1)
+	tracker.mutex.Lock()
+	tracker.acks[message.ID] = ackChannel
+	tracker.mutex.Unlock()
+	defer func() {
+		tracker.mutex.Lock()
+		delete(tracker.acks, message.ID)
+		tracker.mutex.Unlock()
+	}()
+
+	timeout := gsspr.originRtt.Timeout(message.Destination, PRIVATE_RETRY_TIMEOUT)
+	for attempt := 0; attempt < PRIVATE_MAX_ATTEMPTS; attempt++ {
+		// Every attempt needs its own copy, routing decrements the hop limit
+		attemptMessage := message
+		RoutePrivateMessage(gsspr, GossipPacket{
+			Private: &attemptMessage,
+		})
+		sent := time.Now()
+		timer := time.NewTimer(retryTimeout(timeout, attempt))
+		select {
+		case <-ackChannel:
+			timer.Stop()
+			if attempt == 0 {
+				gsspr.originRtt.Sample(message.Destination, time.Since(sent))
+			}
+			tracker.setStatus(message.ID, PRIVATE_DELIVERED)
+			return
+		case <-timer.C:
+		case <-gsspr.quit:
+			timer.Stop()
+			return
+		}
+	}
+	depositPrivateMessage(gsspr, message, expires)
+}
+
+// Route an acknowledgment back to the origin of a private message
+func sendPrivateAck(gsspr *Gossiper, message PrivateMessage, read bool) {
+	if message.ID == 0 {
+		// Sent by a peer that doesn't wait for acknowledgments
+		return
+	}
+	ack := PrivateAck{
+		Origin:      gsspr.Name,
+		Destination: message.Origin,
+		HopLimit:    uint32(gsspr.hopLimit),
+		ID:          message.ID,
+		Read:        read,
+	}
+	signPrivateAck(gsspr.keys, &ack)
+	routePrivateAck(gsspr, ack)
+}
+
+func routePrivateAck(gsspr *Gossiper, ack PrivateAck) {
+	ack.HopLimit--
+	nextHop := gsspr.routingTable.GetAddress(ack.Destination)
+	if ack.HopLimit > 0 && nextHop != "" {
+		gsspr.queueGossip(&QueuedMessage{
+			packet: GossipPacket{
+				PrivateAck: &ack,
+			},
+			destination: nextHop,
+		})
+	}
+}
+
+func processPrivateAck(gsspr *Gossiper, ack PrivateAck) {
+	if ack.Destination == gsspr.Name {
+		if !gsspr.keyStore.VerifyPrivateAck(&ack) {
+			logInvalidPrivateAck(ack.Origin)
+			return
+		}
+		if gsspr.privateMessages.Acknowledge(&ack) {
+			gsspr.mailbox.Remove(ack.Origin, gsspr.Name, ack.ID)
+		}
+		return
+	}
+	routePrivateAck(gsspr, ack)
+}
+
+// Private message with its delivery status, as shown in the GUI
+type privateMessageView struct {
+	PrivateMessage
+	Status string
+}
+
+// Get all private messages with the status of the ones we sent
+func (gsspr *Gossiper) getPrivateMessages() []privateMessageView {
+	gsspr.mutex.Lock()
+	messages := append([]PrivateMessage{}, gsspr.allPrivateMessages...)
+	gsspr.mutex.Unlock()
+	views := make([]privateMessageView, 0, len(messages))
+	for _, message := range messages {
+		view := privateMessageView{
+			PrivateMessage: message,
+		}
+		if message.Origin == gsspr.Name {
+			view.Status = gsspr.privateMessages.GetStatus(message.ID)
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+// Mark the messages received from origin as read, a read receipt is sent for each of them
+func (gsspr *Gossiper) MarkPrivateMessagesRead(origin string) {
+	gsspr.mutex.Lock()
+	messages := append([]PrivateMessage{}, gsspr.allPrivateMessages...)
+	gsspr.mutex.Unlock()
+	for _, message := range messages {
+		if message.Origin == origin && message.Destination == gsspr.Name &&
+			gsspr.privateMessages.MarkRead(message.Origin, message.ID) {
+			sendPrivateAck(gsspr, message, true)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package gossiper
+
+import (
+	"testing"
+)
+
+func TestAcknowledgmentsOnlyFromDestination(t *testing.T) {
+	tracker := NewPrivateMessagesTracker()
+	id := tracker.NextId("bob")
+	forged := &PrivateAck{
+		Origin:      "mallory",
+		Destination: "alice",
+		ID:          id,
+		Read:        true,
+	}
+	if tracker.Acknowledge(forged) || tracker.GetStatus(id) != PRIVATE_PENDING {
+		t.Fatal("acknowledgment accepted from another node than the destination")
+	}
+	unknown := &PrivateAck{
+		Origin:      "bob",
+		Destination: "alice",
+		ID:          id + 1,
+	}
+	if tracker.Acknowledge(unknown) || tracker.GetStatus(id+1) != "" {
+		t.Fatal("acknowledgment accepted for a message we didn't send")
+	}
+	ack := &PrivateAck{
+		Origin:      "bob",
+		Destination: "alice",
+		ID:          id,
+		Read:        true,
+	}
+	if !tracker.Acknowledge(ack) || tracker.GetStatus(id) != PRIVATE_READ {
+		t.Fatalf("read receipt of the destination not applied, status %s", tracker.GetStatus(id))
+	}
+}
+
+func TestListingPrivateMessagesDoesNotMarkThemRead(t *testing.T) {
+	network := NewMemoryNetwork()
+	bob := newTestGossiper(t, network, "bob", "127.0.0.1:5001", "")
+	for id := uint32(1); id <= 2; id++ {
+		bob.privateMessages.AddReceived("alice", id)
+		bob.addToAllPrivateMessagesList(PrivateMessage{
+			Origin:      "alice",
+			ID:          id,
+			Text:        "hello",
+			Destination: "bob",
+		})
+	}
+	bob.getPrivateMessages()
+	if bob.privateMessages.received["alice,1"] || bob.privateMessages.received["alice,2"] {
+		t.Fatal("messages marked read by listing them")
+	}
+	bob.MarkPrivateMessagesRead("carol")
+	if bob.privateMessages.received["alice,1"] {
+		t.Fatal("messages of alice marked read with those of carol")
+	}
+	bob.MarkPrivateMessagesRead("alice")
+	if !bob.privateMessages.received["alice,1"] || !bob.privateMessages.received["alice,2"] {
+		t.Fatal("messages of alice not marked read")
+	}
+}
+
+func TestAcknowledgmentsSignedByDestination(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "")
+	bobKeys, malloryKeys := newTestKeyPair(t), newTestKeyPair(t)
+	rumor := &RumorMessage{
+		Origin: "bob",
+		ID:     1,
+	}
+	signRumor(bobKeys, rumor)
+	if !alice.keyStore.VerifyRumor(rumor, UNSIGNED_REJECT) {
+		t.Fatal("rumor of bob rejected")
+	}
+
+	id := alice.privateMessages.NextId("bob")
+	unsigned := PrivateAck{
+		Origin:      "bob",
+		Destination: "alice",
+		ID:          id,
+		Read:        true,
+	}
+	forged := unsigned
+	signPrivateAck(malloryKeys, &forged)
+	for _, ack := range []PrivateAck{unsigned, forged} {
+		processPrivateAck(alice, ack)
+		if alice.privateMessages.GetStatus(id) != PRIVATE_PENDING {
+			t.Fatal("acknowledgment not signed by bob applied")
+		}
+	}
+	signed := unsigned
+	signPrivateAck(bobKeys, &signed)
+	processPrivateAck(alice, signed)
+	if alice.privateMessages.GetStatus(id) != PRIVATE_READ {
+		t.Fatalf("acknowledgment of bob not applied, status %s", alice.privateMessages.GetStatus(id))
+	}
+}
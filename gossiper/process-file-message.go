@@ -3,272 +3,391 @@ package gossiper
 import (
 	"bytes"
 	"crypto/sha256"
+	"errors"
 	"github.com/eliasmpw/Peerster/common"
 	"io/ioutil"
-	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
+// Time to wait for a metafile or chunk, until the round-trip time of the node it is requested
+// from is measured
+const DATA_REQUEST_TIMEOUT = 5000 * time.Millisecond
+
 func StartFileDownload(gsspr *Gossiper, request DataRequest) {
+	downloadFile(gsspr, request, nil)
+}
+
+// Download a file and return once it ended. The files of a folder are downloaded with the
+// download of the folder as parent: they are paused, resumed and cancelled with it, and only
+// the download of the folder is kept to be resumed after a restart
+func downloadFile(gsspr *Gossiper, request DataRequest, parent *FileDownload) error {
+	// The name comes from the user or a search reply, it must stay in the downloads directory
+	fileName := cleanDownloadName(request.FileName)
+	if fileName == "" {
+		err := errors.New("invalid file name")
+		logDownloadFailed(request.FileName, err.Error())
+		if parent == nil {
+			gsspr.forgetDownload(request.HashValue)
+		}
+		return err
+	}
+	request.FileName = fileName
+	// Downloads paused before a restart stay paused
+	paused := parent == nil && gsspr.isDownloadJournaledPaused(request.HashValue)
+	download := newFileDownload(request, paused)
+	download.journaled = parent == nil
+	if !gsspr.fileDownloadsList.Add(download) {
+		// Already being downloaded
+		return errors.New("already being downloaded")
+	}
+	defer close(download.done)
+	if parent != nil {
+		gsspr.fileDownloadsList.SetChild(parent, download)
+		defer gsspr.fileDownloadsList.SetChild(parent, nil)
+	} else {
+		// Keep the request until the download ends, to resume it after a restart
+		gsspr.journalDownload(request, paused)
+	}
+
+	err := runFileDownload(gsspr, request, download)
+	switch err {
+	case nil:
+		gsspr.fileDownloadsList.Finish(download, DOWNLOAD_COMPLETED, nil)
+	case ErrGossiperStopped:
+		// Resumed at the next start
+		return err
+	case ErrDownloadCancelled:
+		logDownloadCancelled(request.FileName)
+		gsspr.fileDownloadsList.Finish(download, DOWNLOAD_CANCELLED, nil)
+	default:
+		// The chunks we received are kept for the next download of the file
+		logDownloadFailed(request.FileName, err.Error())
+		gsspr.fileDownloadsList.Finish(download, DOWNLOAD_FAILED, err)
+	}
+	if parent == nil {
+		gsspr.forgetDownload(request.HashValue)
+	}
+	return err
+}
+
+// Error to return when a download is interrupted, once it is known it isn't paused anymore
+func (gsspr *Gossiper) downloadInterruption(download *FileDownload) error {
+	if gsspr.isStopped() {
+		return ErrGossiperStopped
+	}
+	return ErrDownloadCancelled
+}
+
+func runFileDownload(gsspr *Gossiper, request DataRequest, download *FileDownload) error {
 	// Check if we already have the MetaData
 	metaData := gsspr.metaDataList.GetByHash(request.HashValue)
 
 	if metaData == nil {
 		// Check if there is a entry for the search results and use their origins if present
 		metaData = gsspr.searchList.GetByHash(request.HashValue)
+		if metaData != nil {
+			// Add it to our files, its chunk map now lists the chunks we received
+			metaData.ChunkMap = make([]uint64, 0)
+			gsspr.metaDataList.Add(*metaData)
+		}
+	}
 
-		// If not send a request for everything
-		if metaData == nil {
-			// First request the MetaFile
-			metaFileReq := DataRequest{
-				Origin:      gsspr.Name,
-				Destination: request.Destination,
-				HopLimit:    request.HopLimit,
-				FileName:    request.FileName,
-				HashValue:   request.HashValue,
-			}
-			// Decrement HopLimit
-			metaFileReq.HopLimit -= 1
-			if metaFileReq.HopLimit <= 0 {
-				return
-			}
-
-			// Get Next Hop and send
-			nextHop := gsspr.routingTable.GetAddress(metaFileReq.Destination)
-			if nextHop == "" {
-				return
-			}
-			if nextHop != "" {
-				gsspr.sendGossipQueue <- &QueuedMessage{
-					packet: GossipPacket{
-						DataRequest: &metaFileReq,
-					},
-					destination: nextHop,
-				}
-			}
-
-			// Log that we are downloading the MetaFile
-			logDownloadingMetaFile(metaFileReq.FileName, metaFileReq.Destination)
-
-			// and wait for data reply
-			metaFileReplyChannel := make(chan *DataReply)
-
-			metaFileReplyString := string(metaFileReq.HashValue)
+	// If not send a request for everything
+	if metaData == nil {
+		if !gsspr.waitWhilePaused(download) {
+			return gsspr.downloadInterruption(download)
+		}
+		var err error
+		metaData, err = fetchMetaFile(gsspr, request, download)
+		if err != nil {
+			return err
+		}
+	}
 
-			gsspr.filesMutex.Lock()
-			_, exists := gsspr.filesListening[metaFileReplyString]
-			gsspr.filesMutex.Unlock()
+	chunkNumber := GetChunkNumber(metaData.MetaFile, gsspr.hashSize)
+	gsspr.fileDownloadsList.SetMetaData(download, *metaData, chunkNumber)
 
-			if exists {
-				// It has already been requested by other thread
-				return
+	// Chunks written by an earlier run of this download, or shared with another file, are not
+	// requested again. Segments under nodes of a tree metafile we don't have yet are checked
+	// once the nodes are fetched
+	haveChunks := make(map[uint64]bool)
+	for _, chunkIndex := range metaData.ChunkMap {
+		haveChunks[chunkIndex] = true
+	}
+	localChunks := make(map[uint64]bool)
+	checkLocalChunks := func(first uint64, chunkHashes [][]byte) {
+		for i, chunkHash := range chunkHashes {
+			index := first + uint64(i)
+			if localChunks[index] {
+				continue
 			}
-
-			// Register new channel
-			gsspr.filesMutex.Lock()
-			gsspr.filesListening[metaFileReplyString] = metaFileReplyChannel
-			gsspr.filesMutex.Unlock()
-
-			received := false
-
-			// While not received
-			for !received {
-				// Set timer
-				timer := time.NewTimer(time.Millisecond * 5000)
-
-				select {
-				case <-timer.C:
-					// If timer runs out
-					timer.Stop()
-					// Resend
-					gsspr.sendGossipQueue <- &QueuedMessage{
-						packet: GossipPacket{
-							DataRequest: &metaFileReq,
-						},
-						destination: nextHop,
-					}
-				case replyMetaFile := <-metaFileReplyChannel:
-					// Received a reply
-					timer.Stop()
-
-					// Check integrity of reply content
-					hash := sha256.New()
-					hash.Write(replyMetaFile.Data)
-					replyHash := hash.Sum(nil)
-
-					if bytes.Equal(replyHash, request.HashValue) {
-						// We have received the chunk correctly
-						received = true
-
-						metaData = &FileMetaData{
-							Origins:   []string{replyMetaFile.Origin},
-							Name:      request.FileName,
-							Size:      GetChunkNumber(replyMetaFile.Data),
-							MetaFile:  nil,
-							HashValue: replyHash,
-							ChunkMap:  make([]uint64, 0),
-						}
-
-						// Add to metaDataList
-						metaData.MetaFile = make([]byte, len(replyMetaFile.Data))
-						copy(metaData.MetaFile, replyMetaFile.Data)
-						gsspr.metaDataList.Add(*metaData)
-
-					} else {
-						// Invalid MetaFile, keep the loop
-						continue
-					}
-				}
+			chunkData := gsspr.readChunkFile(chunkHash)
+			if chunkData == nil {
+				continue
 			}
-
-			// Close channel
-			close(metaFileReplyChannel)
-			gsspr.filesMutex.Lock()
-			gsspr.filesListening[metaFileReplyString] = nil
-			gsspr.filesMutex.Unlock()
+			localChunks[index] = true
+			gsspr.chunkStore.Register(chunkHash, len(chunkData), metaData.HashValue, index+1)
+			if !haveChunks[index+1] {
+				gsspr.metaDataList.AddChunkNumberToMap(metaData.HashValue, index+1)
+				gsspr.fileDownloadsList.AddChunkNumberToMetaData(metaData.HashValue, index+1)
+			}
+			gsspr.fileDownloadsList.AddChunk(download, index, len(chunkData), false)
 		}
 	}
-
-	chunkNumber := GetChunkNumber(metaData.MetaFile)
-
-	fileDownload := FileDownload{
-		metaData:  *metaData,
-		Chunks:    make([][]byte, 0),
-		NextChunk: 0,
+	segmentCount := metaData.SegmentCount(gsspr.hashSize)
+	for segment := uint64(0); segment < segmentCount; segment++ {
+		chunkHashes, err := metaData.SegmentHashes(segment, gsspr.hashSize, gsspr.readMetaFileNode)
+		if err == nil {
+			checkLocalChunks(segment*METAFILE_FANOUT, chunkHashes)
+		}
 	}
-
-	// Add new download to list of downloads
-	newDownload := gsspr.fileDownloadsList.Add(&fileDownload)
-	if !newDownload {
-		return
+	if len(localChunks) > 0 && uint64(len(localChunks)) < chunkNumber {
+		logResumingDownload(request.FileName, len(localChunks), int(chunkNumber))
 	}
 
-	for index := uint64(0); index < chunkNumber; index++ {
-
-		// Download chunk in position index
-		chunkHash := metaData.GetChunkHash(index)
+	// The progress of a paused download is known before it waits
+	if !gsspr.waitWhilePaused(download) {
+		return gsspr.downloadInterruption(download)
+	}
 
-		// build the request
-		chunkReq := DataRequest{
-			Origin:      gsspr.Name,
-			Destination: metaData.Origins[index%uint64(len(metaData.Origins))],
-			HopLimit:    request.HopLimit,
-			FileName:    request.FileName,
-			HashValue:   chunkHash,
+	// Download segment by segment, so only the chunk hashes of one segment are kept. Nodes of a
+	// tree metafile are asked first to the origin that sent the last one
+	nodeOrigins := make([]string, 0)
+	seenOrigins := make(map[string]bool)
+	for _, origin := range metaData.Origins {
+		if origin != "" && origin != gsspr.Name && !seenOrigins[origin] {
+			seenOrigins[origin] = true
+			nodeOrigins = append(nodeOrigins, origin)
 		}
-
-		// Decrement Hoplimit
-		chunkReq.HopLimit -= 1
-		if chunkReq.HopLimit <= 0 {
-			return
+	}
+	scheduler := newDownloadScheduler(gsspr, request, download)
+	getNode := func(hash []byte) ([]byte, error) {
+		node, origin, err := fetchMetaFileNode(gsspr, request, download, hash, nodeOrigins)
+		for i := range nodeOrigins {
+			if origin != "" && nodeOrigins[i] == origin {
+				copy(nodeOrigins[1:i+1], nodeOrigins[:i])
+				nodeOrigins[0] = origin
+				break
+			}
 		}
-
-		// Get nextHop
-		nextHop := gsspr.routingTable.GetAddress(chunkReq.Destination)
-		if nextHop == "" {
-			return
+		return node, err
+	}
+	for segment := uint64(0); segment < segmentCount; segment++ {
+		first := segment * METAFILE_FANOUT
+		chunkHashes, err := metaData.SegmentHashes(segment, gsspr.hashSize, getNode)
+		if err != nil {
+			return err
 		}
-
-		// Send Packet
-		gsspr.sendGossipQueue <- &QueuedMessage{
-			packet: GossipPacket{
-				DataRequest: &chunkReq,
-			},
-			destination: nextHop,
+		checkLocalChunks(first, chunkHashes)
+		missing := make(map[uint64][]byte)
+		for i, chunkHash := range chunkHashes {
+			if !localChunks[first+uint64(i)] {
+				missing[first+uint64(i)] = chunkHash
+			}
+		}
+		if len(missing) == 0 {
+			continue
 		}
 
-		// print same notification
-		logDownloadingChunk(chunkReq.FileName, index+1, chunkReq.Destination)
-
-		// Create channels for chunk reply
-		chunkReplyChannel := make(chan *DataReply)
-		chunkReplyString := string(chunkReq.HashValue)
+		// Fetch what we can over stream connections, the missing chunks are requested hop by hop
+		streamedChunks := fetchFileByStreams(gsspr, *metaData, missing,
+			func(index uint64, chunkData []byte) {
+				logDownloadingChunk(request.FileName, index+1, metaData.Origins[index%uint64(len(metaData.Origins))])
+				gsspr.saveChunk(download, index, chunkData)
+			})
+		for index := range streamedChunks {
+			delete(missing, index)
+		}
 
-		gsspr.filesMutex.Lock()
-		_, present := gsspr.filesListening[chunkReplyString]
-		gsspr.filesMutex.Unlock()
+		// Request the other chunks hop by hop, from every peer known to have them
+		err = scheduler.run(missing)
+		if err != nil {
+			return err
+		}
+	}
 
-		if present {
-			// Another goroutine is already waiting for this data
-			return
+	// The files of a folder are downloaded once we have its manifest
+	if strings.HasSuffix(request.FileName, "/") {
+		manifest, err := gsspr.readManifest(*metaData)
+		if err != nil {
+			return err
+		}
+		err = downloadManifestFiles(gsspr, request, download, *metaData, manifest)
+		if err != nil {
+			return err
 		}
+		logFileReconstructed(request.FileName)
+		return nil
+	}
 
-		// Register
-		gsspr.filesMutex.Lock()
-		gsspr.filesListening[chunkReplyString] = chunkReplyChannel
-		gsspr.filesMutex.Unlock()
+	// We have all the chunks, reconstruct the file in the downloads folder
+	path, err := filepath.Abs("")
+	common.CheckError(err)
+	downloadedPath := filepath.Join(path, gsspr.downloadedFilesDir)
+	err = gsspr.reconstructFromChunkFiles(*metaData, downloadedPath, filepath.FromSlash(request.FileName))
+	if err != nil {
+		return err
+	}
 
-		received := false // not yet received
+	// Log file downloaded succesfully
+	logFileReconstructed(request.FileName)
+	return nil
+}
 
-		for !received {
+// Request the metafile of a download from its destination and add it to our files
+func fetchMetaFile(gsspr *Gossiper, request DataRequest, download *FileDownload) (*FileMetaData, error) {
+	// Log that we are downloading the MetaFile
+	logDownloadingMetaFile(request.FileName, request.Destination)
 
-			timer := time.NewTimer(time.Millisecond * 5000)
+	metaFile, err := requestData(gsspr, download, request.Destination, request.HopLimit, request.FileName,
+		request.HashValue, "metafile")
+	if err != nil {
+		return nil, err
+	}
+	if !validMetaFile(metaFile, gsspr.hashSize) {
+		return nil, errors.New("invalid metafile from " + request.Destination)
+	}
+	metaData := &FileMetaData{
+		Origins:   []string{request.Destination},
+		Name:      request.FileName,
+		Size:      GetChunkNumber(metaFile, gsspr.hashSize),
+		MetaFile:  metaFile,
+		HashValue: request.HashValue,
+		ChunkMap:  make([]uint64, 0),
+	}
 
-			select {
-			case <-timer.C:
-				// If timer runs out
-				timer.Stop()
-				// Resend packet
-				gsspr.sendGossipQueue <- &QueuedMessage{
-					packet: GossipPacket{
-						DataRequest: &chunkReq,
-					},
-					destination: nextHop,
-				}
-			case chunkReply := <-chunkReplyChannel:
-				// When we receive the chunk data
-				timer.Stop()
-
-				// Check integrity
-				hash := sha256.New()
-				hash.Write(chunkReply.Data)
-				receivedHash := hash.Sum(nil)
-
-				if bytes.Equal(receivedHash, chunkHash) {
-					// We received the correct chunk
-					received = true
-
-					chunkData := make([]byte, len(chunkReply.Data))
-					copy(chunkData, chunkReply.Data)
-
-					gsspr.metaDataList.AddChunkNumberToMap(metaData.HashValue, index+1)
-					gsspr.fileDownloadsList.AddChunkNumberToMetaData(metaData.HashValue, index+1)
-					fileDownload.NextChunk++
-					fileDownload.Chunks = append(fileDownload.Chunks, chunkData)
-
-				} else {
-					// Invalid chunk, keep looping
-					continue
-				}
-			}
+	// Add to metaDataList
+	gsspr.metaDataList.Add(*metaData)
+	return metaData, nil
+}
 
+// Get a node of the tree metafile of a download, from the chunk directory or else from the
+// given origins in turn. Nodes we fetch are kept in the chunk directory and served to others.
+// Returns the origin that sent the node, if it was fetched
+func fetchMetaFileNode(gsspr *Gossiper, request DataRequest, download *FileDownload,
+	hash []byte, origins []string) ([]byte, string, error) {
+	node := gsspr.readChunkFile(hash)
+	if node != nil {
+		return node, "", nil
+	}
+	err := errors.New("no origin for the metafile node")
+	for _, origin := range origins {
+		logDownloadingMetaFileNode(request.FileName, origin)
+		node, err = requestData(gsspr, download, origin, request.HopLimit, request.FileName, hash,
+			"metafile node")
+		if err == nil {
+			WriteChunksOnDisk([][]byte{node}, gsspr.chunkFilesDir, "")
+			return node, origin, nil
 		}
+		if err == ErrGossiperStopped || err == ErrDownloadCancelled {
+			break
+		}
+	}
+	return nil, "", err
+}
 
-		//Close channel
-		close(chunkReplyChannel)
-		gsspr.filesMutex.Lock()
-		gsspr.filesListening[chunkReplyString] = nil
-		gsspr.filesMutex.Unlock()
+// Request the data with the given hash from destination until it is received, resending the
+// request when it times out. Replies that don't match the hash are ignored
+func requestData(gsspr *Gossiper, download *FileDownload, destination string, hopLimit uint32,
+	fileName string, hash []byte, what string) ([]byte, error) {
+	dataReq := DataRequest{
+		Origin:      gsspr.Name,
+		Destination: destination,
+		HopLimit:    hopLimit,
+		FileName:    fileName,
+		HashValue:   hash,
 	}
+	// Decrement HopLimit
+	if dataReq.HopLimit <= 1 {
+		return nil, errors.New("hop limit too low")
+	}
+	dataReq.HopLimit -= 1
 
-	// We have all the chunks, reconstruct file
-	reconstructedFile := ReconstructFromChunks(&(fileDownload.Chunks))
+	// Get Next Hop and send
+	nextHop := gsspr.routingTable.GetAddress(dataReq.Destination)
+	if nextHop == "" {
+		return nil, errors.New("no route to " + dataReq.Destination)
+	}
 
-	// Store the file in the downloads folder
-	path, err := filepath.Abs("")
-	common.CheckError(err)
-	downloadedPath := path + string(os.PathSeparator) + gsspr.downloadedFilesDir
-	WriteFileOnDisk(*reconstructedFile, downloadedPath, request.FileName)
+	// and wait for data reply
+	replyChannel := make(chan *DataReply, 1)
 
-	// Log file downloaded succesfully
-	logFileReconstructed(request.FileName)
+	gsspr.listenForData(hash, replyChannel)
+	defer gsspr.stopListeningForData(hash, replyChannel)
 
-	// store chunks in disk
-	WriteChunksOnDisk(fileDownload.Chunks, gsspr.chunkFilesDir, request.FileName)
+	send := func() {
+		gsspr.queueGossip(&QueuedMessage{
+			packet: GossipPacket{
+				DataRequest: &dataReq,
+			},
+			destination: nextHop,
+		})
+	}
+	send()
+	attempt := 0
+	sent := time.Now()
+
+	// While not received
+	for {
+		// Set timer, doubled at each attempt
+		timer := time.NewTimer(retryTimeout(
+			gsspr.originRtt.Timeout(dataReq.Destination, DATA_REQUEST_TIMEOUT), attempt))
+
+		select {
+		case <-gsspr.quit:
+			timer.Stop()
+			return nil, ErrGossiperStopped
+		case <-download.wake:
+			// Paused or cancelled, resend once resumed
+			timer.Stop()
+			if !gsspr.waitWhilePaused(download) {
+				return nil, gsspr.downloadInterruption(download)
+			}
+			attempt = 0
+			sent = time.Now()
+			send()
+		case <-timer.C:
+			// If timer runs out
+			timer.Stop()
+			attempt++
+			if attempt == MAX_REQUEST_ATTEMPTS {
+				return nil, errors.New("no " + what + " from " + dataReq.Destination)
+			}
+			// Resend
+			send()
+		case reply := <-replyChannel:
+			// Received a reply
+			timer.Stop()
+
+			// Check integrity of reply content
+			replyHash := sha256.Sum256(reply.Data)
+			if !bytes.Equal(replyHash[:], hash) {
+				// Invalid reply, keep the loop
+				continue
+			}
+			// We have received the data correctly
+			if attempt == 0 {
+				gsspr.originRtt.Sample(dataReq.Destination, time.Since(sent))
+			}
+			data := make([]byte, len(reply.Data))
+			copy(data, reply.Data)
+			return data, nil
+		}
+	}
+}
 
-	// we are done with the download
-	gsspr.fileDownloadsList.Remove(&fileDownload)
+// Write a chunk we received to the chunk directory before adding it to the chunk map, so the
+// chunk map never lists a chunk we would lose by stopping
+func (gsspr *Gossiper) saveChunk(download *FileDownload, index uint64, chunkData []byte) {
+	fileHash := download.metaData.HashValue
+	gsspr.chunkStore.Write(gsspr.chunkFilesDir, chunkData, fileHash, index+1)
+	gsspr.metaDataList.AddChunkNumberToMap(fileHash, index+1)
+	gsspr.fileDownloadsList.AddChunkNumberToMetaData(fileHash, index+1)
+	gsspr.fileDownloadsList.AddChunk(download, index, len(chunkData), true)
+	// Chunks of other files make room for it if the chunk directory is full
+	gsspr.evictChunks()
 }
 
 func ProcessDataRequest(gsspr *Gossiper, request DataRequest, addressReq string) {
@@ -283,65 +402,21 @@ func ProcessDataRequest(gsspr *Gossiper, request DataRequest, addressReq string)
 
 		hash := request.HashValue
 
-		// Search in metaDataList for a entry with the hash
-		metaData := gsspr.metaDataList.GetByHash(hash)
-
-		if metaData != nil {
-			// If no match, this is a metafile request
-			gsspr.sendGossipQueue <- &QueuedMessage{
+		data := findRequestedData(gsspr, hash)
+		if data != nil {
+			gsspr.queueGossip(&QueuedMessage{
 				packet: GossipPacket{
 					DataReply: &DataReply{
-						Origin:      gsspr.Name,
-						Destination: request.Origin,
-						HopLimit:    uint32(gsspr.hopLimit),
-						HashValue:   hash,
-						Data:        metaData.MetaFile,
+						Origin:        gsspr.Name,
+						Destination:   request.Origin,
+						HopLimit:      uint32(gsspr.hopLimit),
+						HashValue:     hash,
+						Data:          data,
+						StreamAddress: gsspr.streamAddress,
 					},
 				},
 				destination: nextHop,
-			}
-			return
-		}
-
-		// Check if we already have the chunk downloaded
-		chunkFileName := GetChunkFilename(request.HashValue)
-		chunkFilePath := gsspr.chunkFilesDir + chunkFileName
-		chunk, err := ioutil.ReadFile(chunkFilePath)
-
-		if err == nil && chunk != nil {
-			// If we have the chunk already, send it
-			gsspr.sendGossipQueue <- &QueuedMessage{
-				packet: GossipPacket{
-					DataReply: &DataReply{
-						Origin:      gsspr.Name,
-						Destination: request.Origin,
-						HopLimit:    uint32(gsspr.hopLimit),
-						HashValue:   request.HashValue,
-						Data:        chunk,
-					},
-				},
-				destination: nextHop,
-			}
-			return
-		}
-
-		// Check in files being downloaded
-		chunkProgress := gsspr.fileDownloadsList.GetChunkByHash(hash)
-		if chunkProgress != nil {
-			// If we have it, send it
-			gsspr.sendGossipQueue <- &QueuedMessage{
-				packet: GossipPacket{
-					DataReply: &DataReply{
-						Origin:      gsspr.Name,
-						Destination: request.Origin,
-						HopLimit:    uint32(gsspr.hopLimit),
-						HashValue:   hash,
-						Data:        *chunkProgress,
-					},
-				},
-				destination: nextHop,
-			}
-			return
+			})
 		}
 		return
 	}
@@ -356,24 +431,87 @@ func ProcessDataRequest(gsspr *Gossiper, request DataRequest, addressReq string)
 	// Get nextHop from routingTable
 	nextHop := gsspr.routingTable.GetAddress(request.Destination)
 	if nextHop != "" {
-		gsspr.sendGossipQueue <- &QueuedMessage{
+		gsspr.queueGossip(&QueuedMessage{
 			packet: GossipPacket{
 				DataRequest: &request,
 			},
 			destination: nextHop,
+		})
+	}
+}
+
+// Get the metafile or chunk with the given hash, nil if we don't have it
+func findRequestedData(gsspr *Gossiper, hash []byte) []byte {
+	// Search in metaDataList for a entry with the hash
+	metaData := gsspr.metaDataList.GetByHash(hash)
+	if metaData != nil {
+		// If there is a match, this is a metafile request
+		return metaData.MetaFile
+	}
+
+	// Check if we already have the chunk downloaded
+	chunkFileName := GetChunkFilename(hash, gsspr.hashSize)
+	chunkFilePath := gsspr.chunkFilesDir + chunkFileName
+	// Chunks of files being downloaded are there too, they are saved as they arrive
+	chunk, err := ioutil.ReadFile(chunkFilePath)
+	if err == nil && chunk != nil {
+		// A corrupt chunk is never sent, the peer would request it again and again
+		chunkHash := sha256.Sum256(chunk)
+		if !bytes.Equal(chunkHash[:], hash) {
+			gsspr.quarantineChunk(hash)
+			return nil
+		}
+		gsspr.chunkStore.Touch(hash)
+		return chunk
+	}
+	return nil
+}
+
+// Receive the replies with the data of the given hash on channel, until stopListeningForData.
+// Several downloads and searches can wait for the same data, each one gets the replies
+func (gsspr *Gossiper) listenForData(hash []byte, channel chan *DataReply) {
+	gsspr.filesMutex.Lock()
+	defer gsspr.filesMutex.Unlock()
+	for _, listening := range gsspr.filesListening[string(hash)] {
+		if listening == channel {
+			return
+		}
+	}
+	gsspr.filesListening[string(hash)] = append(gsspr.filesListening[string(hash)], channel)
+}
+
+func (gsspr *Gossiper) stopListeningForData(hash []byte, channel chan *DataReply) {
+	gsspr.filesMutex.Lock()
+	defer gsspr.filesMutex.Unlock()
+	channels := gsspr.filesListening[string(hash)]
+	for i, listening := range channels {
+		if listening == channel {
+			channels = append(channels[:i:i], channels[i+1:]...)
+			break
 		}
 	}
+	if len(channels) == 0 {
+		delete(gsspr.filesListening, string(hash))
+	} else {
+		gsspr.filesListening[string(hash)] = channels
+	}
 }
 
 func processDataReply(gsspr *Gossiper, reply DataReply, addressReq string) {
 	if reply.Destination == gsspr.Name {
 		// If we are the destination
-		dataReplyString := string(reply.HashValue)
-
-		// Send to channel
+		if reply.StreamAddress != "" {
+			// Remember where the origin accepts stream connections
+			gsspr.streamPeers.Set(reply.Origin, reply.StreamAddress)
+		}
+		// Send to every channel waiting for it, replies a channel has no room for are dropped
+		// and requested again
 		gsspr.filesMutex.Lock()
-		if gsspr.filesListening[dataReplyString] != nil {
-			gsspr.filesListening[dataReplyString] <- &reply
+		for _, channel := range gsspr.filesListening[string(reply.HashValue)] {
+			select {
+			case channel <- &reply:
+			default:
+			}
 		}
 		gsspr.filesMutex.Unlock()
 		return
@@ -389,12 +527,12 @@ func processDataReply(gsspr *Gossiper, reply DataReply, addressReq string) {
 	// Get nextHop from routingTable
 	nextHop := gsspr.routingTable.GetAddress(reply.Destination)
 	if nextHop != "" {
-		gsspr.sendGossipQueue <- &QueuedMessage{
+		gsspr.queueGossip(&QueuedMessage{
 			packet: GossipPacket{
 				DataReply: &reply,
 			},
 			destination: nextHop,
-		}
+		})
 	}
 	return
 }
@@ -0,0 +1,105 @@
+package gossiper
+
+import (
+	"sync"
+	"time"
+)
+
+// Bounds of the retransmission timeouts
+const RTO_MIN = 200 * time.Millisecond
+const RTO_MAX = 60 * time.Second
+
+// Attempts of a request before it is reported as failed
+const MAX_REQUEST_ATTEMPTS = 5
+
+// Smoothed round-trip time and its variation, as kept by TCP (RFC 6298)
+type rttEstimate struct {
+	srtt   time.Duration
+	rttvar time.Duration
+}
+
+// Retransmission timeout
+func (estimate *rttEstimate) timeout() time.Duration {
+	return boundTimeout(estimate.srtt + 4*estimate.rttvar)
+}
+
+// Round-trip time estimates by peer address, for exchanges with a neighbour, or by node name,
+// for requests routed hop by hop
+type RttEstimator struct {
+	estimates map[string]*rttEstimate
+	mutex     *sync.Mutex
+}
+
+func NewRttEstimator() *RttEstimator {
+	return &RttEstimator{
+		estimates: make(map[string]*rttEstimate),
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// Add a round-trip time measured with key. Only answers to a request sent once are
+// measured, the answer to a retransmitted request can't be matched to one of its sendings
+func (re *RttEstimator) Sample(key string, rtt time.Duration) {
+	re.mutex.Lock()
+	defer re.mutex.Unlock()
+	estimate, exists := re.estimates[key]
+	if !exists {
+		re.estimates[key] = &rttEstimate{
+			srtt:   rtt,
+			rttvar: rtt / 2,
+		}
+		return
+	}
+	deviation := estimate.srtt - rtt
+	if deviation < 0 {
+		deviation = -deviation
+	}
+	estimate.rttvar = (3*estimate.rttvar + deviation) / 4
+	estimate.srtt = (7*estimate.srtt + rtt) / 8
+}
+
+// Time to wait for an answer from key, initial if it was never measured
+func (re *RttEstimator) Timeout(key string, initial time.Duration) time.Duration {
+	re.mutex.Lock()
+	defer re.mutex.Unlock()
+	estimate, exists := re.estimates[key]
+	if !exists {
+		return initial
+	}
+	return estimate.timeout()
+}
+
+// Longest timeout of the measured keys, initial if none was measured
+func (re *RttEstimator) MaxTimeout(initial time.Duration) time.Duration {
+	re.mutex.Lock()
+	defer re.mutex.Unlock()
+	if len(re.estimates) == 0 {
+		return initial
+	}
+	longest := time.Duration(0)
+	for _, estimate := range re.estimates {
+		timeout := estimate.timeout()
+		if timeout > longest {
+			longest = timeout
+		}
+	}
+	return longest
+}
+
+// Timeout of the given attempt of a request, starting at 0, doubled at each new attempt
+func retryTimeout(timeout time.Duration, attempt int) time.Duration {
+	for i := 0; i < attempt && timeout < RTO_MAX; i++ {
+		timeout *= 2
+	}
+	return boundTimeout(timeout)
+}
+
+func boundTimeout(timeout time.Duration) time.Duration {
+	if timeout < RTO_MIN {
+		return RTO_MIN
+	}
+	if timeout > RTO_MAX {
+		return RTO_MAX
+	}
+	return timeout
+}
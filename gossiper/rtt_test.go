@@ -0,0 +1,88 @@
+package gossiper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRttEstimatorFollowsSamples(t *testing.T) {
+	estimator := NewRttEstimator()
+	if estimator.Timeout("bob", time.Second) != time.Second || estimator.MaxTimeout(time.Second) != time.Second {
+		t.Fatal("timeout of an unmeasured peer isn't the initial one")
+	}
+
+	// The first sample gives the round-trip time and half of it as variation
+	estimator.Sample("bob", 100*time.Millisecond)
+	if timeout := estimator.Timeout("bob", time.Second); timeout != 300*time.Millisecond {
+		t.Fatalf("timeout %v after the first sample", timeout)
+	}
+	// Then they are smoothed with gains 1/8 and 1/4
+	estimator.Sample("bob", 200*time.Millisecond)
+	if timeout := estimator.Timeout("bob", time.Second); timeout != 362500*time.Microsecond {
+		t.Fatalf("timeout %v after the second sample", timeout)
+	}
+
+	estimator.Sample("carol", time.Millisecond)
+	if timeout := estimator.Timeout("carol", time.Second); timeout != RTO_MIN {
+		t.Fatalf("timeout %v below RTO_MIN", timeout)
+	}
+	estimator.Sample("dave", 2*RTO_MAX)
+	if timeout := estimator.Timeout("dave", time.Second); timeout != RTO_MAX {
+		t.Fatalf("timeout %v above RTO_MAX", timeout)
+	}
+	if timeout := estimator.MaxTimeout(time.Second); timeout != RTO_MAX {
+		t.Fatalf("longest timeout %v instead of the one of dave", timeout)
+	}
+}
+
+func TestRetryTimeoutBacksOff(t *testing.T) {
+	for attempt, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		if timeout := retryTimeout(time.Second, attempt); timeout != expected {
+			t.Errorf("attempt %d waits %v instead of %v", attempt, timeout, expected)
+		}
+	}
+	// Doubling stops at RTO_MAX instead of overflowing
+	if timeout := retryTimeout(time.Second, 100); timeout != RTO_MAX {
+		t.Errorf("attempt 100 waits %v", timeout)
+	}
+	if timeout := retryTimeout(time.Millisecond, 0); timeout != RTO_MIN {
+		t.Errorf("first attempt waits %v", timeout)
+	}
+}
+
+func TestDataRequestFailsAfterMaxAttempts(t *testing.T) {
+	// Waits for every timeout, the gossiper has its own name to run along the other tests
+	t.Parallel()
+	network := NewMemoryNetwork()
+	requester := newTestGossiper(t, network, "requester", "127.0.0.1:5000", "")
+	// Bob receives the requests but never answers
+	bob, _ := network.NewTransport("127.0.0.1:5001")
+	defer bob.Close()
+	requester.routingTable.RegisterNextHop("bob", "127.0.0.1:5001")
+	requester.originRtt.Sample("bob", time.Millisecond)
+
+	request := DataRequest{
+		Origin:      "requester",
+		Destination: "bob",
+		HopLimit:    10,
+		HashValue:   make([]byte, 32),
+		FileName:    "file",
+	}
+	started := time.Now()
+	_, err := requestData(requester, newFileDownload(request, false), "bob", request.HopLimit, "file",
+		request.HashValue, "chunk")
+	if err == nil {
+		t.Fatal("request without answer succeeded")
+	}
+	// RTO_MIN doubled at each of the attempts
+	expected := time.Duration(0)
+	for attempt := 0; attempt < MAX_REQUEST_ATTEMPTS; attempt++ {
+		expected += retryTimeout(RTO_MIN, attempt)
+	}
+	if elapsed := time.Since(started); elapsed < expected || elapsed > 2*expected {
+		t.Fatalf("gave up after %v instead of %v", elapsed, expected)
+	}
+	if len(bob.inbox) != MAX_REQUEST_ATTEMPTS {
+		t.Fatalf("%d requests sent instead of %d", len(bob.inbox), MAX_REQUEST_ATTEMPTS)
+	}
+}
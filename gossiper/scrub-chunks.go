@@ -0,0 +1,229 @@
+package gossiper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subdirectory of the chunk directory where chunk files that don't match their hash are moved
+const QUARANTINE_DIR = "Quarantine/"
+
+// Chunk files are deleted from quarantine after this time, or the oldest ones once there are
+// more than QUARANTINE_MAX_FILES
+const QUARANTINE_RETENTION = 7 * 24 * time.Hour
+const QUARANTINE_MAX_FILES = 1024
+
+// Result of a scrub of the chunk directory
+type ScrubReport struct {
+	// Number of chunk files checked
+	Chunks int
+	// Hashes of the chunk files moved to quarantine
+	Corrupt []string
+	// Files that lost chunks, then those written again from the shared files directory and
+	// those downloaded again from other holders
+	Damaged     []string
+	Repaired    []string
+	Downloading []string
+}
+
+// Repair the files damaged by corrupt chunks found by scrubs
+func (gsspr *Gossiper) SetScrubRepair(repair bool) {
+	gsspr.scrubRepair = repair
+}
+
+// Scrub the chunk directory once at startup, it is the only check of the content of the chunks
+// of the files reloaded from the store
+func (gsspr *Gossiper) StartScrubbingChunks(wait *sync.WaitGroup) {
+	go func() {
+		defer wait.Done()
+		gsspr.pruneQuarantine()
+		gsspr.ScrubChunks(gsspr.scrubRepair)
+	}()
+}
+
+// Delete the chunk files quarantined more than QUARANTINE_RETENTION ago, and the oldest ones
+// over QUARANTINE_MAX_FILES
+func (gsspr *Gossiper) pruneQuarantine() {
+	quarantineDir := gsspr.chunkFilesDir + QUARANTINE_DIR
+	infos, err := ioutil.ReadDir(quarantineDir)
+	if err != nil {
+		return
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+	for i, info := range infos {
+		if i >= QUARANTINE_MAX_FILES || time.Since(info.ModTime()) > QUARANTINE_RETENTION {
+			os.Remove(quarantineDir + info.Name())
+		}
+	}
+}
+
+// Hash every chunk file of the chunk directory and move those that don't match their name to
+// quarantine, then remove the chunks we lost from the chunk maps. With repair, files we shared
+// are written again from the shared files directory and the others downloaded again
+func (gsspr *Gossiper) ScrubChunks(repair bool) ScrubReport {
+	report := ScrubReport{
+		Corrupt:     make([]string, 0),
+		Damaged:     make([]string, 0),
+		Repaired:    make([]string, 0),
+		Downloading: make([]string, 0),
+	}
+	gsspr.metaDataList.mutex.Lock()
+	metaDataFiles := append([]FileMetaData{}, gsspr.metaDataList.metaDataFiles...)
+	gsspr.metaDataList.mutex.Unlock()
+
+	infos, err := ioutil.ReadDir(gsspr.chunkFilesDir)
+	if err != nil {
+		return report
+	}
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".chunk") {
+			continue
+		}
+		chunkHash, err := hex.DecodeString(strings.TrimSuffix(info.Name(), ".chunk"))
+		if err != nil || len(chunkHash) != int(gsspr.hashSize/8) {
+			continue
+		}
+		report.Chunks++
+		chunk, err := ioutil.ReadFile(gsspr.chunkFilesDir + info.Name())
+		hash := sha256.Sum256(chunk)
+		if err == nil && bytes.Equal(hash[:], chunkHash) {
+			continue
+		}
+		if gsspr.quarantineChunk(chunkHash) {
+			report.Corrupt = append(report.Corrupt, hex.EncodeToString(chunkHash))
+		}
+	}
+
+	// Nodes of tree metafiles are checked too, the chunks under a lost node are unknown
+	for _, metaData := range metaDataFiles {
+		chunkMap := gsspr.verifiedChunkMap(metaData, func(chunkHash []byte) bool {
+			_, err := os.Stat(gsspr.chunkFilesDir + GetChunkFilename(chunkHash, gsspr.hashSize))
+			return err == nil
+		})
+		if len(chunkMap) == len(metaData.ChunkMap) {
+			continue
+		}
+		kept := make(map[uint64]bool)
+		for _, chunkNumber := range chunkMap {
+			kept[chunkNumber] = true
+		}
+		for _, chunkNumber := range metaData.ChunkMap {
+			if !kept[chunkNumber] {
+				gsspr.metaDataList.RemoveChunkNumberFromMap(metaData.HashValue, chunkNumber)
+				gsspr.fileDownloadsList.RemoveChunkNumberFromMetaData(metaData.HashValue, chunkNumber)
+			}
+		}
+		gsspr.chunkStore.MarkDamaged(metaData.HashValue)
+	}
+
+	// Files that lost chunks since they were last repaired, also when chunks were found corrupt
+	// while serving them or missing at startup
+	for _, fileHash := range gsspr.chunkStore.Damaged() {
+		metaData := gsspr.metaDataList.GetByHash(fileHash)
+		if metaData == nil {
+			gsspr.chunkStore.MarkRepaired(fileHash)
+			continue
+		}
+		report.Damaged = append(report.Damaged, metaData.Name)
+		if !repair {
+			continue
+		}
+		if len(metaData.Origins) > 0 && metaData.Origins[0] == gsspr.Name {
+			if gsspr.repairSharedFile(*metaData) {
+				gsspr.chunkStore.MarkRepaired(fileHash)
+				report.Repaired = append(report.Repaired, metaData.Name)
+			}
+		} else if len(metaData.Origins) > 0 {
+			// The missing chunks are requested again by a new download of the file
+			gsspr.chunkStore.MarkRepaired(fileHash)
+			go gsspr.downloadWhenRoutable(DataRequest{
+				Origin:      gsspr.Name,
+				Destination: metaData.Origins[0],
+				HopLimit:    uint32(gsspr.hopLimit),
+				HashValue:   metaData.HashValue,
+				FileName:    metaData.Name,
+			})
+			report.Downloading = append(report.Downloading, metaData.Name)
+		}
+	}
+	logScrubFinished(report.Chunks, len(report.Corrupt), len(report.Damaged))
+	return report
+}
+
+// Move a chunk file that doesn't match its hash to quarantine, and remove it from the chunk
+// maps of its files. Returns false if it matches its hash
+func (gsspr *Gossiper) quarantineChunk(chunkHash []byte) bool {
+	files, quarantined := gsspr.chunkStore.Quarantine(gsspr.chunkFilesDir, chunkHash, gsspr.hashSize)
+	if !quarantined {
+		return false
+	}
+	for fileHash, chunkNumbers := range files {
+		for _, chunkNumber := range chunkNumbers {
+			gsspr.metaDataList.RemoveChunkNumberFromMap([]byte(fileHash), chunkNumber)
+			gsspr.fileDownloadsList.RemoveChunkNumberFromMetaData([]byte(fileHash), chunkNumber)
+		}
+	}
+	logChunkQuarantined(hex.EncodeToString(chunkHash))
+	return true
+}
+
+// Write the chunks of a file we shared again from the shared files directory, returns true if
+// the file has every chunk again. A folder is shared again with its files
+func (gsspr *Gossiper) repairSharedFile(metaData FileMetaData) bool {
+	absPath, err := filepath.Abs("")
+	if err != nil {
+		return false
+	}
+	if strings.HasSuffix(metaData.Name, "/") {
+		_, err = gsspr.indexSharedEntry(strings.TrimSuffix(metaData.Name, "/"))
+	} else {
+		_, _, err = IndexFileChunks(filepath.Join(absPath, gsspr.sharedFilesDir, filepath.FromSlash(metaData.Name)),
+			gsspr.chunkSize, gsspr.hashSize, gsspr.chunkFilesDir)
+	}
+	if err != nil {
+		return false
+	}
+	// The chunks match the metafile only if the file is unchanged
+	chunkCount := GetChunkNumber(metaData.MetaFile, gsspr.hashSize)
+	metaData.ChunkMap = make([]uint64, chunkCount)
+	for i := uint64(0); i < chunkCount; i++ {
+		metaData.ChunkMap[i] = i + 1
+	}
+	metaData.ChunkMap = gsspr.verifiedChunkMap(metaData, func(chunkHash []byte) bool {
+		return gsspr.readChunkFile(chunkHash) != nil
+	})
+	for _, chunkNumber := range metaData.ChunkMap {
+		gsspr.metaDataList.AddChunkNumberToMap(metaData.HashValue, chunkNumber)
+	}
+	gsspr.registerChunks(metaData)
+	return uint64(len(metaData.ChunkMap)) == chunkCount
+}
+
+// Download a file again once the nodes that have it can be reached, it is resumed after a
+// restart meanwhile
+func (gsspr *Gossiper) downloadWhenRoutable(request DataRequest) {
+	gsspr.journalDownload(request, false)
+	ticker := time.NewTicker(DOWNLOAD_RESUME_INTERVAL)
+	defer ticker.Stop()
+	start := time.Now()
+	for !gsspr.canRouteDownload(request) {
+		if !gsspr.waitTick(ticker) {
+			return
+		}
+		if time.Since(start) > DOWNLOAD_RESUME_TIMEOUT {
+			gsspr.pauseUnroutableDownload(request)
+			return
+		}
+	}
+	StartFileDownload(gsspr, request)
+}
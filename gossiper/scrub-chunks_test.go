@@ -0,0 +1,63 @@
+package gossiper
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestQuarantinePruned(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "")
+	quarantineDir := alice.chunkFilesDir + QUARANTINE_DIR
+	os.MkdirAll(quarantineDir, 0755)
+	for i := 0; i < QUARANTINE_MAX_FILES+1; i++ {
+		name := fmt.Sprintf("%s%04d.chunk", quarantineDir, i)
+		ioutil.WriteFile(name, []byte("corrupt"), 0644)
+		// The first one is the oldest
+		quarantined := time.Now().Add(time.Duration(i-QUARANTINE_MAX_FILES) * time.Minute)
+		os.Chtimes(name, quarantined, quarantined)
+	}
+	expired := quarantineDir + "expired.chunk"
+	ioutil.WriteFile(expired, []byte("corrupt"), 0644)
+	quarantined := time.Now().Add(-QUARANTINE_RETENTION - time.Hour)
+	os.Chtimes(expired, quarantined, quarantined)
+
+	alice.pruneQuarantine()
+	infos, _ := ioutil.ReadDir(quarantineDir)
+	if len(infos) != QUARANTINE_MAX_FILES {
+		t.Fatalf("%d chunk files left in quarantine", len(infos))
+	}
+	if _, err := os.Stat(quarantineDir + "0000.chunk"); !os.IsNotExist(err) {
+		t.Error("oldest chunk file kept instead of a newer one")
+	}
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Error("expired chunk file kept")
+	}
+}
+
+func TestCorruptChunksOfReloadedFilesFoundByScrub(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "_Store/messages.db")
+	os.MkdirAll(alice.chunkFilesDir, 0755)
+	metaData, err := alice.indexContent(bytes.NewReader(bytes.Repeat([]byte("chunk "), 3000)), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunkHash := metaData.ChunkHashes(alice.hashSize)[1]
+	ioutil.WriteFile(alice.chunkFilesDir+GetChunkFilename(chunkHash, alice.hashSize), []byte("corrupt"), 0644)
+	alice.Stop()
+
+	// The chunks are only hashed once, by the scrub
+	restarted := newTestGossiper(t, network, "alice", "127.0.0.1:5002", "_Store/messages.db")
+	if len(restarted.metaDataList.GetByHash(metaData.HashValue).ChunkMap) != 3 {
+		t.Fatal("chunk map checked against the content of the chunks at load")
+	}
+	report := restarted.ScrubChunks(false)
+	if len(report.Corrupt) != 1 || len(restarted.metaDataList.GetByHash(metaData.HashValue).ChunkMap) != 2 {
+		t.Fatalf("scrub found %d corrupt chunks", len(report.Corrupt))
+	}
+}
@@ -13,16 +13,46 @@ import (
 // Structure containing slice of search data and a mutex
 type SearchList struct {
 	searchData []SearchData
-	mutex      *sync.Mutex
+	// Every peer that answered with a chunk, by metafile hash and chunk number
+	holders map[string]map[uint64][]string
+	mutex   *sync.Mutex
 }
 
 func NewSearchList() *SearchList {
 	return &SearchList{
 		searchData: make([]SearchData, 0),
+		holders:    make(map[string]map[uint64][]string),
 		mutex:      &sync.Mutex{},
 	}
 }
 
+// Register the chunks a peer has of a file
+func (sl *SearchList) AddHolder(hash []byte, origin string, chunkMap []uint64) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+	chunkHolders, exists := sl.holders[string(hash)]
+	if !exists {
+		chunkHolders = make(map[uint64][]string)
+		sl.holders[string(hash)] = chunkHolders
+	}
+	for _, chunkNumber := range chunkMap {
+		known := false
+		for _, holder := range chunkHolders[chunkNumber] {
+			known = known || holder == origin
+		}
+		if !known {
+			chunkHolders[chunkNumber] = append(chunkHolders[chunkNumber], origin)
+		}
+	}
+}
+
+// Peers known to have the chunk of a file, in the order they answered
+func (sl *SearchList) GetHolders(hash []byte, chunkNumber uint64) []string {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+	return append([]string{}, sl.holders[string(hash)][chunkNumber]...)
+}
+
 // Add Search Data to List
 func (sl *SearchList) Add(newSearchData SearchData) {
 	sl.mutex.Lock()
@@ -94,6 +124,9 @@ func NewSearchData(keywords []string) SearchData {
 	}
 }
 
+// Time to wait for the replies of a search round, until round-trip times are measured
+const SEARCH_ROUND_TIMEOUT = 1000 * time.Millisecond
+
 func StartFileSearch(gsspr *Gossiper, request SearchRequest, autoDownload bool) []FileMetaData {
 	// Set initial budget and start searching
 	budgetMax := request.Budget
@@ -137,7 +170,8 @@ func StartFileSearch(gsspr *Gossiper, request SearchRequest, autoDownload bool)
 				}
 			}
 
-			timer := time.NewTimer(time.Millisecond * 1000)
+			// Wait as long as it takes to hear from the slowest node we know
+			timer := time.NewTimer(gsspr.originRtt.MaxTimeout(SEARCH_ROUND_TIMEOUT))
 			waitingForSearch := true
 			for waitingForSearch {
 				select {
@@ -147,7 +181,8 @@ func StartFileSearch(gsspr *Gossiper, request SearchRequest, autoDownload bool)
 					waitingForSearch = false
 					break
 				case replySearch := <-gsspr.searchesListening:
-					// Received a reply
+					// Received a reply. Its delay depends on the whole search, not only on the
+					// route to its origin, so it isn't sampled for the timeouts of data requests
 					// Check if it matches our search keywords
 					if len(replySearch.Results) > 0 {
 						isAMatch := false
@@ -180,7 +215,8 @@ func StartFileSearch(gsspr *Gossiper, request SearchRequest, autoDownload bool)
 		}
 	}
 
-	// Request metafiles for all valid search results
+	// Request metafiles for all valid search results, results whose metafile doesn't arrive are dropped
+	fetchedMetaDatas := make([]FileMetaData, 0, len(validMetaDatas))
 	for i, auxMetaData := range validMetaDatas {
 		metaFileReq := DataRequest{
 			Origin:      gsspr.Name,
@@ -201,54 +237,51 @@ func StartFileSearch(gsspr *Gossiper, request SearchRequest, autoDownload bool)
 			return make([]FileMetaData, 0)
 		}
 		if nextHop != "" {
-			gsspr.sendGossipQueue <- &QueuedMessage{
+			gsspr.queueGossip(&QueuedMessage{
 				packet: GossipPacket{
 					DataRequest: &metaFileReq,
 				},
 				destination: nextHop,
-			}
+			})
 		}
 
 		// Log that we are downloading the MetaFile
 		logDownloadingMetaFile(metaFileReq.FileName, metaFileReq.Destination)
 
 		// and wait for data reply
-		metaFileReplyChannel := make(chan *DataReply)
-
-		metaFileReplyString := string(metaFileReq.HashValue)
+		metaFileReplyChannel := make(chan *DataReply, 1)
 
-		gsspr.filesMutex.Lock()
-		channelValue, exists := gsspr.filesListening[metaFileReplyString]
-		gsspr.filesMutex.Unlock()
-
-		if exists && channelValue != nil {
-			// It has already been requested by other thread
-			return make([]FileMetaData, 0)
-		}
-
-		// Register new channel
-		gsspr.filesMutex.Lock()
-		gsspr.filesListening[metaFileReplyString] = metaFileReplyChannel
-		gsspr.filesMutex.Unlock()
+		gsspr.listenForData(metaFileReq.HashValue, metaFileReplyChannel)
 
 		received := false
+		attempt := 0
+		sent := time.Now()
 
 		// While not received
-		for !received {
-			// Set timer
-			timer := time.NewTimer(time.Millisecond * 5000)
+		for !received && attempt < MAX_REQUEST_ATTEMPTS {
+			// Set timer, doubled at each attempt
+			timer := time.NewTimer(retryTimeout(
+				gsspr.originRtt.Timeout(metaFileReq.Destination, DATA_REQUEST_TIMEOUT), attempt))
 
 			select {
+			case <-gsspr.quit:
+				timer.Stop()
+				gsspr.stopListeningForData(metaFileReq.HashValue, metaFileReplyChannel)
+				return make([]FileMetaData, 0)
 			case <-timer.C:
 				// If timer runs out
 				timer.Stop()
+				attempt++
+				if attempt == MAX_REQUEST_ATTEMPTS {
+					break
+				}
 				// Resend
-				gsspr.sendGossipQueue <- &QueuedMessage{
+				gsspr.queueGossip(&QueuedMessage{
 					packet: GossipPacket{
 						DataRequest: &metaFileReq,
 					},
 					destination: nextHop,
-				}
+				})
 			case replyMetaFile := <-metaFileReplyChannel:
 				// Received a reply
 				timer.Stop()
@@ -258,13 +291,17 @@ func StartFileSearch(gsspr *Gossiper, request SearchRequest, autoDownload bool)
 				hash.Write(replyMetaFile.Data)
 				replyHash := hash.Sum(nil)
 
-				if bytes.Equal(replyHash, auxMetaData.HashValue) {
+				if bytes.Equal(replyHash, auxMetaData.HashValue) && validMetaFile(replyMetaFile.Data, gsspr.hashSize) {
 					// We have received the chunk correctly
 					received = true
+					if attempt == 0 {
+						gsspr.originRtt.Sample(metaFileReq.Destination, time.Since(sent))
+					}
 
 					// Add to metaDataList
 					validMetaDatas[i].MetaFile = make([]byte, len(replyMetaFile.Data))
 					copy(validMetaDatas[i].MetaFile, replyMetaFile.Data)
+					fetchedMetaDatas = append(fetchedMetaDatas, validMetaDatas[i])
 
 				} else {
 					// Invalid MetaFile, keep the loop
@@ -273,12 +310,10 @@ func StartFileSearch(gsspr *Gossiper, request SearchRequest, autoDownload bool)
 			}
 		}
 
-		// Close channel
-		close(metaFileReplyChannel)
-		gsspr.filesMutex.Lock()
-		delete(gsspr.filesListening, metaFileReplyString)
-		gsspr.filesMutex.Unlock()
+		// Stop listening
+		gsspr.stopListeningForData(metaFileReq.HashValue, metaFileReplyChannel)
 	}
+	validMetaDatas = fetchedMetaDatas
 	logSearchFinished()
 	if len(validMetaDatas) > 0 {
 		gsspr.searchList.Add(SearchData{
@@ -346,10 +381,10 @@ func ProcessSearchRequest(gsspr *Gossiper, request SearchRequest, addressReq str
 						FileName:     resultMetaData.Name,
 						MetafileHash: resultMetaData.HashValue,
 						ChunkMap:     resultMetaData.ChunkMap,
-						ChunkCount:   GetChunkNumber(resultMetaData.MetaFile),
+						ChunkCount:   GetChunkNumber(resultMetaData.MetaFile, gsspr.hashSize),
 					})
 				}
-				gsspr.sendGossipQueue <- &QueuedMessage{
+				gsspr.queueGossip(&QueuedMessage{
 					packet: GossipPacket{
 						SearchReply: &SearchReply{
 							Origin:      gsspr.Name,
@@ -359,7 +394,7 @@ func ProcessSearchRequest(gsspr *Gossiper, request SearchRequest, addressReq str
 						},
 					},
 					destination: nextHop,
-				}
+				})
 			}
 		}
 	}
@@ -383,12 +418,12 @@ func processSearchReply(gsspr *Gossiper, reply SearchReply, addressReq string) {
 	// Get nextHop from routingTable
 	nextHop := gsspr.routingTable.GetAddress(reply.Destination)
 	if nextHop != "" {
-		gsspr.sendGossipQueue <- &QueuedMessage{
+		gsspr.queueGossip(&QueuedMessage{
 			packet: GossipPacket{
 				SearchReply: &reply,
 			},
 			destination: nextHop,
-		}
+		})
 	}
 	return
 }
@@ -401,7 +436,7 @@ func searchFileLocally(gsspr *Gossiper, keywords []string, logFindings bool) ([]
 	for _, metaData := range gsspr.metaDataList.metaDataFiles {
 		for _, key := range keywords {
 			if strings.Contains(metaData.Name, key) {
-				newFinding := expandMetaDataOrigins(metaData)
+				newFinding := expandMetaDataOrigins(metaData, gsspr.hashSize)
 				auxMetaDataList = append(auxMetaDataList, newFinding)
 				validMetaDataList = append(validMetaDataList, newFinding)
 				if logFindings {
@@ -416,7 +451,7 @@ func searchFileLocally(gsspr *Gossiper, keywords []string, logFindings bool) ([]
 	for _, download := range gsspr.fileDownloadsList.fileDownloads {
 		for _, key := range keywords {
 			if strings.Contains(download.metaData.Name, key) {
-				auxMetaDataList = append(auxMetaDataList, expandMetaDataOrigins(download.metaData))
+				auxMetaDataList = append(auxMetaDataList, expandMetaDataOrigins(download.metaData, gsspr.hashSize))
 				break;
 			}
 		}
@@ -425,10 +460,10 @@ func searchFileLocally(gsspr *Gossiper, keywords []string, logFindings bool) ([]
 	return auxMetaDataList, validMetaDataList
 }
 
-func expandMetaDataOrigins(metaData FileMetaData) FileMetaData {
+func expandMetaDataOrigins(metaData FileMetaData, hashSize uint) FileMetaData {
 	oldOriginsSize := uint64(len(metaData.Origins))
 	newOrigins := []string{}
-	chunkNumber := GetChunkNumber(metaData.MetaFile)
+	chunkNumber := GetChunkNumber(metaData.MetaFile, hashSize)
 	for i := uint64(0); i < chunkNumber; i++ {
 		newOrigins = append(newOrigins, metaData.Origins[i%oldOriginsSize])
 	}
@@ -445,6 +480,10 @@ func expandMetaDataOrigins(metaData FileMetaData) FileMetaData {
 func processSearchContent(gsspr *Gossiper, list []FileMetaData, reply *SearchReply, validMetaDatas []FileMetaData) ([]FileMetaData, []FileMetaData) {
 	gsspr.searchesMutex.Lock()
 	for _, auxResult := range reply.Results {
+		if !validSearchResult(auxResult) {
+			continue
+		}
+		gsspr.searchList.AddHolder(auxResult.MetafileHash, reply.Origin, auxResult.ChunkMap)
 		found := false
 		for i, metaData := range list {
 			if bytes.Equal(auxResult.MetafileHash, metaData.HashValue) {
@@ -489,9 +528,26 @@ func processSearchContent(gsspr *Gossiper, list []FileMetaData, reply *SearchRep
 	return list, validMetaDatas
 }
 
+// Check the chunk numbers of a result we received, they go from 1 to its chunk count. A result
+// without chunks names no origin to fetch the file from
+func validSearchResult(result *SearchResult) bool {
+	if result == nil || result.ChunkCount == 0 {
+		return false
+	}
+	for _, index := range result.ChunkMap {
+		if index < 1 || index > result.ChunkCount {
+			return false
+		}
+	}
+	return true
+}
+
 func mergeOrigins(replyOrigin string, result SearchResult, metaData FileMetaData) FileMetaData {
 	for _, index := range result.ChunkMap {
-		metaData.Origins[index] = replyOrigin
+		// Another origin may have given another chunk count for the same file
+		if index <= uint64(len(metaData.Origins)) {
+			metaData.Origins[index-1] = replyOrigin
+		}
 	}
 	metaData.ChunkMap = append([]uint64(nil), common.MergeUint64Slices(metaData.ChunkMap, result.ChunkMap)...)
 
@@ -522,10 +578,10 @@ func getChannelName(origin string, keywords []string) string {
 
 func sendSingleSearchRequest(gsspr *Gossiper, searchReq SearchRequest, peer string) {
 	// Send to neighbor
-	gsspr.sendGossipQueue <- &QueuedMessage{
+	gsspr.queueGossip(&QueuedMessage{
 		packet: GossipPacket{
 			SearchRequest: &searchReq,
 		},
 		destination: peer,
-	}
+	})
 }
@@ -0,0 +1,38 @@
+package gossiper
+
+import (
+	"testing"
+)
+
+func TestSearchResultsWithInvalidChunksIgnored(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "")
+	hash := []byte("metafile hash")
+	reply := &SearchReply{
+		Origin: "mallory",
+		Results: []*SearchResult{
+			nil,
+			{FileName: "file", MetafileHash: hash},
+			{FileName: "file", MetafileHash: hash, ChunkMap: []uint64{0}, ChunkCount: 2},
+			{FileName: "file", MetafileHash: hash, ChunkMap: []uint64{3}, ChunkCount: 2},
+		},
+	}
+	list, valid := processSearchContent(alice, nil, reply, nil)
+	if len(list) != 0 || len(valid) != 0 || len(alice.searchList.GetHolders(hash, 3)) != 0 {
+		t.Fatal("result with chunks out of the file kept")
+	}
+
+	// A chunk count that disagrees with the first result doesn't index out of the origins
+	for _, result := range []*SearchResult{
+		{FileName: "file", MetafileHash: hash, ChunkMap: []uint64{1}, ChunkCount: 2},
+		{FileName: "file", MetafileHash: hash, ChunkMap: []uint64{1, 2, 3}, ChunkCount: 3},
+	} {
+		list, valid = processSearchContent(alice, list, &SearchReply{
+			Origin:  "bob",
+			Results: []*SearchResult{result},
+		}, valid)
+	}
+	if len(list) != 1 || list[0].Origins[0] != "bob" || len(alice.searchList.GetHolders(hash, 2)) != 1 {
+		t.Fatalf("valid results not merged: %+v", list)
+	}
+}
@@ -0,0 +1,245 @@
+package gossiper
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A file or folder at the top of the shared files directory, as the watcher last indexed it
+type watchedEntry struct {
+	// Sizes and modification times of the file or of the files of the folder
+	fingerprint string
+	// Hashes of the files we share for it, the manifest and every file of a folder
+	hashes [][]byte
+}
+
+// Scan the shared files directory every period seconds, 0 to disable the watcher
+func (gsspr *Gossiper) SetSharedFilesWatch(period int) {
+	gsspr.sharedFilesWatch = period
+}
+
+// Index the files and folders that appear or change in the shared files directory, and stop
+// serving those that are removed from it
+func (gsspr *Gossiper) StartWatchingSharedFiles(wait *sync.WaitGroup) {
+	go func() {
+		defer wait.Done()
+		if gsspr.sharedFilesWatch <= 0 {
+			return
+		}
+		watched := gsspr.restoreWatchedEntries()
+		ticker := time.NewTicker(time.Duration(gsspr.sharedFilesWatch) * time.Second)
+		defer ticker.Stop()
+		seen := make(map[string]string)
+		for {
+			seen = gsspr.scanSharedFiles(watched, seen)
+			if !gsspr.waitTick(ticker) {
+				return
+			}
+		}
+	}()
+}
+
+// What we shared before a restart, to check it against the directory too. Entries whose
+// fingerprint didn't change since they were last indexed are not indexed again
+func (gsspr *Gossiper) restoreWatchedEntries() map[string]*watchedEntry {
+	watched := make(map[string]*watchedEntry)
+	gsspr.metaDataList.mutex.Lock()
+	for _, metaData := range gsspr.metaDataList.metaDataFiles {
+		if len(metaData.Origins) > 0 && metaData.Origins[0] == gsspr.Name {
+			watched[strings.SplitN(metaData.Name, "/", 2)[0]] = nil
+		}
+	}
+	gsspr.metaDataList.mutex.Unlock()
+	for name := range watched {
+		watched[name] = &watchedEntry{
+			fingerprint: gsspr.storedFingerprint(name),
+			hashes:      gsspr.sharedHashesOf(name),
+		}
+	}
+	return watched
+}
+
+// Compare the shared files directory with what we share. An entry is indexed once it is the same
+// in two scans in a row, so files still being copied are not. Returns the fingerprints of this scan
+func (gsspr *Gossiper) scanSharedFiles(watched map[string]*watchedEntry, previous map[string]string) map[string]string {
+	sharedDir, err := filepath.Abs(gsspr.sharedFilesDir)
+	if err != nil {
+		return previous
+	}
+	chunkDir, err := filepath.Abs(gsspr.chunkFilesDir)
+	if err != nil {
+		return previous
+	}
+	infos, err := ioutil.ReadDir(sharedDir)
+	if err != nil {
+		return previous
+	}
+	current := make(map[string]string)
+	for _, info := range infos {
+		entryPath := filepath.Join(sharedDir, info.Name())
+		// Hidden files are left alone, they are often temporary files of editors
+		if entryPath == chunkDir || strings.HasPrefix(info.Name(), ".") ||
+			!(info.IsDir() || info.Mode().IsRegular()) {
+			continue
+		}
+		fingerprint, err := sharedEntryFingerprint(entryPath, info, chunkDir)
+		if err == nil {
+			current[info.Name()] = fingerprint
+		}
+	}
+
+	for name, fingerprint := range current {
+		entry := watched[name]
+		if entry == nil {
+			// Shared by the client while we were watching, or never shared
+			entry = &watchedEntry{
+				hashes: gsspr.sharedHashesOf(name),
+			}
+			watched[name] = entry
+		}
+		if entry.fingerprint == fingerprint || previous[name] != fingerprint {
+			continue
+		}
+		metaData, err := gsspr.indexSharedEntry(name)
+		if err != nil {
+			logSharedFileIndexFailed(name, err.Error())
+			continue
+		}
+		hashes := [][]byte{metaData.HashValue}
+		if strings.HasSuffix(metaData.Name, "/") {
+			manifest, err := gsspr.readManifest(*metaData)
+			if err != nil {
+				logSharedFileIndexFailed(name, fmt.Sprint("can't read manifest: ", err))
+				continue
+			}
+			for _, manifestEntry := range manifest.Entries {
+				hashes = append(hashes, manifestEntry.MetafileHash)
+			}
+		}
+		oldHashes := entry.hashes
+		entry.fingerprint = fingerprint
+		entry.hashes = hashes
+		gsspr.storeFingerprint(name, fingerprint)
+		if len(oldHashes) == 0 {
+			// Only new names are published, the blockchain keeps the first file of a name
+			gsspr.publishSharedFile(*metaData)
+		} else if !containsHash(oldHashes, metaData.HashValue) {
+			logFileShared(metaData.Name, hex.EncodeToString(metaData.HashValue))
+		}
+		gsspr.stopServingUnwatched(watched, oldHashes)
+	}
+
+	for name, entry := range watched {
+		if _, exists := current[name]; !exists {
+			delete(watched, name)
+			gsspr.storeFingerprint(name, "")
+			gsspr.stopServingUnwatched(watched, entry.hashes)
+		}
+	}
+	return current
+}
+
+// Sizes and modification times of a file, or of every file of a folder
+func sharedEntryFingerprint(entryPath string, info os.FileInfo, chunkDir string) (string, error) {
+	if !info.IsDir() {
+		return fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano()), nil
+	}
+	var fingerprint strings.Builder
+	err := filepath.Walk(entryPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && filePath == chunkDir {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() {
+			fmt.Fprintf(&fingerprint, "%s %d %d\n", filePath, info.Size(), info.ModTime().UnixNano())
+		}
+		return nil
+	})
+	return fingerprint.String(), err
+}
+
+// A name of the shared files directory and its fingerprint, kept in the store
+type storedFingerprint struct {
+	Name        string
+	Fingerprint string
+}
+
+// Fingerprint of an entry of the shared files directory when we last indexed it, "" if unknown
+func (gsspr *Gossiper) storedFingerprint(name string) string {
+	stored := storedFingerprint{}
+	if gsspr.store == nil || !gsspr.store.Get(STORE_WATCHED_PREFIX+name, &stored) {
+		return ""
+	}
+	return stored.Fingerprint
+}
+
+// Remember the fingerprint of an indexed entry, or forget the entry if fingerprint is ""
+func (gsspr *Gossiper) storeFingerprint(name, fingerprint string) {
+	if gsspr.store == nil {
+		return
+	}
+	if fingerprint == "" {
+		checkStoreError(gsspr.store.Delete(STORE_WATCHED_PREFIX + name))
+		return
+	}
+	checkStoreError(gsspr.store.Put(STORE_WATCHED_PREFIX+name, &storedFingerprint{
+		Name:        name,
+		Fingerprint: fingerprint,
+	}))
+}
+
+// Hashes of the files we share under a name of the shared files directory, with the files of a
+// folder of that name
+func (gsspr *Gossiper) sharedHashesOf(name string) [][]byte {
+	hashes := make([][]byte, 0)
+	gsspr.metaDataList.mutex.Lock()
+	for _, metaData := range gsspr.metaDataList.metaDataFiles {
+		if len(metaData.Origins) > 0 && metaData.Origins[0] == gsspr.Name &&
+			(metaData.Name == name || strings.HasPrefix(metaData.Name, name+"/")) {
+			hashes = append(hashes, metaData.HashValue)
+		}
+	}
+	gsspr.metaDataList.mutex.Unlock()
+	return hashes
+}
+
+// Stop serving the files of hashes that no watched entry shares anymore
+func (gsspr *Gossiper) stopServingUnwatched(watched map[string]*watchedEntry, hashes [][]byte) {
+	unshared := make([][]byte, 0)
+	for _, hash := range hashes {
+		stillShared := false
+		for _, entry := range watched {
+			if containsHash(entry.hashes, hash) {
+				stillShared = true
+				break
+			}
+		}
+		if stillShared {
+			continue
+		}
+		// The same file may also be one we downloaded
+		metaData := gsspr.metaDataList.GetByHash(hash)
+		if metaData != nil && len(metaData.Origins) > 0 && metaData.Origins[0] == gsspr.Name {
+			unshared = append(unshared, hash)
+		}
+	}
+	gsspr.unshareFiles(unshared)
+}
+
+func containsHash(hashes [][]byte, hash []byte) bool {
+	for _, h := range hashes {
+		if bytes.Equal(h, hash) {
+			return true
+		}
+	}
+	return false
+}
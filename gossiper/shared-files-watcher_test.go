@@ -0,0 +1,37 @@
+package gossiper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWatchedFingerprintsKeptAcrossRestarts(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "_Store/messages.db")
+	os.MkdirAll(alice.chunkFilesDir, 0755)
+	ioutil.WriteFile(filepath.Join(alice.sharedFilesDir, "notes.txt"), []byte("some notes"), 0644)
+
+	watched := alice.restoreWatchedEntries()
+	seen := alice.scanSharedFiles(watched, nil)
+	alice.scanSharedFiles(watched, seen)
+	if watched["notes.txt"] == nil || len(watched["notes.txt"].hashes) != 1 {
+		t.Fatal("new file not indexed")
+	}
+	fingerprint := watched["notes.txt"].fingerprint
+	alice.Stop()
+
+	restarted := newTestGossiper(t, network, "alice", "127.0.0.1:5002", "_Store/messages.db")
+	watched = restarted.restoreWatchedEntries()
+	if watched["notes.txt"] == nil || watched["notes.txt"].fingerprint != fingerprint {
+		t.Fatal("unchanged file to be indexed again after a restart")
+	}
+
+	hash := watched["notes.txt"].hashes[0]
+	os.Remove(filepath.Join(restarted.sharedFilesDir, "notes.txt"))
+	restarted.scanSharedFiles(watched, nil)
+	if restarted.storedFingerprint("notes.txt") != "" || restarted.metaDataList.GetByHash(hash) != nil {
+		t.Fatal("removed file still shared")
+	}
+}
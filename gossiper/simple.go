@@ -2,10 +2,9 @@ package gossiper
 
 import (
 	"github.com/dedis/protobuf"
-	"net"
 )
 
-func onSimpleMessageReceived(gsspr *Gossiper, message []byte, sourceAddr *net.UDPAddr, isClient bool) {
+func onSimpleMessageReceived(gsspr *Gossiper, message []byte, sourceAddr string, isClient bool) {
 	var packetReceived = GossipPacket{}
 	protobuf.Decode(message, &packetReceived)
 	if packetReceived.Simple == nil {
@@ -18,29 +17,29 @@ func onSimpleMessageReceived(gsspr *Gossiper, message []byte, sourceAddr *net.UD
 			packetReceived.Simple.OriginalName = gsspr.Name
 			packetReceived.Simple.RelayPeerAddr = gsspr.addressStr
 			if peer != gsspr.addressStr {
-				gsspr.sendGossipQueue <- &QueuedMessage{
+				gsspr.queueGossip(&QueuedMessage{
 					packet:      packetReceived,
 					destination: peer,
-				}
+				})
 			}
 		}
 	} else {
 		//Log the first line for simple message
-		logSimpleMessage(packetReceived, sourceAddr.String())
+		logSimpleMessage(packetReceived, sourceAddr)
 		packetReceived.Simple.RelayPeerAddr = gsspr.addressStr
 		found := false
 		for _, peer := range gsspr.peersList {
-			if peer == sourceAddr.String() {
+			if peer == sourceAddr {
 				found = true
 			} else {
-				gsspr.sendGossipQueue <- &QueuedMessage{
+				gsspr.queueGossip(&QueuedMessage{
 					packet:      packetReceived,
 					destination: peer,
-				}
+				})
 			}
 		}
 		if !found {
-			gsspr.peersList = append(gsspr.peersList, sourceAddr.String())
+			gsspr.peersList = append(gsspr.peersList, sourceAddr)
 		}
 		logPeers(gsspr)
 	}
@@ -0,0 +1,417 @@
+package gossiper
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/dedis/protobuf"
+	"github.com/eliasmpw/Peerster/common"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrStoreClosed = errors.New("store closed")
+
+// The log is compacted once it has this many records and less than half of them are live
+const STORE_COMPACT_MIN_RECORDS = 1024
+
+// Record of the log of the store, a value written for a key or its removal
+type storeRecord struct {
+	Key     string
+	Value   []byte
+	Deleted bool
+	// Order in which the key was first written, kept by compaction
+	Seq uint64
+}
+
+type storeEntry struct {
+	value []byte
+	seq   uint64
+}
+
+// Key-value store kept in one append-only file. Every write appends a record, the file is
+// rewritten with only the live values when most of its records are outdated
+type MessageStore struct {
+	path    string
+	file    *os.File
+	writer  *bufio.Writer
+	entries map[string]storeEntry
+	records int
+	nextSeq uint64
+	mutex   *sync.Mutex
+}
+
+// Open the store at path, creating it if it doesn't exist
+func OpenMessageStore(path string) (*MessageStore, error) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	ms := &MessageStore{
+		path:    path,
+		file:    file,
+		entries: make(map[string]storeEntry),
+		mutex:   &sync.Mutex{},
+	}
+	err = ms.load()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	ms.writer = bufio.NewWriter(file)
+	return ms, nil
+}
+
+// Replay the log. A record cut by a crash ends the log, it is removed from the file
+func (ms *MessageStore) load() error {
+	reader := bufio.NewReader(ms.file)
+	var offset int64
+	for {
+		frame, err := readStreamFrame(reader)
+		if err != nil {
+			break
+		}
+		record := storeRecord{}
+		if protobuf.Decode(frame, &record) != nil {
+			break
+		}
+		offset += int64(4 + len(frame))
+		ms.apply(record)
+	}
+	err := ms.file.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	_, err = ms.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (ms *MessageStore) apply(record storeRecord) {
+	ms.records++
+	if record.Seq >= ms.nextSeq {
+		ms.nextSeq = record.Seq + 1
+	}
+	if record.Deleted {
+		delete(ms.entries, record.Key)
+		return
+	}
+	ms.entries[record.Key] = storeEntry{
+		value: record.Value,
+		seq:   record.Seq,
+	}
+}
+
+func (ms *MessageStore) append(record storeRecord) error {
+	if ms.file == nil {
+		return ErrStoreClosed
+	}
+	err := writeStreamFrame(ms.writer, &record)
+	if err != nil {
+		return err
+	}
+	err = ms.writer.Flush()
+	if err != nil {
+		return err
+	}
+	ms.apply(record)
+	if ms.records >= STORE_COMPACT_MIN_RECORDS && ms.records > 2*len(ms.entries) {
+		return ms.compact()
+	}
+	return nil
+}
+
+// Write the value of a key, encoded with protobuf
+func (ms *MessageStore) Put(key string, value interface{}) error {
+	content, err := protobuf.Encode(value)
+	if err != nil {
+		return err
+	}
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	seq := ms.nextSeq
+	if entry, exists := ms.entries[key]; exists {
+		seq = entry.seq
+	}
+	return ms.append(storeRecord{
+		Key:   key,
+		Value: content,
+		Seq:   seq,
+	})
+}
+
+func (ms *MessageStore) Delete(key string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if _, exists := ms.entries[key]; !exists {
+		return nil
+	}
+	return ms.append(storeRecord{
+		Key:     key,
+		Deleted: true,
+	})
+}
+
+// Remove every key with the given prefix
+func (ms *MessageStore) DeletePrefix(prefix string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	keys := make([]string, 0)
+	for key := range ms.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		err := ms.append(storeRecord{
+			Key:     key,
+			Deleted: true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decode the value of a key into value, returns false if the key is not in the store
+func (ms *MessageStore) Get(key string, value interface{}) bool {
+	ms.mutex.Lock()
+	entry, exists := ms.entries[key]
+	ms.mutex.Unlock()
+	return exists && protobuf.Decode(entry.value, value) == nil
+}
+
+// Encoded values of the keys with the given prefix, in the order the keys were first written
+func (ms *MessageStore) Scan(prefix string) [][]byte {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	keys := make([]string, 0)
+	for key := range ms.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return ms.entries[keys[i]].seq < ms.entries[keys[j]].seq
+	})
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = ms.entries[key].value
+	}
+	return values
+}
+
+// Rewrite the log with only the live values, the new file replaces the old one atomically
+func (ms *MessageStore) compact() error {
+	keys := make([]string, 0, len(ms.entries))
+	for key := range ms.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return ms.entries[keys[i]].seq < ms.entries[keys[j]].seq
+	})
+	tmpPath := ms.path + ".tmp"
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmpFile)
+	for _, key := range keys {
+		entry := ms.entries[key]
+		err = writeStreamFrame(writer, &storeRecord{
+			Key:   key,
+			Value: entry.value,
+			Seq:   entry.seq,
+		})
+		if err != nil {
+			tmpFile.Close()
+			return err
+		}
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+	err = os.Rename(tmpPath, ms.path)
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+	ms.file.Close()
+	ms.file = tmpFile
+	ms.writer = bufio.NewWriter(tmpFile)
+	ms.records = len(keys)
+	return nil
+}
+
+func (ms *MessageStore) Close() error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if ms.file == nil {
+		return nil
+	}
+	err := ms.file.Close()
+	ms.file = nil
+	return err
+}
+
+// Keys of the values a gossiper keeps in its store
+const STORE_RUMOR_PREFIX = "rumor/"
+
+// Followed by the origin, its last route rumor. Older route rumors are not kept, they carry no
+// text and ours can be signed again when a peer asks for them
+const STORE_ROUTE_PREFIX = "route/"
+const STORE_PRIVATE_PREFIX = "private/"
+const STORE_SEQUENCE_KEY = "sequence"
+
+// Followed by the origin, the next ID of an origin written by an older version, removed on load
+const STORE_CLOCK_PREFIX = "clock/"
+
+// Followed by the hex encoded metafile hash
+const STORE_FILE_PREFIX = "file/"
+
+// Followed by the hex encoded metafile hash, a slash and a chunk number, a change of the chunk
+// map of a file written after the record of the file
+const STORE_CHUNK_PREFIX = "chunk/"
+
+// Followed by a name of the shared files directory, its fingerprint when the watcher last
+// indexed it
+const STORE_WATCHED_PREFIX = "watched/"
+
+// Followed by the hex encoded metafile hash, the request of a download that is not complete
+const STORE_DOWNLOAD_PREFIX = "download/"
+
+// Next ID of our own rumors
+type storedSequence struct {
+	NextID uint32
+}
+
+// Chunk added to or removed from the chunk map of a file
+type storedChunkChange struct {
+	HashValue []byte
+	Number    uint64
+	Present   bool
+}
+
+// Reload the messages of a previous run, our new rumors continue after the IDs we already used.
+// The clock of another origin only covers its rumors we kept from the first one without a gap,
+// so we can send all of them to a peer that is behind. The others are asked again to our peers
+func (gsspr *Gossiper) loadStore() {
+	rumors := make([]RumorMessage, 0)
+	for _, value := range gsspr.store.Scan(STORE_RUMOR_PREFIX) {
+		rumor := RumorMessage{}
+		if protobuf.Decode(value, &rumor) != nil {
+			continue
+		}
+		if rumor.Text == "" {
+			// Route rumor kept under its ID by an older version, only the last one is kept
+			checkStoreError(gsspr.store.Delete(rumorStoreKey(rumor)))
+			last := RumorMessage{}
+			if !gsspr.store.Get(STORE_ROUTE_PREFIX+rumor.Origin, &last) || last.ID < rumor.ID {
+				checkStoreError(gsspr.store.Put(STORE_ROUTE_PREFIX+rumor.Origin, &rumor))
+			}
+			continue
+		}
+		rumors = append(rumors, rumor)
+	}
+	for _, value := range gsspr.store.Scan(STORE_ROUTE_PREFIX) {
+		rumor := RumorMessage{}
+		if protobuf.Decode(value, &rumor) == nil {
+			rumors = append(rumors, rumor)
+		}
+	}
+	checkStoreError(gsspr.store.DeletePrefix(STORE_CLOCK_PREFIX))
+
+	kept := make(map[string]map[uint32]bool)
+	for _, rumor := range rumors {
+		if kept[rumor.Origin] == nil {
+			kept[rumor.Origin] = make(map[uint32]bool)
+		}
+		kept[rumor.Origin][rumor.ID] = true
+	}
+	nextIds := make(map[string]uint32)
+	for _, rumor := range rumors {
+		if _, exists := nextIds[rumor.Origin]; !exists {
+			nextId := uint32(1)
+			for kept[rumor.Origin][nextId] {
+				nextId++
+			}
+			nextIds[rumor.Origin] = nextId
+		}
+		// Our own rumors are all kept, the missing route rumors are signed again when needed
+		if rumor.Origin == gsspr.Name || rumor.ID < nextIds[rumor.Origin] {
+			gsspr.loadRumor(rumor)
+		}
+	}
+
+	for _, value := range gsspr.store.Scan(STORE_PRIVATE_PREFIX) {
+		message := PrivateMessage{}
+		if protobuf.Decode(value, &message) == nil {
+			gsspr.allPrivateMessages = append(gsspr.allPrivateMessages, message)
+		}
+	}
+	sequence := storedSequence{}
+	if gsspr.store.Get(STORE_SEQUENCE_KEY, &sequence) {
+		gsspr.Vc.Advance(gsspr.Name, sequence.NextID)
+	}
+	gsspr.loadedNextId = gsspr.Vc.GetNextId(gsspr.Name)
+}
+
+// Add a rumor of a previous run, the clock of its origin continues after it
+func (gsspr *Gossiper) loadRumor(rumor RumorMessage) {
+	gsspr.Vc.Advance(rumor.Origin, rumor.ID+1)
+	if rumor.Origin != gsspr.Name && rumor.Signature != nil && gsspr.keyStore.VerifyRumor(&rumor, UNSIGNED_REJECT) {
+		// Pin the keys we learned before the restart
+		gsspr.keyStore.RegisterEncryptionKey(rumor.Origin, rumor.EncryptionKey)
+	}
+	gsspr.allRumorMessages = append(gsspr.allRumorMessages, rumor)
+}
+
+func rumorStoreKey(rumor RumorMessage) string {
+	return fmt.Sprintf("%s%s/%d", STORE_RUMOR_PREFIX, rumor.Origin, rumor.ID)
+}
+
+// Keep a rumor in the store, a route rumor replaces the previous one of its origin
+func (gsspr *Gossiper) storeRumor(rumor RumorMessage) {
+	if gsspr.store == nil {
+		return
+	}
+	key := rumorStoreKey(rumor)
+	if rumor.Text == "" {
+		key = STORE_ROUTE_PREFIX + rumor.Origin
+	}
+	err := gsspr.store.Put(key, &rumor)
+	if err == nil && rumor.Origin == gsspr.Name {
+		err = gsspr.store.Put(STORE_SEQUENCE_KEY, &storedSequence{
+			NextID: rumor.ID + 1,
+		})
+	}
+	checkStoreError(err)
+}
+
+func (gsspr *Gossiper) storePrivateMessage(index int, message PrivateMessage) {
+	if gsspr.store == nil {
+		return
+	}
+	err := gsspr.store.Put(fmt.Sprintf("%s%d", STORE_PRIVATE_PREFIX, index), &message)
+	checkStoreError(err)
+}
+
+// Writes after the gossiper stopped are dropped, other errors are fatal
+func checkStoreError(err error) {
+	if err != ErrStoreClosed {
+		common.CheckError(err)
+	}
+}
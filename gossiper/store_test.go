@@ -0,0 +1,267 @@
+package gossiper
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/dedis/protobuf"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestStore(t *testing.T, path string) *MessageStore {
+	store, err := OpenMessageStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func storedSequences(t *testing.T, store *MessageStore, prefix string) []uint32 {
+	ids := make([]uint32, 0)
+	for _, value := range store.Scan(prefix) {
+		sequence := storedSequence{}
+		if protobuf.Decode(value, &sequence) != nil {
+			t.Fatal("undecodable value")
+		}
+		ids = append(ids, sequence.NextID)
+	}
+	return ids
+}
+
+func TestStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store", "messages.db")
+	store := openTestStore(t, path)
+	for i := uint32(1); i <= 3; i++ {
+		store.Put(fmt.Sprintf("key/%d", i), &storedSequence{NextID: i})
+	}
+	store.Put("key/1", &storedSequence{NextID: 10})
+	store.Delete("key/2")
+	store.Close()
+	if store.Put("key/4", &storedSequence{NextID: 4}) != ErrStoreClosed {
+		t.Error("write accepted by a closed store")
+	}
+
+	store = openTestStore(t, path)
+	defer store.Close()
+	// Rewritten keys keep the position of their first write
+	if ids := storedSequences(t, store, "key/"); fmt.Sprint(ids) != "[10 3]" {
+		t.Fatalf("reopened with %v", ids)
+	}
+	sequence := storedSequence{}
+	if store.Get("key/2", &sequence) {
+		t.Error("deleted key reopened")
+	}
+}
+
+func TestStoreDropsRecordCutByCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.db")
+	store := openTestStore(t, path)
+	store.Put("key/1", &storedSequence{NextID: 1})
+	store.Put("key/2", &storedSequence{NextID: 2})
+	store.Close()
+	info, _ := os.Stat(path)
+
+	// Half written record at the end of the log
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	file.Write([]byte{0, 0, 1, 0, 42})
+	file.Close()
+
+	store = openTestStore(t, path)
+	if ids := storedSequences(t, store, "key/"); fmt.Sprint(ids) != "[1 2]" {
+		t.Fatalf("reopened with %v", ids)
+	}
+	truncated, _ := os.Stat(path)
+	if truncated.Size() != info.Size() {
+		t.Fatalf("log of %d bytes after removing the cut record, %d before", truncated.Size(), info.Size())
+	}
+	// New records follow the last complete one
+	store.Put("key/3", &storedSequence{NextID: 3})
+	store.Close()
+	store = openTestStore(t, path)
+	defer store.Close()
+	if ids := storedSequences(t, store, "key/"); fmt.Sprint(ids) != "[1 2 3]" {
+		t.Fatalf("reopened with %v", ids)
+	}
+}
+
+func TestStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.db")
+	store := openTestStore(t, path)
+	store.Put("first", &storedSequence{NextID: 1})
+	store.Put("deleted", &storedSequence{NextID: 2})
+	store.Delete("deleted")
+	for i := uint32(0); i < 2*STORE_COMPACT_MIN_RECORDS; i++ {
+		store.Put(fmt.Sprintf("key/%d", i%4), &storedSequence{NextID: i})
+	}
+	if store.records > STORE_COMPACT_MIN_RECORDS {
+		t.Fatalf("%d records for %d live keys", store.records, len(store.entries))
+	}
+	store.Close()
+
+	// Only the live values are left, in the order their keys were first written
+	store = openTestStore(t, path)
+	defer store.Close()
+	if store.records > STORE_COMPACT_MIN_RECORDS {
+		t.Errorf("%d records reopened for %d live keys", store.records, len(store.entries))
+	}
+	if ids := storedSequences(t, store, ""); fmt.Sprint(ids) != "[1 2044 2045 2046 2047]" {
+		t.Fatalf("reopened with %v", ids)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary file of the compaction left")
+	}
+}
+
+func TestRouteRumorsKeptOncePerOrigin(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "_Store/messages.db")
+	alice.newRumor("hello", "")
+	for i := 0; i < 5; i++ {
+		alice.newRumor("", "")
+	}
+	for id := uint32(1); id <= 3; id++ {
+		alice.addToAllRumorMessagesList(RumorMessage{
+			Origin: "bob",
+			ID:     id,
+		})
+	}
+	if rumors := len(alice.store.Scan(STORE_RUMOR_PREFIX)); rumors != 1 {
+		t.Fatalf("%d rumors stored instead of the one with a text", rumors)
+	}
+	if routes := len(alice.store.Scan(STORE_ROUTE_PREFIX)); routes != 2 {
+		t.Fatalf("%d route rumors stored for 2 origins", routes)
+	}
+
+	// A restarted gossiper continues after our last rumor, the rumors of bob are asked again
+	storePath := alice.store.path
+	alice.Stop()
+	restarted := newTestGossiper(t, network, "alice", "127.0.0.1:5002", "_Store/messages.db")
+	if restarted.store.path != storePath {
+		t.Fatal("restarted with another store")
+	}
+	if restarted.Vc.GetNextId("alice") != 7 || restarted.Vc.GetNextId("bob") != 1 {
+		t.Fatalf("restarted with clock %+v", restarted.Vc.Want)
+	}
+	if restarted.FindFromAllRumorMessages("alice", 1) == nil || restarted.FindFromAllRumorMessages("alice", 6) == nil {
+		t.Error("rumors of the previous run not reloaded")
+	}
+}
+
+func TestRestartedGossiperSendsAllRumorsOfItsClock(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "_Store/messages.db")
+	alice.newRumor("hello", "")
+	alice.newRumor("", "")
+	alice.newRumor("", "")
+	alice.newRumor("again", "")
+	bobKeys := newTestKeyPair(t)
+	for id, text := range []string{"hi", "", "", "bye"} {
+		rumor := &RumorMessage{
+			Origin: "bob",
+			ID:     uint32(id + 1),
+			Text:   text,
+		}
+		signRumor(bobKeys, rumor)
+		handleMessage(alice, &GossipPacket{
+			Rumor: rumor,
+		}, "127.0.0.1:5001")
+	}
+	alice.Stop()
+	restarted := newTestGossiper(t, network, "alice", "127.0.0.1:5002", "_Store/messages.db")
+	restarted.SetKeyPair(alice.keys)
+	// Route rumor 2 of bob was replaced, the rumors of bob after it are asked again
+	if restarted.Vc.GetNextId("alice") != 5 || restarted.Vc.GetNextId("bob") != 2 {
+		t.Fatalf("restarted with clock %+v", restarted.Vc.Want)
+	}
+
+	// A peer that is behind gets every rumor the clock counts, in order
+	carol := newTestGossiper(t, network, "carol", "127.0.0.1:5003", "")
+	for _, origin := range []string{"alice", "bob"} {
+		for id := uint32(1); id < restarted.Vc.GetNextId(origin); id++ {
+			rumor := restarted.FindFromAllRumorMessages(origin, id)
+			if rumor == nil {
+				t.Fatalf("rumor %d of %s counted by the clock but not kept", id, origin)
+			}
+			handleMessage(carol, &GossipPacket{
+				Rumor: rumor,
+			}, "127.0.0.1:5002")
+		}
+		if carol.Vc.GetNextId(origin) != restarted.Vc.GetNextId(origin) {
+			t.Fatalf("carol stuck at rumor %d of %s", carol.Vc.GetNextId(origin), origin)
+		}
+	}
+	if len(carol.allRumorMessages) != 5 {
+		t.Fatalf("%d rumors received instead of 5", len(carol.allRumorMessages))
+	}
+}
+
+func TestRouteRumorsOfOlderStoresRemoved(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "_Store/messages.db")
+	for id := uint32(1); id <= 3; id++ {
+		rumor := RumorMessage{
+			Origin: "bob",
+			ID:     id,
+		}
+		alice.store.Put(rumorStoreKey(rumor), &rumor)
+	}
+	alice.Stop()
+
+	restarted := newTestGossiper(t, network, "alice", "127.0.0.1:5002", "_Store/messages.db")
+	if rumors := len(restarted.store.Scan(STORE_RUMOR_PREFIX)); rumors != 0 {
+		t.Fatalf("%d route rumors left under their ID", rumors)
+	}
+	last := RumorMessage{}
+	if !restarted.store.Get(STORE_ROUTE_PREFIX+"bob", &last) || last.ID != 3 {
+		t.Fatalf("last route rumor of bob not kept: %+v", last)
+	}
+	// Rumors 1 and 2 of bob are gone, they are asked again to our peers
+	if restarted.Vc.GetNextId("bob") != 1 {
+		t.Fatalf("restarted with clock %+v", restarted.Vc.Want)
+	}
+}
+
+func TestChunkMapSavedIncrementally(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "_Store/messages.db")
+	os.MkdirAll(alice.chunkFilesDir, 0755)
+	metaFile := make([]byte, 0)
+	for i := 0; i < 64; i++ {
+		chunk := []byte(fmt.Sprintf("chunk %d", i))
+		hash := sha256.Sum256(chunk)
+		ioutil.WriteFile(alice.chunkFilesDir+GetChunkFilename(hash[:], alice.hashSize), chunk, 0644)
+		metaFile = append(metaFile, hash[:]...)
+	}
+	metaFileHash := sha256.Sum256(metaFile)
+	alice.metaDataList.Add(FileMetaData{
+		Name:      "file",
+		MetaFile:  metaFile,
+		HashValue: metaFileHash[:],
+		ChunkMap:  make([]uint64, 0),
+	})
+
+	info, _ := os.Stat(alice.store.path)
+	for chunkNumber := uint64(1); chunkNumber <= 64; chunkNumber++ {
+		alice.metaDataList.AddChunkNumberToMap(metaFileHash[:], chunkNumber)
+	}
+	grown, _ := os.Stat(alice.store.path)
+	// Each chunk adds a small record, the metafile is not written again
+	if grown.Size()-info.Size() > int64(64*(len(metaFile)/8)) {
+		t.Fatalf("log grew by %d bytes for 64 chunks", grown.Size()-info.Size())
+	}
+	for chunkNumber := uint64(1); chunkNumber <= 32; chunkNumber++ {
+		alice.metaDataList.RemoveChunkNumberFromMap(metaFileHash[:], chunkNumber)
+	}
+	alice.Stop()
+
+	restarted := newTestGossiper(t, network, "alice", "127.0.0.1:5002", "_Store/messages.db")
+	fmd := restarted.metaDataList.GetByHash(metaFileHash[:])
+	if fmd == nil || len(fmd.ChunkMap) != 32 || fmd.ChunkMap[0] != 33 {
+		t.Fatalf("restarted with chunk map %v", fmd)
+	}
+	if records := len(restarted.store.Scan(STORE_CHUNK_PREFIX)); records != 0 {
+		t.Fatalf("%d chunk records left after merging them", records)
+	}
+}
@@ -0,0 +1,256 @@
+package gossiper
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/dedis/protobuf"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of chunk requests sent on a stream before waiting for their replies
+const STREAM_WINDOW = 16
+const STREAM_DIAL_TIMEOUT = 2 * time.Second
+const STREAM_READ_TIMEOUT = 5 * time.Second
+const MAX_STREAM_FRAME_SIZE = 1 << 24
+
+// Time a served stream waits for the next request before being closed
+const STREAM_IDLE_TIMEOUT = 30 * time.Second
+
+// Stream addresses advertised by other peers in their data replies
+type StreamPeers struct {
+	addresses map[string]string
+	mutex     *sync.Mutex
+}
+
+func NewStreamPeers() *StreamPeers {
+	return &StreamPeers{
+		addresses: make(map[string]string),
+		mutex:     &sync.Mutex{},
+	}
+}
+
+func (sp *StreamPeers) Get(name string) string {
+	sp.mutex.Lock()
+	address := sp.addresses[name]
+	sp.mutex.Unlock()
+	return address
+}
+
+func (sp *StreamPeers) Set(name, address string) {
+	sp.mutex.Lock()
+	sp.addresses[name] = address
+	sp.mutex.Unlock()
+}
+
+func (sp *StreamPeers) Remove(name string) {
+	sp.mutex.Lock()
+	delete(sp.addresses, name)
+	sp.mutex.Unlock()
+}
+
+// Accept TCP stream connections on the given address and advertise it in our data replies,
+// so downloaders can fetch many chunks over one reliable connection
+func (gsspr *Gossiper) EnableStreams(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	gsspr.streamListener = listener
+	gsspr.streamAddress = advertisedStreamAddress(listener.Addr().String(), gsspr.addressStr)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				// Listener closed
+				return
+			}
+			go serveStream(gsspr, conn)
+		}
+	}()
+	return nil
+}
+
+// Address of the listener peers can connect to, a wildcard host is replaced by the host we gossip from
+func advertisedStreamAddress(listenAddress, gossipAddress string) string {
+	host, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return listenAddress
+	}
+	ip := net.ParseIP(host)
+	if host == "" || ip != nil && ip.IsUnspecified() {
+		gossipHost, _, err := net.SplitHostPort(gossipAddress)
+		if err == nil {
+			host = gossipHost
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// Answer the data requests received on a stream connection, in order, until the downloader closes it
+// or stays idle for STREAM_IDLE_TIMEOUT
+func serveStream(gsspr *Gossiper, conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(STREAM_IDLE_TIMEOUT))
+		frame, err := readStreamFrame(reader)
+		if err != nil {
+			return
+		}
+		request := DataRequest{}
+		err = protobuf.Decode(frame, &request)
+		if err != nil {
+			return
+		}
+		reply := DataReply{
+			Origin:      gsspr.Name,
+			Destination: request.Origin,
+			HashValue:   request.HashValue,
+			Data:        findRequestedData(gsspr, request.HashValue),
+		}
+		// A downloader that stops reading doesn't block us
+		conn.SetWriteDeadline(time.Now().Add(STREAM_READ_TIMEOUT))
+		err = writeStreamFrame(writer, &reply)
+		if err != nil {
+			return
+		}
+		// Only flush when the downloader is waiting for more than what is buffered
+		if reader.Buffered() == 0 {
+			err = writer.Flush()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Download the given chunks from a peer over a stream connection, keeping at most STREAM_WINDOW
+// requests in flight. Every chunk received and verified is given to save with its position in
+// hashes. Returns the number of chunks received
+func fetchChunksByStream(gsspr *Gossiper, address, destination string, hashes [][]byte,
+	save func(i int, chunk []byte)) int {
+	chunks := 0
+	conn, err := net.DialTimeout("tcp", address, STREAM_DIAL_TIMEOUT)
+	if err != nil {
+		return chunks
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	sent := 0
+	for received := 0; received < len(hashes); received++ {
+		// Fill the window
+		for sent < len(hashes) && sent-received < STREAM_WINDOW {
+			err = writeStreamFrame(writer, &DataRequest{
+				Origin:      gsspr.Name,
+				Destination: destination,
+				HashValue:   hashes[sent],
+			})
+			if err != nil {
+				return chunks
+			}
+			sent++
+		}
+		err = writer.Flush()
+		if err != nil {
+			return chunks
+		}
+
+		conn.SetReadDeadline(time.Now().Add(STREAM_READ_TIMEOUT))
+		frame, err := readStreamFrame(reader)
+		if err != nil {
+			return chunks
+		}
+		reply := DataReply{}
+		err = protobuf.Decode(frame, &reply)
+		if err != nil {
+			return chunks
+		}
+		// Replies come in the same order as the requests, skip the ones that don't verify
+		hash := sha256.Sum256(reply.Data)
+		if reply.Data != nil && bytes.Equal(hash[:], hashes[received]) {
+			save(received, reply.Data)
+			chunks++
+		}
+	}
+	return chunks
+}
+
+// Frames are a 4 bytes big endian length followed by a protobuf encoded message
+func writeStreamFrame(writer io.Writer, message interface{}) error {
+	content, err := protobuf.Encode(message)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(content)))
+	_, err = writer.Write(append(header, content...))
+	return err
+}
+
+func readStreamFrame(reader io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > MAX_STREAM_FRAME_SIZE {
+		return nil, errors.New("stream frame too big")
+	}
+	frame := make([]byte, size)
+	_, err = io.ReadFull(reader, frame)
+	return frame, err
+}
+
+// Fetch chunks of a file from the origins that accept streams, missing gives the hash of each
+// chunk to fetch by position. Each chunk is given to save as it arrives. Returns the positions
+// received
+func fetchFileByStreams(gsspr *Gossiper, metaData FileMetaData, missing map[uint64][]byte,
+	save func(index uint64, chunk []byte)) map[uint64]bool {
+	fileChunks := make(map[uint64]bool)
+	if len(metaData.Origins) == 0 {
+		return fileChunks
+	}
+	// Group chunks by the origin they are requested from, in order
+	positions := make(map[string][]uint64)
+	sorted := make([]uint64, 0, len(missing))
+	for index := range missing {
+		sorted = append(sorted, index)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	for _, index := range sorted {
+		origin := metaData.Origins[index%uint64(len(metaData.Origins))]
+		positions[origin] = append(positions[origin], index)
+	}
+	for origin, indexes := range positions {
+		address := gsspr.streamPeers.Get(origin)
+		if address == "" {
+			continue
+		}
+		hashes := make([][]byte, len(indexes))
+		for i, index := range indexes {
+			hashes[i] = missing[index]
+		}
+		received := fetchChunksByStream(gsspr, address, origin, hashes, func(i int, chunk []byte) {
+			save(indexes[i], chunk)
+			fileChunks[indexes[i]] = true
+		})
+		if received == 0 {
+			// Stream unusable, use only hop by hop requests with this origin from now on
+			gsspr.streamPeers.Remove(origin)
+		}
+	}
+	return fileChunks
+}
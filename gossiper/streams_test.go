@@ -0,0 +1,73 @@
+package gossiper
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestAdvertisedStreamAddress(t *testing.T) {
+	for _, test := range []struct {
+		listen, gossip, advertised string
+	}{
+		{"[::]:6000", "127.0.0.1:5000", "127.0.0.1:6000"},
+		{"0.0.0.0:6000", "10.0.0.2:5000", "10.0.0.2:6000"},
+		{"0.0.0.0:6000", "[::1]:5000", "[::1]:6000"},
+		{"10.0.0.3:6000", "10.0.0.2:5000", "10.0.0.3:6000"},
+	} {
+		advertised := advertisedStreamAddress(test.listen, test.gossip)
+		if advertised != test.advertised {
+			t.Errorf("%s advertised as %s instead of %s", test.listen, advertised, test.advertised)
+		}
+	}
+}
+
+func TestChunksFetchedByStream(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "")
+	bob := newTestGossiper(t, network, "bob", "127.0.0.1:5001", "")
+	os.MkdirAll(bob.chunkFilesDir, 0755)
+	content := bytes.Repeat([]byte("streamed "), 3000)
+	shared, err := bob.indexContent(bytes.NewReader(content), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.EnableStreams("0.0.0.0:0"); err != nil {
+		t.Fatal(err)
+	}
+	host, _, _ := net.SplitHostPort(bob.streamAddress)
+	if host != "127.0.0.1" {
+		t.Fatalf("stream advertised at %s", bob.streamAddress)
+	}
+
+	// A chunk bob doesn't have is skipped, the following ones still arrive
+	hashes := append([][]byte{make([]byte, bob.hashSize/8)}, shared.ChunkHashes(bob.hashSize)...)
+	received := make(map[int][]byte)
+	chunks := fetchChunksByStream(alice, bob.streamAddress, "bob", hashes, func(i int, chunk []byte) {
+		received[i] = chunk
+	})
+	if chunks != len(hashes)-1 || received[0] != nil {
+		t.Fatalf("%d chunks received out of %d", chunks, len(hashes)-1)
+	}
+	data := []byte{}
+	for i := 1; i < len(hashes); i++ {
+		data = append(data, received[i]...)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatalf("%d bytes received instead of the %d of the file", len(data), len(content))
+	}
+}
+
+func TestStreamFramesBounded(t *testing.T) {
+	frame := bytes.NewBuffer(nil)
+	if err := writeStreamFrame(frame, &DataRequest{Origin: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readStreamFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readStreamFrame(bytes.NewReader([]byte{0xFF, 0xFF, 0xFF, 0xFF})); err == nil {
+		t.Fatal("frame over MAX_STREAM_FRAME_SIZE accepted")
+	}
+}
@@ -0,0 +1,187 @@
+package gossiper
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// A topic as listed in the GUI
+type TopicInfo struct {
+	Name       string
+	Subscribed bool
+	// Number of rumors seen with the topic, stored or not
+	Rumors   int
+	Messages int
+}
+
+// Topics we are subscribed to and their messages. Rumors of other topics are still
+// relayed, but their messages are not kept here nor shown
+type TopicList struct {
+	subscriptions map[string]bool
+	seen          map[string]int
+	messages      map[string][]RumorMessage
+	// Rumors of other topics by origin and ID, oldest first in relayedOrder. They are all kept,
+	// our vector clock tells peers we have them
+	relayed      map[string]RumorMessage
+	relayedOrder []string
+	mutex        *sync.Mutex
+}
+
+func NewTopicList() *TopicList {
+	return &TopicList{
+		subscriptions: make(map[string]bool),
+		seen:          make(map[string]int),
+		messages:      make(map[string][]RumorMessage),
+		relayed:       make(map[string]RumorMessage),
+		mutex:         &sync.Mutex{},
+	}
+}
+
+// Subscribe to a topic, returns false if we already were
+func (tl *TopicList) Subscribe(topic string) bool {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	if tl.subscriptions[topic] {
+		return false
+	}
+	tl.subscriptions[topic] = true
+	return true
+}
+
+// Unsubscribe from a topic and forget its messages
+func (tl *TopicList) Unsubscribe(topic string) {
+	tl.mutex.Lock()
+	delete(tl.subscriptions, topic)
+	delete(tl.messages, topic)
+	tl.mutex.Unlock()
+}
+
+func (tl *TopicList) IsSubscribed(topic string) bool {
+	tl.mutex.Lock()
+	subscribed := tl.subscriptions[topic]
+	tl.mutex.Unlock()
+	return subscribed
+}
+
+// Register a rumor with a topic, returns true if it is kept because we are subscribed to it.
+// Otherwise it is only kept in memory to relay it
+func (tl *TopicList) Add(rumor RumorMessage) bool {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	tl.seen[rumor.Topic]++
+	if !tl.subscriptions[rumor.Topic] {
+		key := relayedKey(rumor.Origin, rumor.ID)
+		if _, exists := tl.relayed[key]; !exists {
+			tl.relayedOrder = append(tl.relayedOrder, key)
+		}
+		tl.relayed[key] = rumor
+		return false
+	}
+	tl.messages[rumor.Topic] = append(tl.messages[rumor.Topic], rumor)
+	return true
+}
+
+func relayedKey(origin string, id uint32) string {
+	return fmt.Sprintf("%s/%d", origin, id)
+}
+
+// Rumor of a topic we are not subscribed to, nil if we don't have it
+func (tl *TopicList) GetRelayed(origin string, id uint32) *RumorMessage {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	rumor, exists := tl.relayed[relayedKey(origin, id)]
+	if !exists {
+		return nil
+	}
+	return &rumor
+}
+
+// Remove and return the rumors of a topic kept to relay them
+func (tl *TopicList) takeRelayed(topic string) []RumorMessage {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	rumors := make([]RumorMessage, 0)
+	order := tl.relayedOrder[:0]
+	for _, key := range tl.relayedOrder {
+		rumor := tl.relayed[key]
+		if rumor.Topic == topic {
+			rumors = append(rumors, rumor)
+			delete(tl.relayed, key)
+		} else {
+			order = append(order, key)
+		}
+	}
+	tl.relayedOrder = order
+	return rumors
+}
+
+// Store a rumor of a topic we just subscribed to, without counting it as seen again
+func (tl *TopicList) restore(rumor RumorMessage) {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	if !tl.subscriptions[rumor.Topic] {
+		return
+	}
+	for _, message := range tl.messages[rumor.Topic] {
+		if message.Origin == rumor.Origin && message.ID == rumor.ID {
+			return
+		}
+	}
+	tl.messages[rumor.Topic] = append(tl.messages[rumor.Topic], rumor)
+}
+
+func (tl *TopicList) GetMessages(topic string) []RumorMessage {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	return append([]RumorMessage{}, tl.messages[topic]...)
+}
+
+// All the topics we are subscribed to or saw in a rumor, sorted by name
+func (tl *TopicList) GetTopics() []TopicInfo {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	topics := make([]TopicInfo, 0, len(tl.seen))
+	for topic := range tl.subscriptions {
+		if _, seen := tl.seen[topic]; !seen {
+			topics = append(topics, TopicInfo{
+				Name:       topic,
+				Subscribed: true,
+			})
+		}
+	}
+	for topic, rumors := range tl.seen {
+		topics = append(topics, TopicInfo{
+			Name:       topic,
+			Subscribed: tl.subscriptions[topic],
+			Rumors:     rumors,
+			Messages:   len(tl.messages[topic]),
+		})
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Name < topics[j].Name
+	})
+	return topics
+}
+
+// Subscribe to a topic, the rumors of the topic we still keep to relay them become its first
+// messages
+func (gsspr *Gossiper) Subscribe(topic string) {
+	if topic == "" || !gsspr.topics.Subscribe(topic) {
+		return
+	}
+	for _, rumor := range gsspr.topics.takeRelayed(topic) {
+		gsspr.addToAllRumorMessagesList(rumor)
+	}
+	gsspr.mutex.Lock()
+	defer gsspr.mutex.Unlock()
+	for _, rumor := range gsspr.allRumorMessages {
+		if rumor.Topic == topic && rumor.Text != "" {
+			gsspr.topics.restore(rumor)
+		}
+	}
+}
+
+func (gsspr *Gossiper) Unsubscribe(topic string) {
+	gsspr.topics.Unsubscribe(topic)
+}
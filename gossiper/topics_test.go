@@ -0,0 +1,79 @@
+package gossiper
+
+import (
+	"testing"
+)
+
+func TestRumorsOfOtherTopicsRelayedButNotStored(t *testing.T) {
+	network := NewMemoryNetwork()
+	bob := newTestGossiper(t, network, "bob", "127.0.0.1:5001", "_Store/messages.db")
+	for id := uint32(1); id <= 2; id++ {
+		handleMessage(bob, &GossipPacket{
+			Rumor: &RumorMessage{
+				Origin: "alice",
+				ID:     id,
+				Text:   "about go",
+				Topic:  "go",
+			},
+		}, "127.0.0.1:5000")
+	}
+	if bob.Vc.GetNextId("alice") != 3 {
+		t.Fatal("rumors of another topic not accepted")
+	}
+	if len(bob.allRumorMessages) != 0 || len(bob.store.Scan(STORE_RUMOR_PREFIX)) != 0 {
+		t.Fatal("rumors of another topic kept")
+	}
+	// Still served to the peers missing them
+	if bob.FindFromAllRumorMessages("alice", 2) == nil {
+		t.Fatal("rumor of another topic not relayed")
+	}
+
+	// A restarted gossiper doesn't have them anymore, it asks for them again
+	bob.Stop()
+	restarted := newTestGossiper(t, network, "bob", "127.0.0.1:5002", "_Store/messages.db")
+	if restarted.Vc.GetNextId("alice") != 1 {
+		t.Fatalf("restarted with clock %+v", restarted.Vc.Want)
+	}
+}
+
+func TestSubscribeKeepsRelayedRumors(t *testing.T) {
+	network := NewMemoryNetwork()
+	bob := newTestGossiper(t, network, "bob", "127.0.0.1:5001", "_Store/messages.db")
+	handleMessage(bob, &GossipPacket{
+		Rumor: &RumorMessage{
+			Origin: "alice",
+			ID:     1,
+			Text:   "about go",
+			Topic:  "go",
+		},
+	}, "127.0.0.1:5000")
+
+	bob.Subscribe("go")
+	if len(bob.topics.GetMessages("go")) != 1 {
+		t.Fatal("relayed rumor not added to the topic")
+	}
+	if len(bob.allRumorMessages) != 1 || len(bob.store.Scan(STORE_RUMOR_PREFIX)) != 1 {
+		t.Fatal("rumor of a subscribed topic not kept")
+	}
+}
+
+func TestRelayedRumorsKeptWhileCounted(t *testing.T) {
+	network := NewMemoryNetwork()
+	bob := newTestGossiper(t, network, "bob", "127.0.0.1:5001", "")
+	for id := uint32(1); id <= 2000; id++ {
+		handleMessage(bob, &GossipPacket{
+			Rumor: &RumorMessage{
+				Origin: "alice",
+				ID:     id,
+				Text:   "about go",
+				Topic:  "go",
+			},
+		}, "127.0.0.1:5000")
+	}
+	// Every rumor our clock claims can be sent to a peer that is behind
+	for id := uint32(1); id < bob.Vc.GetNextId("alice"); id++ {
+		if bob.FindFromAllRumorMessages("alice", id) == nil {
+			t.Fatalf("rumor %d counted by the clock but not kept", id)
+		}
+	}
+}
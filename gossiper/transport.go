@@ -0,0 +1,200 @@
+package gossiper
+
+import (
+	"errors"
+	"github.com/eliasmpw/Peerster/common"
+	"net"
+	"sync"
+	"time"
+)
+
+// Interface used by the gossiper to exchange packets with its peers
+type Transport interface {
+	// Send a datagram to the given address
+	Send(data []byte, address string) error
+	// Block until a datagram arrives, returns its content and the sender address
+	Receive() ([]byte, string, error)
+	// Address other peers use to reach us
+	LocalAddress() string
+	Close() error
+}
+
+// Default transport, one UDP socket bound to the gossip address
+type UDPTransport struct {
+	conn *net.UDPConn
+}
+
+func NewUDPTransport(address string) (*UDPTransport, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPTransport{
+		conn: udpConn,
+	}, nil
+}
+
+func (ut *UDPTransport) Send(data []byte, address string) error {
+	addressToSend, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	_, err = ut.conn.WriteToUDP(data, addressToSend)
+	return err
+}
+
+func (ut *UDPTransport) Receive() ([]byte, string, error) {
+	buffer := make([]byte, common.BUFFER_SIZE)
+	n, sourceAddr, err := ut.conn.ReadFromUDP(buffer)
+	if err != nil {
+		return nil, "", err
+	}
+	return buffer[:n], sourceAddr.String(), nil
+}
+
+func (ut *UDPTransport) LocalAddress() string {
+	return ut.conn.LocalAddr().String()
+}
+
+func (ut *UDPTransport) Close() error {
+	return ut.conn.Close()
+}
+
+var ErrTransportClosed = errors.New("transport closed")
+var ErrPacketTooBig = errors.New("packet too big to be sent")
+
+const MEMORY_QUEUE_SIZE = 1024
+
+type memoryDatagram struct {
+	data   []byte
+	source string
+}
+
+// Decides what happens to a datagram sent from source to destination:
+// how long it is delayed and whether it is dropped
+type LinkPolicy func(source, destination string) (delay time.Duration, drop bool)
+
+// Set of in-memory transports that can reach each other by address,
+// used to run several gossipers inside a single process
+type MemoryNetwork struct {
+	transports map[string]*MemoryTransport
+	linkPolicy LinkPolicy
+	mutex      *sync.Mutex
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		transports: make(map[string]*MemoryTransport),
+		mutex:      &sync.Mutex{},
+	}
+}
+
+// Set the policy applied to every datagram, nil delivers everything immediately
+func (mn *MemoryNetwork) SetLinkPolicy(policy LinkPolicy) {
+	mn.mutex.Lock()
+	mn.linkPolicy = policy
+	mn.mutex.Unlock()
+}
+
+// Create a transport attached to the network at the given address
+func (mn *MemoryNetwork) NewTransport(address string) (*MemoryTransport, error) {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+	if _, exists := mn.transports[address]; exists {
+		return nil, errors.New("address already in use: " + address)
+	}
+	mt := &MemoryTransport{
+		network: mn,
+		address: address,
+		inbox:   make(chan memoryDatagram, MEMORY_QUEUE_SIZE),
+		closed:  make(chan struct{}),
+	}
+	mn.transports[address] = mt
+	return mt, nil
+}
+
+// Put a datagram in the inbox of the transport at address, if any.
+// Like UDP, datagrams to unknown addresses or full inboxes are dropped
+func (mn *MemoryNetwork) deliver(data []byte, source, address string) {
+	mn.mutex.Lock()
+	policy := mn.linkPolicy
+	mn.mutex.Unlock()
+	content := make([]byte, len(data))
+	copy(content, data)
+	if policy != nil {
+		delay, drop := policy(source, address)
+		if drop {
+			return
+		}
+		if delay > 0 {
+			time.AfterFunc(delay, func() {
+				mn.deliverNow(content, source, address)
+			})
+			return
+		}
+	}
+	mn.deliverNow(content, source, address)
+}
+
+func (mn *MemoryNetwork) deliverNow(content []byte, source, address string) {
+	mn.mutex.Lock()
+	destination := mn.transports[address]
+	mn.mutex.Unlock()
+	if destination == nil {
+		return
+	}
+	select {
+	case <-destination.closed:
+	case destination.inbox <- memoryDatagram{data: content, source: source}:
+	default:
+	}
+}
+
+func (mn *MemoryNetwork) remove(address string) {
+	mn.mutex.Lock()
+	delete(mn.transports, address)
+	mn.mutex.Unlock()
+}
+
+type MemoryTransport struct {
+	network   *MemoryNetwork
+	address   string
+	inbox     chan memoryDatagram
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (mt *MemoryTransport) Send(data []byte, address string) error {
+	select {
+	case <-mt.closed:
+		return ErrTransportClosed
+	default:
+	}
+	mt.network.deliver(data, mt.address, address)
+	return nil
+}
+
+func (mt *MemoryTransport) Receive() ([]byte, string, error) {
+	select {
+	case <-mt.closed:
+		return nil, "", ErrTransportClosed
+	case datagram := <-mt.inbox:
+		return datagram.data, datagram.source, nil
+	}
+}
+
+func (mt *MemoryTransport) LocalAddress() string {
+	return mt.address
+}
+
+func (mt *MemoryTransport) Close() error {
+	mt.closeOnce.Do(func() {
+		close(mt.closed)
+		mt.network.remove(mt.address)
+	})
+	return nil
+}
@@ -0,0 +1,94 @@
+package gossiper
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// Create two transports of the same kind that can reach each other
+type transportPair func(t *testing.T) (Transport, Transport)
+
+func udpTransportPair(t *testing.T) (Transport, Transport) {
+	first, err := NewUDPTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewUDPTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return first, second
+}
+
+func memoryTransportPair(t *testing.T) (Transport, Transport) {
+	network := NewMemoryNetwork()
+	first, err := network.NewTransport("127.0.0.1:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := network.NewTransport("127.0.0.1:5001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return first, second
+}
+
+func TestTransports(t *testing.T) {
+	for name, newPair := range map[string]transportPair{
+		"udp":    udpTransportPair,
+		"memory": memoryTransportPair,
+	} {
+		t.Run(name, func(t *testing.T) {
+			first, second := newPair(t)
+			defer first.Close()
+
+			packet := []byte("hello")
+			if err := first.Send(packet, second.LocalAddress()); err != nil {
+				t.Fatal(err)
+			}
+			received, source, err := second.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(received, packet) || source != first.LocalAddress() {
+				t.Fatalf("received %q from %s", received, source)
+			}
+
+			// Receiving stops once the transport is closed
+			second.Close()
+			if _, _, err := second.Receive(); err == nil {
+				t.Fatal("closed transport still receiving")
+			}
+		})
+	}
+}
+
+func TestMemoryAddressInUse(t *testing.T) {
+	network := NewMemoryNetwork()
+	transport, _ := network.NewTransport("127.0.0.1:5000")
+	if _, err := network.NewTransport("127.0.0.1:5000"); err == nil {
+		t.Fatal("two transports at the same address")
+	}
+	// The address is free again once closed
+	transport.Close()
+	if _, err := network.NewTransport("127.0.0.1:5000"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGossiperKeepsConfiguredAddress(t *testing.T) {
+	transport, err := NewUDPTransport("0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := TEST_DIR + "wildcard/"
+	defer os.RemoveAll(dir)
+	gsspr := NewGossiperWithTransport(transport, "127.0.0.1", "0", "localhost:5000", "wildcard", nil, false, 0,
+		dir+"_SharedFiles/", dir+"_SharedFiles/Chunks/", dir+"_Downloads/", "",
+		10, 256, 8192, 32, 2)
+	defer gsspr.Stop()
+	if gsspr.addressStr != "127.0.0.1:5000" {
+		t.Fatalf("gossip address %s instead of the configured one", gsspr.addressStr)
+	}
+}
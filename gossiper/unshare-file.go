@@ -0,0 +1,96 @@
+package gossiper
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"strings"
+)
+
+// Stop sharing the file with the given metafile hash, shared by us or downloaded. Its download is
+// cancelled if not complete, and unsharing a folder we share also unshares its files. The chunks
+// no other file is made of are deleted from the chunk directory. Returns false for unknown files
+func (gsspr *Gossiper) UnshareFile(hash []byte) bool {
+	metaData := gsspr.metaDataList.GetByHash(hash)
+	if metaData == nil {
+		return false
+	}
+	hashes := [][]byte{hash}
+	if strings.HasSuffix(metaData.Name, "/") {
+		manifest, err := gsspr.readManifest(*metaData)
+		for i := 0; err == nil && i < len(manifest.Entries); i++ {
+			// The same content may be shared on its own under another name
+			entryHash := manifest.Entries[i].MetafileHash
+			file := gsspr.metaDataList.GetByHash(entryHash)
+			if file != nil && strings.HasPrefix(file.Name, metaData.Name) {
+				hashes = append(hashes, entryHash)
+			}
+		}
+	}
+	// The chunks are only deleted once no download can save them anymore
+	for _, fileHash := range hashes {
+		gsspr.cancelDownloadAndWait(fileHash)
+	}
+	gsspr.unshareFiles(hashes)
+	return true
+}
+
+// Remove the FileMetaData of files and delete the chunks no other file references
+func (gsspr *Gossiper) unshareFiles(hashes [][]byte) {
+	// Listed before any chunk is deleted, the nodes of tree metafiles are read from the chunk directory
+	chunkHashes := make([][]byte, 0)
+	for _, hash := range hashes {
+		metaData := gsspr.metaDataList.Remove(hash)
+		if metaData == nil {
+			continue
+		}
+		logFileUnshared(metaData.Name, hex.EncodeToString(hash))
+		gsspr.chunkStore.Forget(hash)
+		chunkHashes = append(chunkHashes, gsspr.chunkDirHashes(*metaData)...)
+	}
+	if len(chunkHashes) == 0 {
+		return
+	}
+	references := gsspr.chunkReferences()
+	for _, chunkHash := range chunkHashes {
+		if references[string(chunkHash)] == 0 {
+			os.Remove(gsspr.chunkFilesDir + GetChunkFilename(chunkHash, gsspr.hashSize))
+		}
+	}
+}
+
+// Number of files of the metadata list each chunk of the chunk directory belongs to, by hash
+func (gsspr *Gossiper) chunkReferences() map[string]int {
+	gsspr.metaDataList.mutex.Lock()
+	metaDataFiles := append([]FileMetaData{}, gsspr.metaDataList.metaDataFiles...)
+	gsspr.metaDataList.mutex.Unlock()
+	references := make(map[string]int)
+	for _, metaData := range metaDataFiles {
+		for _, chunkHash := range gsspr.chunkDirHashes(metaData) {
+			references[string(chunkHash)]++
+		}
+	}
+	return references
+}
+
+// Hashes of the chunks of a file and of the nodes of its tree metafile. The chunks under nodes
+// missing from the chunk directory are unknown, none of them can be there either
+func (gsspr *Gossiper) chunkDirHashes(metaData FileMetaData) [][]byte {
+	if !isTreeMetaFile(metaData.MetaFile, gsspr.hashSize) {
+		return metaData.ChunkHashes(gsspr.hashSize)
+	}
+	hashes := make([][]byte, 0)
+	level := splitHashes(metaData.MetaFile[METAFILE_TREE_HEADER_SIZE:], gsspr.hashSize)
+	for depth := binary.BigEndian.Uint32(metaData.MetaFile[4:8]); depth > 0; depth-- {
+		hashes = append(hashes, level...)
+		nextLevel := make([][]byte, 0)
+		for _, nodeHash := range level {
+			node, err := gsspr.readMetaFileNode(nodeHash)
+			if err == nil {
+				nextLevel = append(nextLevel, splitHashes(node, gsspr.hashSize)...)
+			}
+		}
+		level = nextLevel
+	}
+	return append(hashes, level...)
+}
@@ -0,0 +1,42 @@
+package gossiper
+
+import (
+	"bytes"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUnshareWaitsForDownloadToStop(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "")
+	os.MkdirAll(alice.chunkFilesDir, 0755)
+	metaData, err := alice.indexContent(bytes.NewReader([]byte("partly downloaded")), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunkPath := alice.chunkFilesDir + GetChunkFilename(metaData.MetaFile, alice.hashSize)
+
+	// A download that takes a while to notice it was cancelled
+	download := newFileDownload(DataRequest{HashValue: metaData.HashValue, FileName: "file"}, false)
+	alice.fileDownloadsList.Add(download)
+	var stopped int32
+	go func() {
+		<-download.wake
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&stopped, 1)
+		alice.fileDownloadsList.Finish(download, DOWNLOAD_CANCELLED, nil)
+		close(download.done)
+	}()
+
+	if !alice.UnshareFile(metaData.HashValue) {
+		t.Fatal("file not unshared")
+	}
+	if atomic.LoadInt32(&stopped) == 0 {
+		t.Fatal("chunks deleted while the download could still save some")
+	}
+	if _, err := os.Stat(chunkPath); !os.IsNotExist(err) {
+		t.Fatal("chunk of the unshared file kept")
+	}
+}
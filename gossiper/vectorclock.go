@@ -5,8 +5,12 @@ import (
 )
 
 type StatusPacket struct {
-	Want  []PeerStatus
-	mutex *sync.Mutex
+	Want []PeerStatus
+	// Name of the sender and its signature of the clock, checked like the signature of rumors
+	Origin     string
+	SigningKey []byte
+	Signature  []byte
+	mutex      *sync.Mutex
 }
 
 func NewStatusPacket(name string) *StatusPacket {
@@ -85,6 +89,20 @@ func (sp *StatusPacket) Update(name string, id uint32) bool {
 	return true
 }
 
+// Move the clock of name forward to nextId, it never goes back
+func (sp *StatusPacket) Advance(name string, nextId uint32) {
+	if sp.GetNextId(name) >= nextId {
+		return
+	}
+	sp.mutex.Lock()
+	for index, status := range sp.Want {
+		if status.Identifier == name && status.NextID < nextId {
+			sp.Want[index].NextID = nextId
+		}
+	}
+	sp.mutex.Unlock()
+}
+
 func (sp *StatusPacket) MakeCopy() *StatusPacket {
 	sp.mutex.Lock()
 	Copy := make([]PeerStatus, len(sp.Want))
@@ -104,7 +122,7 @@ func CompareVectorClocks(gsspr *Gossiper, sourceAddr string, status StatusPacket
 	status.mutex = &sync.Mutex{}
 
 	// Make a copy of vector clock for evaluation
-	copy := (&gsspr.Vc).MakeCopy()
+	copy := gsspr.newStatus()
 
 	for _, theirStatus := range wanting {
 		myId := gsspr.Vc.GetNextId(theirStatus.Identifier)
@@ -117,12 +135,12 @@ func CompareVectorClocks(gsspr *Gossiper, sourceAddr string, status StatusPacket
 	}
 
 	if isBehind {
-		gsspr.sendGossipQueue <- &QueuedMessage{
+		gsspr.queueGossip(&QueuedMessage{
 			packet: GossipPacket{
 				Status: copy,
 			},
 			destination: sourceAddr,
-		}
+		})
 	}
 
 	for i := 0; i < gsspr.Vc.Length(); i++ {
@@ -1,42 +1,55 @@
 package gossiper
 
 import (
+	"encoding/hex"
 	"encoding/json"
-	"flag"
 	"github.com/eliasmpw/Peerster/common"
 	"github.com/gorilla/mux"
 	"io/ioutil"
 	"net/http"
+	"strings"
 )
 
-var myGossiper *Gossiper
+// Directory the GUI files are served from
+const GUI_DIR = "./gui/"
 
-func createRouteHandlers(gsspr *Gossiper) *mux.Router {
-	myGossiper = gsspr
-	var dir string
+const downloadNotFound = "no such download in a state allowing it"
 
-	flag.StringVar(&dir, "./gui/", "./gui/", "The directory to serve files from. Defaults to the current dir")
-	flag.Parse()
+// Create the router of the GUI, every handler is bound to the given gossiper
+func createRouteHandlers(gsspr *Gossiper) *mux.Router {
 	r := mux.NewRouter()
 
-	r.HandleFunc("/message", newMessageHandler).Methods("POST")
-	r.HandleFunc("/node", newNodeHandler).Methods("POST")
-	r.HandleFunc("/message", messagesHandler).Methods("GET")
-	r.HandleFunc("/node", nodesHandler).Methods("GET")
-	r.HandleFunc("/id", idHandler).Methods("GET")
-	r.HandleFunc("/ipAddress", ipAddressHandler).Methods("GET")
-	r.HandleFunc("/allNodes", allNodesHandler).Methods("GET")
-	r.HandleFunc("/privateMessage", privateMessageHandler).Methods("GET")
-	r.HandleFunc("/privateMessage", newPrivateMessageHandler).Methods("POST")
-	r.HandleFunc("/shareFile", shareFileHandler).Methods("POST")
-	r.HandleFunc("/downloadFile", downloadFileHandler).Methods("POST")
-	r.HandleFunc("/searchFile", searchFileHandler).Methods("POST")
-	r.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir(dir))))
+	r.HandleFunc("/message", gsspr.newMessageHandler).Methods("POST")
+	r.HandleFunc("/node", gsspr.newNodeHandler).Methods("POST")
+	r.HandleFunc("/message", gsspr.messagesHandler).Methods("GET")
+	r.HandleFunc("/node", gsspr.nodesHandler).Methods("GET")
+	r.HandleFunc("/id", gsspr.idHandler).Methods("GET")
+	r.HandleFunc("/ipAddress", gsspr.ipAddressHandler).Methods("GET")
+	r.HandleFunc("/allNodes", gsspr.allNodesHandler).Methods("GET")
+	r.HandleFunc("/privateMessage", gsspr.privateMessageHandler).Methods("GET")
+	r.HandleFunc("/privateMessage", gsspr.newPrivateMessageHandler).Methods("POST")
+	r.HandleFunc("/privateMessage/read", gsspr.readPrivateMessagesHandler).Methods("POST")
+	r.HandleFunc("/group", gsspr.groupsHandler).Methods("GET")
+	r.HandleFunc("/group", gsspr.newGroupMessageHandler).Methods("POST")
+	r.HandleFunc("/topic", gsspr.topicsHandler).Methods("GET")
+	r.HandleFunc("/topic/messages", gsspr.topicMessagesHandler).Methods("GET")
+	r.HandleFunc("/topic/subscribe", gsspr.subscribeHandler).Methods("POST")
+	r.HandleFunc("/topic/unsubscribe", gsspr.unsubscribeHandler).Methods("POST")
+	r.HandleFunc("/shareFile", gsspr.shareFileHandler).Methods("POST")
+	r.HandleFunc("/downloadFile", gsspr.downloadFileHandler).Methods("POST")
+	r.HandleFunc("/searchFile", gsspr.searchFileHandler).Methods("POST")
+	r.HandleFunc("/download", gsspr.downloadsHandler).Methods("GET")
+	r.HandleFunc("/scrub", gsspr.scrubHandler).Methods("POST")
+	r.HandleFunc("/unshareFile", gsspr.hashControlHandler(gsspr.UnshareFile, "no such file")).Methods("POST")
+	r.HandleFunc("/download/pause", gsspr.hashControlHandler(gsspr.PauseDownload, downloadNotFound)).Methods("POST")
+	r.HandleFunc("/download/resume", gsspr.hashControlHandler(gsspr.ResumeDownload, downloadNotFound)).Methods("POST")
+	r.HandleFunc("/download/cancel", gsspr.hashControlHandler(gsspr.CancelDownload, downloadNotFound)).Methods("POST")
+	r.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir(GUI_DIR))))
 
 	return r
 }
 
-func newMessageHandler(writer http.ResponseWriter, request *http.Request) {
+func (gsspr *Gossiper) newMessageHandler(writer http.ResponseWriter, request *http.Request) {
 	rawContent, _ := ioutil.ReadAll(request.Body)
 	var packetReceived GossipPacket
 	json.Unmarshal(rawContent, &packetReceived)
@@ -45,21 +58,26 @@ func newMessageHandler(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	handleClientMessage(myGossiper, &packetReceived, myGossiper.address)
+	handleClientMessage(gsspr, &packetReceived, gsspr.addressStr)
 }
 
-func newNodeHandler(writer http.ResponseWriter, request *http.Request) {
+func (gsspr *Gossiper) newNodeHandler(writer http.ResponseWriter, request *http.Request) {
 	rawContent, _ := ioutil.ReadAll(request.Body)
 	request.Body.Close()
 
-	newNode := string(rawContent[:])
-	addPeerToList(myGossiper, newNode)
+	newNode, err := common.CanonicalAddress(strings.TrimSpace(string(rawContent[:])))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	addPeerToList(gsspr, newNode)
 }
 
-func messagesHandler(writer http.ResponseWriter, request *http.Request) {
+func (gsspr *Gossiper) messagesHandler(writer http.ResponseWriter, request *http.Request) {
 	filteredMessages := []RumorMessage{}
-	for _, message := range myGossiper.allRumorMessages {
-		if message.Text != "" {
+	for _, message := range gsspr.allRumorMessages {
+		// Messages with a topic are shown with their topic only
+		if message.Text != "" && message.Topic == "" {
 			filteredMessages = append(filteredMessages, message)
 		}
 	}
@@ -69,42 +87,42 @@ func messagesHandler(writer http.ResponseWriter, request *http.Request) {
 	writer.Write(response)
 }
 
-func nodesHandler(writer http.ResponseWriter, request *http.Request) {
-	response, err := json.Marshal(myGossiper.peersList)
+func (gsspr *Gossiper) nodesHandler(writer http.ResponseWriter, request *http.Request) {
+	response, err := json.Marshal(gsspr.peersList)
 	common.CheckError(err)
 	writer.Header().Set("Content-Type", "application/json")
 	writer.Write(response)
 }
 
-func idHandler(writer http.ResponseWriter, request *http.Request) {
-	response, err := json.Marshal(myGossiper.Name)
+func (gsspr *Gossiper) idHandler(writer http.ResponseWriter, request *http.Request) {
+	response, err := json.Marshal(gsspr.Name)
 	common.CheckError(err)
 	writer.Header().Set("Content-Type", "application/json")
 	writer.Write(response)
 }
 
-func ipAddressHandler(writer http.ResponseWriter, request *http.Request) {
-	response, err := json.Marshal(myGossiper.addressStr)
+func (gsspr *Gossiper) ipAddressHandler(writer http.ResponseWriter, request *http.Request) {
+	response, err := json.Marshal(gsspr.addressStr)
 	common.CheckError(err)
 	writer.Header().Set("Content-Type", "application/json")
 	writer.Write(response)
 }
 
-func allNodesHandler(writer http.ResponseWriter, request *http.Request) {
-	response, err := json.Marshal(myGossiper.routingTable.table)
+func (gsspr *Gossiper) allNodesHandler(writer http.ResponseWriter, request *http.Request) {
+	response, err := json.Marshal(gsspr.routingTable.table)
 	common.CheckError(err)
 	writer.Header().Set("Content-Type", "application/json")
 	writer.Write(response)
 }
 
-func privateMessageHandler(writer http.ResponseWriter, request *http.Request) {
-	response, err := json.Marshal(myGossiper.allPrivateMessages)
+func (gsspr *Gossiper) privateMessageHandler(writer http.ResponseWriter, request *http.Request) {
+	response, err := json.Marshal(gsspr.getPrivateMessages())
 	common.CheckError(err)
 	writer.Header().Set("Content-Type", "application/json")
 	writer.Write(response)
 }
 
-func newPrivateMessageHandler(writer http.ResponseWriter, request *http.Request) {
+func (gsspr *Gossiper) newPrivateMessageHandler(writer http.ResponseWriter, request *http.Request) {
 	rawContent, _ := ioutil.ReadAll(request.Body)
 	var packetReceived GossipPacket
 	json.Unmarshal(rawContent, &packetReceived)
@@ -113,38 +131,92 @@ func newPrivateMessageHandler(writer http.ResponseWriter, request *http.Request)
 		return
 	}
 
-	handleClientMessage(myGossiper, &packetReceived, myGossiper.address)
+	handleClientMessage(gsspr, &packetReceived, gsspr.addressStr)
+}
+
+// Mark the messages received from the node named in the body as read
+func (gsspr *Gossiper) readPrivateMessagesHandler(writer http.ResponseWriter, request *http.Request) {
+	rawContent, _ := ioutil.ReadAll(request.Body)
+	request.Body.Close()
+
+	gsspr.MarkPrivateMessagesRead(strings.TrimSpace(string(rawContent[:])))
+}
+
+func (gsspr *Gossiper) groupsHandler(writer http.ResponseWriter, request *http.Request) {
+	response, err := json.Marshal(gsspr.groups.GetGroups())
+	common.CheckError(err)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(response)
+}
+
+func (gsspr *Gossiper) newGroupMessageHandler(writer http.ResponseWriter, request *http.Request) {
+	rawContent, _ := ioutil.ReadAll(request.Body)
+	var packetReceived GossipPacket
+	json.Unmarshal(rawContent, &packetReceived)
+	request.Body.Close()
+
+	handleClientMessage(gsspr, &GossipPacket{
+		Group: packetReceived.Group,
+	}, gsspr.addressStr)
+}
+
+func (gsspr *Gossiper) topicsHandler(writer http.ResponseWriter, request *http.Request) {
+	response, err := json.Marshal(gsspr.topics.GetTopics())
+	common.CheckError(err)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(response)
+}
+
+func (gsspr *Gossiper) topicMessagesHandler(writer http.ResponseWriter, request *http.Request) {
+	response, err := json.Marshal(gsspr.topics.GetMessages(request.URL.Query().Get("topic")))
+	common.CheckError(err)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(response)
+}
+
+func (gsspr *Gossiper) subscribeHandler(writer http.ResponseWriter, request *http.Request) {
+	rawContent, _ := ioutil.ReadAll(request.Body)
+	request.Body.Close()
+
+	gsspr.Subscribe(strings.TrimSpace(string(rawContent[:])))
 }
 
-func shareFileHandler(writer http.ResponseWriter, request *http.Request) {
+func (gsspr *Gossiper) unsubscribeHandler(writer http.ResponseWriter, request *http.Request) {
 	rawContent, _ := ioutil.ReadAll(request.Body)
 	request.Body.Close()
 
-	handleClientMessage(myGossiper, &GossipPacket{
+	gsspr.Unsubscribe(strings.TrimSpace(string(rawContent[:])))
+}
+
+func (gsspr *Gossiper) shareFileHandler(writer http.ResponseWriter, request *http.Request) {
+	rawContent, _ := ioutil.ReadAll(request.Body)
+	request.Body.Close()
+
+	handleClientMessage(gsspr, &GossipPacket{
 		Simple: &SimpleMessage{
 			OriginalName:  "file",
 			RelayPeerAddr: "file",
 			Contents:      string(rawContent[:]),
 		},
-	}, myGossiper.address)
+	}, gsspr.addressStr)
 }
 
-func downloadFileHandler(writer http.ResponseWriter, request *http.Request) {
+func (gsspr *Gossiper) downloadFileHandler(writer http.ResponseWriter, request *http.Request) {
 	rawContent, _ := ioutil.ReadAll(request.Body)
 	var packetReceived GossipPacket
 	json.Unmarshal(rawContent, &packetReceived)
-	handleClientMessage(myGossiper, &GossipPacket{
+	handleClientMessage(gsspr, &GossipPacket{
 		DataRequest: packetReceived.DataRequest,
-	}, myGossiper.address)
+	}, gsspr.addressStr)
 	request.Body.Close()
 }
 
-func searchFileHandler(writer http.ResponseWriter, request *http.Request) {
+func (gsspr *Gossiper) searchFileHandler(writer http.ResponseWriter, request *http.Request) {
 	rawContent, _ := ioutil.ReadAll(request.Body)
 	var packetReceived GossipPacket
 	json.Unmarshal(rawContent, &packetReceived)
-	response, err := json.Marshal(StartFileSearch(myGossiper, SearchRequest{
-		Origin:   myGossiper.Name,
+	response, err := json.Marshal(StartFileSearch(gsspr, SearchRequest{
+		Origin:   gsspr.Name,
 		Budget:   packetReceived.SearchRequest.Budget,
 		Keywords: packetReceived.SearchRequest.Keywords,
 	}, false))
@@ -153,3 +225,40 @@ func searchFileHandler(writer http.ResponseWriter, request *http.Request) {
 	writer.Write(response)
 	request.Body.Close()
 }
+
+func (gsspr *Gossiper) downloadsHandler(writer http.ResponseWriter, request *http.Request) {
+	response, err := json.Marshal(gsspr.GetDownloads())
+	common.CheckError(err)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(response)
+}
+
+// Scrub the chunk directory, the files that lost chunks are repaired if the body is "repair"
+func (gsspr *Gossiper) scrubHandler(writer http.ResponseWriter, request *http.Request) {
+	rawContent, _ := ioutil.ReadAll(request.Body)
+	request.Body.Close()
+
+	repair := strings.TrimSpace(string(rawContent[:])) == "repair"
+	response, err := json.Marshal(gsspr.ScrubChunks(repair))
+	common.CheckError(err)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(response)
+}
+
+// Handler applying action to the file whose metafile hash is the hex body of the request, notFound
+// is the error returned when action refuses it
+func (gsspr *Gossiper) hashControlHandler(action func(hash []byte) bool, notFound string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		rawContent, _ := ioutil.ReadAll(request.Body)
+		request.Body.Close()
+
+		hash, err := hex.DecodeString(strings.TrimSpace(string(rawContent[:])))
+		if err != nil {
+			http.Error(writer, "invalid hash", http.StatusBadRequest)
+			return
+		}
+		if !action(hash) {
+			http.Error(writer, notFound, http.StatusNotFound)
+		}
+	}
+}
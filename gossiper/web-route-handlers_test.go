@@ -0,0 +1,45 @@
+package gossiper
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Send a request to the GUI of a gossiper and decode its JSON response into result, if any
+func requestGUI(t *testing.T, gsspr *Gossiper, method, path, body string, result interface{}) int {
+	recorder := httptest.NewRecorder()
+	gsspr.GUIHandler().ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if result != nil && recorder.Code == http.StatusOK {
+		if err := json.Unmarshal(recorder.Body.Bytes(), result); err != nil {
+			t.Fatalf("%s %s answered %q: %v", method, path, recorder.Body.String(), err)
+		}
+	}
+	return recorder.Code
+}
+
+func TestGossipersInOneProcessKeepTheirState(t *testing.T) {
+	network := NewMemoryNetwork()
+	alice := newTestGossiper(t, network, "alice", "127.0.0.1:5000", "")
+	bob := newTestGossiper(t, network, "bob", "127.0.0.1:5001", "")
+
+	// Each GUI answers for its own gossiper
+	for _, gsspr := range []*Gossiper{alice, bob} {
+		name := ""
+		requestGUI(t, gsspr, "GET", "/id", "", &name)
+		if name != gsspr.Name {
+			t.Fatalf("GUI of %s answered as %s", gsspr.Name, name)
+		}
+	}
+
+	requestGUI(t, alice, "POST", "/message", `{"Simple":{"Contents":"hello"}}`, nil)
+	for gsspr, count := range map[*Gossiper]int{alice: 1, bob: 0} {
+		messages := []RumorMessage{}
+		requestGUI(t, gsspr, "GET", "/message", "", &messages)
+		if len(messages) != count {
+			t.Fatalf("%s lists %d messages instead of %d", gsspr.Name, len(messages), count)
+		}
+	}
+}
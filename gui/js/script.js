@@ -14,6 +14,15 @@ $(document).ready(function () {
     setInterval(function () {
         getAllNodes();
     }, 2000);
+    setInterval(function () {
+        getGroups();
+    }, 1000);
+    setInterval(function () {
+        getTopics();
+    }, 1000);
+    setInterval(function () {
+        getDownloads();
+    }, 1000);
 
     $('#sendMessage').click(postMessage);
     $('#addPeerNode').click(postPeerNode);
@@ -27,12 +36,27 @@ $(document).ready(function () {
     $('#downloadFileButton').click(downloadFileBtn);
     $('#searchFileButton').click(searchFileBtn);
     $('body').on('click', '.searchResultFile', downloadFileFromSearch);
+    $('body').on('click', '.groupName', selectGroup);
+    $('#createGroup').click(postGroup);
+    $('#sendGroupMessage').click(postGroupMessage);
+    $('#newGroupName').keyup(enableCreateGroupBtn);
+    $('#newGroupMembers').keyup(enableCreateGroupBtn);
+    $('#newGroupMessage').keyup(enableSendGroupMessageBtn);
+    $('body').on('click', '.topicName', selectTopic);
+    $('body').on('click', '.topicSubscription', toggleSubscription);
+    $('#subscribeTopic').click(subscribeNewTopic);
+    $('#sendTopicMessage').click(postTopicMessage);
+    $('#newTopic').keyup(enableSubscribeTopicBtn);
+    $('#newTopicMessage').keyup(enableSendTopicMessageBtn);
+    $('body').on('click', '.downloadControl', controlDownload);
 
     let idName;
     let ipAddress;
     let selectedPrivateName;
     let selectedPrivateAddress;
     let privateMessageInterval;
+    let selectedGroup;
+    let selectedTopic;
 
     function getMessages() {
         let messagesElement = $('#messages');
@@ -215,17 +239,29 @@ $(document).ready(function () {
                     });
                     messagesElement.text('');
                     $.each(response, function (key, value) {
+                        const status = value.Status ? ' (' + sanitizeString(value.Status) + ')' : '';
                         messagesElement.append(sanitizeString(value.Origin) + ': ' +
-                            sanitizeString(value.Text) + '\n');
+                            sanitizeString(value.Text) + status + '\n');
                     });
                     if (oldValue !== messagesElement.text()) {
                         messagesElement.scrollTop(messagesElement.prop('scrollHeight'));
+                        if (response.some(message => message.Origin === selectedPrivateName)) {
+                            markPrivateMessagesRead();
+                        }
                     }
                 }
             }
         });
     }
 
+    function markPrivateMessagesRead() {
+        $.ajax({
+            type: 'POST',
+            url: '/privateMessage/read',
+            data: selectedPrivateName,
+        });
+    }
+
     function postPrivateMessage() {
         const newMessage = $('#newPrivateMessage').val();
         if (newMessage !== '') {
@@ -263,6 +299,204 @@ $(document).ready(function () {
         clearInterval(privateMessageInterval);
     }
 
+    function getGroups() {
+        let groupsElement = $('#allGroups');
+        let messagesElement = $('#groupMessages');
+        $.ajax({
+            type: 'GET',
+            url: '/group',
+            data: '',
+            success: function (response) {
+                if (response) {
+                    newContent = "";
+                    for (let group of response) {
+                        newContent = newContent + '<div class="groupName" data-name="' + sanitizeString(group.Name) + '">' +
+                            sanitizeString(group.Name) + ' (' + sanitizeString(group.Members.join(', ')) + ')</div>';
+                        if (group.Name === selectedGroup) {
+                            const oldValue = messagesElement.text();
+                            messagesElement.text('');
+                            $.each(group.Messages, function (key, value) {
+                                messagesElement.append(sanitizeString(value.Origin) + ': ' +
+                                    sanitizeString(value.Text) + '\n');
+                            });
+                            if (oldValue !== messagesElement.text()) {
+                                messagesElement.scrollTop(messagesElement.prop('scrollHeight'));
+                            }
+                        }
+                    }
+                    groupsElement.html(newContent);
+                }
+            }
+        });
+    }
+
+    function selectGroup(element) {
+        selectedGroup = element.target.dataset.name;
+        $('#titleGroupMessages').text('Group Messages: ' + selectedGroup);
+        $('#groupMessages').text('');
+        enableSendGroupMessageBtn();
+        getGroups();
+    }
+
+    function postGroup() {
+        const name = $('#newGroupName').val().trim();
+        const members = parseKeywords($('#newGroupMembers').val());
+        if (name && members) {
+            const GossipPacket = {
+                Group: {
+                    Group: name,
+                    Members: members
+                }
+            };
+            const packet = JSON.stringify(GossipPacket);
+            $.ajax({
+                type: 'POST',
+                url: '/group',
+                data: packet,
+            });
+        }
+        $('#newGroupName').val('');
+        $('#newGroupMembers').val('');
+        enableCreateGroupBtn();
+    }
+
+    function postGroupMessage() {
+        const newMessage = $('#newGroupMessage').val();
+        if (newMessage !== '' && selectedGroup) {
+            const GossipPacket = {
+                Group: {
+                    Group: selectedGroup,
+                    Text: newMessage,
+                    HopLimit: 10
+                }
+            };
+            const packet = JSON.stringify(GossipPacket);
+            console.log("POST /group: ", packet);
+            $.ajax({
+                type: 'POST',
+                url: '/group',
+                data: packet,
+            });
+        }
+        $('#newGroupMessage').val('');
+        enableSendGroupMessageBtn();
+    }
+
+    function enableCreateGroupBtn() {
+        $('#createGroup').prop('disabled', $('#newGroupName').val() == '' || $('#newGroupMembers').val() == '');
+    }
+
+    function enableSendGroupMessageBtn() {
+        $('#sendGroupMessage').prop('disabled', $('#newGroupMessage').val() == '' || !selectedGroup);
+    }
+
+    function getTopics() {
+        $.ajax({
+            type: 'GET',
+            url: '/topic',
+            data: '',
+            success: function (response) {
+                if (response) {
+                    newContent = "";
+                    for (let topic of response) {
+                        const name = sanitizeString(topic.Name);
+                        newContent = newContent + '<div><span class="topicName" data-name="' + name + '">' + name +
+                            ' (' + topic.Rumors + ' rumors)</span> <button type="button" class="btn btn-sm topicSubscription" ' +
+                            'data-name="' + name + '" data-subscribed="' + topic.Subscribed + '">' +
+                            (topic.Subscribed ? 'Unsubscribe' : 'Subscribe') + '</button></div>';
+                    }
+                    $('#allTopics').html(newContent);
+                }
+            }
+        });
+        if (selectedTopic) {
+            getTopicMessages();
+        }
+    }
+
+    function getTopicMessages() {
+        let messagesElement = $('#topicMessages');
+        $.ajax({
+            type: 'GET',
+            url: '/topic/messages',
+            data: {topic: selectedTopic},
+            success: function (response) {
+                if (response) {
+                    const oldValue = messagesElement.text();
+                    messagesElement.text('');
+                    $.each(response, function (key, value) {
+                        messagesElement.append(sanitizeString(value.Origin) + ': ' +
+                            sanitizeString(value.Text) + '\n');
+                    });
+                    if (oldValue !== messagesElement.text()) {
+                        messagesElement.scrollTop(messagesElement.prop('scrollHeight'));
+                    }
+                }
+            }
+        });
+    }
+
+    function selectTopic(element) {
+        selectedTopic = element.target.dataset.name;
+        $('#titleTopicMessages').text('Topic Messages: ' + selectedTopic);
+        $('#topicMessages').text('');
+        enableSendTopicMessageBtn();
+        getTopicMessages();
+    }
+
+    function toggleSubscription(element) {
+        const url = element.target.dataset.subscribed === 'true' ? '/topic/unsubscribe' : '/topic/subscribe';
+        $.ajax({
+            type: 'POST',
+            url: url,
+            data: element.target.dataset.name,
+            success: getTopics,
+        });
+    }
+
+    function subscribeNewTopic() {
+        const topic = $('#newTopic').val().trim();
+        if (topic) {
+            $.ajax({
+                type: 'POST',
+                url: '/topic/subscribe',
+                data: topic,
+                success: getTopics,
+            });
+        }
+        $('#newTopic').val('');
+        enableSubscribeTopicBtn();
+    }
+
+    function postTopicMessage() {
+        const newMessage = $('#newTopicMessage').val();
+        if (newMessage !== '' && selectedTopic) {
+            const GossipPacket = {
+                Rumor: {
+                    Text: newMessage,
+                    Topic: selectedTopic
+                }
+            };
+            const packet = JSON.stringify(GossipPacket);
+            console.log("POST /message: ", packet);
+            $.ajax({
+                type: 'POST',
+                url: '/message',
+                data: packet,
+            });
+        }
+        $('#newTopicMessage').val('');
+        enableSendTopicMessageBtn();
+    }
+
+    function enableSubscribeTopicBtn() {
+        $('#subscribeTopic').prop('disabled', $('#newTopic').val().trim() == '');
+    }
+
+    function enableSendTopicMessageBtn() {
+        $('#sendTopicMessage').prop('disabled', $('#newTopicMessage').val() == '' || !selectedTopic);
+    }
+
     function shareFileBtn() {
         const filePath = $('#selectedFile').val();
         if (filePath) {
@@ -381,6 +615,59 @@ $(document).ready(function () {
         }
     }
 
+    function getDownloads() {
+        $.ajax({
+            type: 'GET',
+            url: '/download',
+            data: '',
+            success: function (response) {
+                if (response) {
+                    newContent = "";
+                    for (let download of response) {
+                        newContent = newContent + '<div>' + sanitizeString(download.FileName) + ' - ' + download.Status +
+                            ' - ' + download.Chunks + '/' + (download.TotalChunks || '?') + ' chunks';
+                        if (download.TotalFiles > 0) {
+                            newContent = newContent + ' - ' + download.Files + '/' + download.TotalFiles + ' files';
+                        }
+                        if (download.Status === 'active') {
+                            newContent = newContent + ' - ' + (download.BytesPerSecond / 1024).toFixed(1) + ' KB/s';
+                        }
+                        if (download.Sources && download.Sources.length > 0) {
+                            newContent = newContent + ' from ' + sanitizeString(download.Sources.join(', '));
+                        }
+                        if (download.Error) {
+                            newContent = newContent + ' <span class="downloadError">' + sanitizeString(download.Error) + '</span>';
+                        }
+                        if (download.Status === 'active') {
+                            newContent = newContent + downloadControlButton(download.Hash, 'pause', 'Pause');
+                        } else if (download.Status === 'paused') {
+                            newContent = newContent + downloadControlButton(download.Hash, 'resume', 'Resume');
+                        }
+                        if (download.Status === 'active' || download.Status === 'paused') {
+                            newContent = newContent + downloadControlButton(download.Hash, 'cancel', 'Cancel');
+                        }
+                        newContent = newContent + '</div>';
+                    }
+                    $('#allDownloads').html(newContent);
+                }
+            }
+        });
+    }
+
+    function downloadControlButton(hash, action, label) {
+        return ' <button type="button" class="btn btn-sm downloadControl" data-hash="' + hash +
+            '" data-action="' + action + '">' + label + '</button>';
+    }
+
+    function controlDownload(element) {
+        $.ajax({
+            type: 'POST',
+            url: '/download/' + element.target.dataset.action,
+            data: element.target.dataset.hash,
+            success: getDownloads,
+        });
+    }
+
     function decodeHex(myString) {
         let bytes = [];
         for (let i = 0; i < myString.length; i += 2)
@@ -2,6 +2,8 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"github.com/eliasmpw/Peerster/common"
 	"github.com/eliasmpw/Peerster/gossiper"
 	"math/rand"
 	"strconv"
@@ -12,25 +14,37 @@ import (
 const SHARED_FILES_DIR = "./_SharedFiles/"
 const CHUNK_FILES_DIR = "./_SharedFiles/Chunks/"
 const DOWNLOADED_FILES_DIR = "./_Downloads/"
+const KEYS_DIR = "./_Keys/"
+const STORE_DIR = "./_Store/"
 const HOP_LIMIT = 10
 const HASH_SIZE = 256
 const CHUNK_SIZE = 8192
 const MAX_SEARCH_BUDGET = 32
 const SEARCH_MATCHES_THRESHOLD = 2
 
-var myGossiper *gossiper.Gossiper;
-
 func main() {
 	// Initialize random number generator
 	randomGenerator := rand.New(rand.NewSource(time.Now().UnixNano()))
 	// Load values passed via flags
+	uiHost := flag.String("UIHost", "127.0.0.1", "Host or IP the UI client and GUI listen on")
 	uiPort := flag.String("UIPort", "8080", "Port for the UI client");
-	gossipAddr := flag.String("gossipAddr", "127.0.0.1:5000", "IP:port for the gossiper")
+	gossipAddr := flag.String("gossipAddr", "127.0.0.1:5000", "IP:port for the gossiper, IPv6 as [ip]:port")
 	name := flag.String("name", "Peer"+strconv.Itoa(50000+randomGenerator.Intn(9999)),
 		"Name of the gossiper")
-	peers := flag.String("peers", "", "Comma separated list of peers of the form ip:port")
+	peers := flag.String("peers", "", "Comma separated list of peers of the form ip:port or [ipv6]:port")
 	simple := flag.Bool("simple", false, "Run gossiper in simple broadcast mode")
 	rTimer := flag.Int("rtimer", 0, "Route rumors sending period in seconds, 0 to disable sending of route rumors (default 0)")
+	keyFile := flag.String("keyFile", "", "File with the long-term keys of the gossiper, created if it doesn't exist (default ./_Keys/<name>.key)")
+	unsigned := flag.String("unsigned", "unknown", "What to do with unsigned rumors and status packets: accept, reject, or unknown to accept them only from origins that never signed")
+	streams := flag.Bool("streams", false, "Accept TCP stream connections for bulk chunk transfers on the gossip address")
+	storeFile := flag.String("store", "", "File where rumors, private messages and our rumor IDs are kept across restarts (default ./_Store/<name>.db)")
+	topics := flag.String("topics", "", "Comma separated list of topics to subscribe to")
+	mailboxReplicas := flag.Int("mailboxReplicas", 0, "Number of neighbours that also keep our private messages for unreachable destinations")
+	downloadWindow := flag.Int("downloadWindow", gossiper.DEFAULT_DOWNLOAD_WINDOW, "Number of chunk requests each download keeps outstanding")
+	watchShared := flag.Int("watchShared", 0, "Period in seconds at which the shared files directory is scanned for new, changed and removed files, 0 to disable (default 0)")
+	chunkStoreSize := flag.Int64("chunkStoreSize", 0, "Maximum size in MB of the chunk directory, 0 for no limit (default 0)")
+	chunkEviction := flag.String("chunkEviction", "lru", "Which chunks are evicted first when the chunk directory is full: lru or lfu")
+	scrubRepair := flag.Bool("scrubRepair", false, "Repair the files that lost chunks found corrupt by the scrub at startup")
 	flag.Parse()
 	var peersSlice []string
 	if *peers == "" {
@@ -39,8 +53,13 @@ func main() {
 		peersSlice = strings.Split(*peers, ",")
 	}
 
+	if *storeFile == "" {
+		*storeFile = STORE_DIR + *name + ".db"
+	}
+
 	// Start gossiper
-	myGossiper = gossiper.NewGossiper(
+	myGossiper := gossiper.NewGossiper(
+		*uiHost,
 		*uiPort,
 		*gossipAddr,
 		*name,
@@ -50,11 +69,39 @@ func main() {
 		SHARED_FILES_DIR,
 		CHUNK_FILES_DIR,
 		DOWNLOADED_FILES_DIR,
+		*storeFile,
 		HOP_LIMIT,
 		HASH_SIZE,
 		CHUNK_SIZE,
 		MAX_SEARCH_BUDGET,
 		SEARCH_MATCHES_THRESHOLD,
 	)
+	if *keyFile == "" {
+		*keyFile = KEYS_DIR + *name + ".key"
+	}
+	keys, err := gossiper.LoadOrCreateKeyPair(*keyFile)
+	common.CheckError(err)
+	myGossiper.SetKeyPair(keys)
+	unsignedPolicy, err := gossiper.ParseUnsignedRumorPolicy(*unsigned)
+	common.CheckError(err)
+	myGossiper.SetUnsignedRumorPolicy(unsignedPolicy)
+	myGossiper.SetMailboxReplicas(*mailboxReplicas)
+	myGossiper.SetDownloadWindow(*downloadWindow)
+	myGossiper.SetSharedFilesWatch(*watchShared)
+	evictionPolicy, err := gossiper.ParseEvictionPolicy(*chunkEviction)
+	common.CheckError(err)
+	myGossiper.SetChunkStoreLimit(*chunkStoreSize*1024*1024, evictionPolicy)
+	myGossiper.SetScrubRepair(*scrubRepair)
+	if *topics != "" {
+		for _, topic := range strings.Split(*topics, ",") {
+			myGossiper.Subscribe(strings.TrimSpace(topic))
+		}
+	}
+	if *streams {
+		err := myGossiper.EnableStreams(*gossipAddr)
+		if err != nil {
+			fmt.Println("Streams disabled: " + err.Error())
+		}
+	}
 	myGossiper.Serve()
 }
@@ -0,0 +1,96 @@
+package simulation
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+const POLL_INTERVAL = 100 * time.Millisecond
+
+// Check periodically until the condition holds or the timeout expires
+func (sim *Simulation) WaitUntil(condition func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(POLL_INTERVAL)
+	}
+	return true
+}
+
+// Get the vector clock of a node as a map from origin to next ID
+func (node *Node) VectorClock() map[string]uint32 {
+	clock := make(map[string]uint32)
+	for _, status := range node.Gossiper.Vc.MakeCopy().Want {
+		clock[status.Identifier] = status.NextID
+	}
+	return clock
+}
+
+// Check that all nodes have the same vector clock, returns a description of the first difference found
+func (sim *Simulation) VectorClocksConverged() (bool, string) {
+	clocks := make([]map[string]uint32, len(sim.Nodes))
+	origins := make(map[string]bool)
+	for i, node := range sim.Nodes {
+		clocks[i] = node.VectorClock()
+		for origin := range clocks[i] {
+			origins[origin] = true
+		}
+	}
+	for origin := range origins {
+		for i := 1; i < len(clocks); i++ {
+			// A missing entry is the same as waiting for ID 1
+			first, current := clocks[0][origin], clocks[i][origin]
+			if first == 0 {
+				first = 1
+			}
+			if current == 0 {
+				current = 1
+			}
+			if first != current {
+				return false, fmt.Sprintf("%s wants %d from %s but %s wants %d",
+					sim.Nodes[0].Name, first, origin, sim.Nodes[i].Name, current)
+			}
+		}
+	}
+	return true, ""
+}
+
+// Wait until all vector clocks converge, returns an error describing the difference otherwise
+func (sim *Simulation) WaitForConvergence(timeout time.Duration) error {
+	difference := ""
+	converged := sim.WaitUntil(func() bool {
+		var ok bool
+		ok, difference = sim.VectorClocksConverged()
+		return ok
+	}, timeout)
+	if !converged {
+		return fmt.Errorf("vector clocks did not converge after %s: %s", timeout, difference)
+	}
+	return nil
+}
+
+// Check that a node knows a route to the node named destination
+func (sim *Simulation) HasRoute(from, destination string) bool {
+	return sim.Node(from).Gossiper.GetNextHop(destination) != ""
+}
+
+// Check that a file was reconstructed in the downloads folder of a node with the expected content
+func (sim *Simulation) FileReconstructed(at, fileName string, content []byte) bool {
+	data, err := ioutil.ReadFile(sim.Node(at).DownloadedFilesDir + fileName)
+	return err == nil && bytes.Equal(data, content)
+}
+
+// Wait until a file is reconstructed at a node, returns an error otherwise
+func (sim *Simulation) WaitForFile(at, fileName string, content []byte, timeout time.Duration) error {
+	reconstructed := sim.WaitUntil(func() bool {
+		return sim.FileReconstructed(at, fileName, content)
+	}, timeout)
+	if !reconstructed {
+		return fmt.Errorf("file %s was not reconstructed at %s after %s", fileName, at, timeout)
+	}
+	return nil
+}
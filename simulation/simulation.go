@@ -0,0 +1,415 @@
+package simulation
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/eliasmpw/Peerster/gossiper"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const DEFAULT_BASE_DIR = "./_Simulation/"
+const DEFAULT_HOP_LIMIT = 10
+const DEFAULT_HASH_SIZE = 256
+const DEFAULT_CHUNK_SIZE = 8192
+const DEFAULT_MAX_SEARCH_BUDGET = 32
+const DEFAULT_SEARCH_MATCHES_THRESHOLD = 2
+const FIRST_GOSSIP_PORT = 5000
+
+// Latency and loss applied to the datagrams of a link
+type LinkConfig struct {
+	Latency time.Duration
+	// Random extra delay between 0 and Jitter
+	Jitter time.Duration
+	// Probability between 0 and 1 of dropping a datagram
+	Loss float64
+}
+
+type Config struct {
+	Nodes           int
+	Topology        Topology
+	EdgeProbability float64
+	// Default conditions of every link, can be changed per link with SetLink
+	Link LinkConfig
+	// Route rumors period in seconds, 0 disables them as in the command line
+	RouteRumorTimer int
+	Mining          bool
+	// Keep the messages of every node on disk, so they survive a Restart
+	Persistent bool
+	// Number of neighbours that keep the private messages of a node for unreachable destinations
+	MailboxReplicas int
+	// Number of chunk requests each download keeps outstanding, 0 for the gossiper default
+	DownloadWindow int
+	// Period in seconds at which every node scans its shared folder, 0 to disable the watcher
+	WatchSharedFiles int
+	// Maximum size in bytes of the chunk directory of every node, 0 for no limit
+	ChunkStoreSize int64
+	ChunkEviction  gossiper.EvictionPolicy
+	// Repair the files damaged by corrupt chunks found by the scrub at the start of every node
+	ScrubRepair bool
+	// Relative directory under which every node gets its own files directories
+	BaseDir string
+	Seed    int64
+}
+
+// A gossiper running inside the simulation
+type Node struct {
+	Name               string
+	Address            string
+	Neighbors          []string
+	Gossiper           *gossiper.Gossiper
+	SharedFilesDir     string
+	ChunkFilesDir      string
+	DownloadedFilesDir string
+	StoreFile          string
+	// Kept across restarts, so peers still accept the rumors of the node
+	keys *gossiper.KeyPair
+}
+
+type Simulation struct {
+	config     Config
+	network    *gossiper.MemoryNetwork
+	Nodes      []*Node
+	nodesByKey map[string]*Node
+	links      map[[2]string]LinkConfig
+	partitions map[string]int
+	random     *rand.Rand
+	mutex      *sync.Mutex
+	wait       *sync.WaitGroup
+}
+
+// Create the nodes of a simulation, they don't exchange packets until Start is called
+func New(config Config) (*Simulation, error) {
+	if config.Nodes <= 0 {
+		return nil, errors.New("simulation needs at least one node")
+	}
+	if config.BaseDir == "" {
+		config.BaseDir = DEFAULT_BASE_DIR
+	}
+	if config.Seed == 0 {
+		config.Seed = time.Now().UnixNano()
+	}
+	sim := &Simulation{
+		config:     config,
+		network:    gossiper.NewMemoryNetwork(),
+		Nodes:      make([]*Node, 0, config.Nodes),
+		nodesByKey: make(map[string]*Node),
+		links:      make(map[[2]string]LinkConfig),
+		partitions: make(map[string]int),
+		random:     rand.New(rand.NewSource(config.Seed)),
+		mutex:      &sync.Mutex{},
+		wait:       &sync.WaitGroup{},
+	}
+	edges := buildEdges(config.Topology, config.Nodes, config.EdgeProbability, sim.random)
+	for i := 0; i < config.Nodes; i++ {
+		name := fmt.Sprintf("node%d", i)
+		nodeDir := config.BaseDir + name + "/"
+		node := &Node{
+			Name:               name,
+			Address:            fmt.Sprintf("127.0.0.1:%d", FIRST_GOSSIP_PORT+i),
+			SharedFilesDir:     nodeDir + "_SharedFiles/",
+			ChunkFilesDir:      nodeDir + "_SharedFiles/Chunks/",
+			DownloadedFilesDir: nodeDir + "_Downloads/",
+		}
+		if config.Persistent {
+			node.StoreFile = nodeDir + "_Store/messages.db"
+		}
+		sim.Nodes = append(sim.Nodes, node)
+		sim.nodesByKey[node.Name] = node
+		sim.nodesByKey[node.Address] = node
+	}
+	for i, node := range sim.Nodes {
+		for _, j := range edges[i] {
+			node.Neighbors = append(node.Neighbors, sim.Nodes[j].Address)
+		}
+		err := sim.createGossiper(node)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sim.network.SetLinkPolicy(sim.linkPolicy)
+	return sim, nil
+}
+
+func (sim *Simulation) createGossiper(node *Node) error {
+	transport, err := sim.network.NewTransport(node.Address)
+	if err != nil {
+		return err
+	}
+	node.Gossiper = gossiper.NewGossiperWithTransport(
+		transport,
+		"127.0.0.1",
+		"0",
+		node.Address,
+		node.Name,
+		append([]string{}, node.Neighbors...),
+		false,
+		sim.config.RouteRumorTimer,
+		node.SharedFilesDir,
+		node.ChunkFilesDir,
+		node.DownloadedFilesDir,
+		node.StoreFile,
+		DEFAULT_HOP_LIMIT,
+		DEFAULT_HASH_SIZE,
+		DEFAULT_CHUNK_SIZE,
+		DEFAULT_MAX_SEARCH_BUDGET,
+		DEFAULT_SEARCH_MATCHES_THRESHOLD,
+	)
+	if node.keys == nil {
+		node.keys, err = gossiper.NewKeyPair()
+		if err != nil {
+			return err
+		}
+	}
+	node.Gossiper.SetKeyPair(node.keys)
+	node.Gossiper.SetMailboxReplicas(sim.config.MailboxReplicas)
+	node.Gossiper.SetDownloadWindow(sim.config.DownloadWindow)
+	node.Gossiper.SetSharedFilesWatch(sim.config.WatchSharedFiles)
+	node.Gossiper.SetChunkStoreLimit(sim.config.ChunkStoreSize, sim.config.ChunkEviction)
+	node.Gossiper.SetScrubRepair(sim.config.ScrubRepair)
+	return nil
+}
+
+// Start the goroutines of every node, the GUI is not served
+func (sim *Simulation) Start() {
+	for _, node := range sim.Nodes {
+		sim.startNode(node)
+	}
+}
+
+func (sim *Simulation) startNode(node *Node) {
+	gsspr := node.Gossiper
+	if sim.config.Mining {
+		sim.wait.Add(9)
+		gsspr.StartMining(sim.wait)
+	} else {
+		sim.wait.Add(8)
+	}
+	gsspr.StartListeningGossip(sim.wait)
+	gsspr.StartGossipSender(sim.wait)
+	gsspr.StartRouteRumoring(sim.wait)
+	gsspr.StartAntiEntropy(sim.wait)
+	gsspr.StartMailboxCleaner(sim.wait)
+	gsspr.StartResumingDownloads(sim.wait)
+	gsspr.StartWatchingSharedFiles(sim.wait)
+	gsspr.StartScrubbingChunks(sim.wait)
+}
+
+// Stop a node and start a new gossiper in its place, with the same name and address.
+// Only what the node kept on disk survives, see Config.Persistent
+func (sim *Simulation) Restart(key string) error {
+	node := sim.Node(key)
+	if node == nil {
+		return errors.New("unknown node " + key)
+	}
+	node.Gossiper.Stop()
+	err := sim.createGossiper(node)
+	if err != nil {
+		return err
+	}
+	sim.startNode(node)
+	return nil
+}
+
+// Stop every node of the simulation and wait for their goroutines to return
+func (sim *Simulation) Stop() {
+	for _, node := range sim.Nodes {
+		node.Gossiper.Stop()
+	}
+	sim.wait.Wait()
+}
+
+// Remove the files written by the nodes
+func (sim *Simulation) Cleanup() error {
+	return os.RemoveAll(sim.config.BaseDir)
+}
+
+// Get a node by name or address
+func (sim *Simulation) Node(key string) *Node {
+	return sim.nodesByKey[key]
+}
+
+// Change the conditions of the link between two nodes, in both directions
+func (sim *Simulation) SetLink(a, b string, link LinkConfig) {
+	nodeA, nodeB := sim.Node(a), sim.Node(b)
+	if nodeA == nil || nodeB == nil {
+		return
+	}
+	sim.mutex.Lock()
+	sim.links[[2]string{nodeA.Address, nodeB.Address}] = link
+	sim.links[[2]string{nodeB.Address, nodeA.Address}] = link
+	sim.mutex.Unlock()
+}
+
+// Split the network, nodes in different groups can't reach each other.
+// Nodes not listed in any group form one more group together
+func (sim *Simulation) Partition(groups ...[]string) {
+	sim.mutex.Lock()
+	sim.partitions = make(map[string]int)
+	for i, group := range groups {
+		for _, key := range group {
+			if node := sim.nodesByKey[key]; node != nil {
+				sim.partitions[node.Address] = i + 1
+			}
+		}
+	}
+	sim.mutex.Unlock()
+}
+
+// Remove all partitions
+func (sim *Simulation) Heal() {
+	sim.Partition()
+}
+
+func (sim *Simulation) linkPolicy(source, destination string) (time.Duration, bool) {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	if sim.partitions[source] != sim.partitions[destination] {
+		return 0, true
+	}
+	link, exists := sim.links[[2]string{source, destination}]
+	if !exists {
+		link = sim.config.Link
+	}
+	if link.Loss > 0 && sim.random.Float64() < link.Loss {
+		return 0, true
+	}
+	delay := link.Latency
+	if link.Jitter > 0 {
+		delay += time.Duration(sim.random.Int63n(int64(link.Jitter)))
+	}
+	return delay, false
+}
+
+// Client actions
+
+// Gossip a rumor from a node, as the client of the node would
+func (sim *Simulation) SendRumor(from, text string) {
+	sim.Node(from).Gossiper.HandleClientPacket(&gossiper.GossipPacket{
+		Simple: &gossiper.SimpleMessage{
+			Contents: text,
+		},
+	})
+}
+
+// Gossip a rumor with a topic from a node, the node subscribes to the topic
+func (sim *Simulation) Publish(from, topic, text string) {
+	sim.Node(from).Gossiper.HandleClientPacket(&gossiper.GossipPacket{
+		Rumor: &gossiper.RumorMessage{
+			Text:  text,
+			Topic: topic,
+		},
+	})
+}
+
+// Send a private message from a node to the node named destination
+func (sim *Simulation) SendPrivate(from, destination, text string) {
+	sim.Node(from).Gossiper.HandleClientPacket(&gossiper.GossipPacket{
+		Private: &gossiper.PrivateMessage{
+			Text:        text,
+			Destination: destination,
+			HopLimit:    DEFAULT_HOP_LIMIT,
+		},
+	})
+}
+
+// Write a file in the shared folder of a node and index it, returns the metafile hash
+func (sim *Simulation) ShareFile(from, fileName string, content []byte) ([]byte, error) {
+	node := sim.Node(from)
+	if node == nil {
+		return nil, errors.New("unknown node " + from)
+	}
+	err := os.MkdirAll(node.SharedFilesDir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	err = writeFile(node.SharedFilesDir+fileName, content)
+	if err != nil {
+		return nil, err
+	}
+	node.Gossiper.HandleClientPacket(&gossiper.GossipPacket{
+		Simple: &gossiper.SimpleMessage{
+			OriginalName:  "file",
+			RelayPeerAddr: "file",
+			Contents:      fileName,
+		},
+	})
+	metaFileHash := sha256.Sum256(metaFileOf(content))
+	return metaFileHash[:], nil
+}
+
+// Write files in a folder of the shared folder of a node and share the folder, files are given
+// by path relative to the folder, separated by slashes. Returns the hash of the manifest
+func (sim *Simulation) ShareDirectory(from, dirName string, files map[string][]byte) ([]byte, error) {
+	node := sim.Node(from)
+	if node == nil {
+		return nil, errors.New("unknown node " + from)
+	}
+	manifest := gossiper.Manifest{}
+	for path, content := range files {
+		filePath := filepath.Join(node.SharedFilesDir, dirName, filepath.FromSlash(path))
+		err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+		err = writeFile(filePath, content)
+		if err != nil {
+			return nil, err
+		}
+		metaFileHash := sha256.Sum256(metaFileOf(content))
+		manifest.Entries = append(manifest.Entries, gossiper.ManifestEntry{
+			Path:         path,
+			Size:         uint64(len(content)),
+			MetafileHash: metaFileHash[:],
+		})
+	}
+	sort.Slice(manifest.Entries, func(i, j int) bool {
+		return manifest.Entries[i].Path < manifest.Entries[j].Path
+	})
+	node.Gossiper.HandleClientPacket(&gossiper.GossipPacket{
+		Simple: &gossiper.SimpleMessage{
+			OriginalName:  "file",
+			RelayPeerAddr: "file",
+			Contents:      dirName,
+		},
+	})
+	content, err := gossiper.EncodeManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	manifestHash := sha256.Sum256(metaFileOf(content))
+	return manifestHash[:], nil
+}
+
+// Metafile the gossipers build for a file
+func metaFileOf(content []byte) []byte {
+	return gossiper.BuildMetaFile(
+		gossiper.CreateChunkHashes(gossiper.SplitToChunks(content, DEFAULT_CHUNK_SIZE)), DEFAULT_HASH_SIZE)
+}
+
+// Start downloading a file from the node named origin, returns without waiting for the download
+func (sim *Simulation) DownloadFile(to, origin, fileName string, metaFileHash []byte) {
+	go sim.Node(to).Gossiper.HandleClientPacket(&gossiper.GossipPacket{
+		DataRequest: &gossiper.DataRequest{
+			Destination: origin,
+			HopLimit:    DEFAULT_HOP_LIMIT,
+			HashValue:   metaFileHash,
+			FileName:    fileName,
+		},
+	})
+}
+
+func writeFile(path string, content []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(content)
+	return err
+}
@@ -0,0 +1,66 @@
+package simulation
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRumorsConvergeOnLine(t *testing.T) {
+	sim, err := New(Config{
+		Nodes:    5,
+		Topology: Line,
+		BaseDir:  "./_SimulationLine/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Cleanup()
+	sim.Start()
+	defer sim.Stop()
+
+	sim.SendRumor("node0", "first")
+	sim.SendRumor("node4", "last")
+	err = sim.WaitForConvergence(30 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every node got the rumors of both ends of the line, they also give routes to their origins
+	for _, node := range sim.Nodes {
+		clock := node.VectorClock()
+		if clock["node0"] != 2 || clock["node4"] != 2 {
+			t.Errorf("%s wants %d from node0 and %d from node4", node.Name, clock["node0"], clock["node4"])
+		}
+	}
+	if !sim.WaitUntil(func() bool {
+		return sim.HasRoute("node0", "node4") && sim.HasRoute("node4", "node0")
+	}, 10*time.Second) {
+		t.Error("no route between the ends of the line")
+	}
+}
+
+func TestStopWaitsForNodes(t *testing.T) {
+	sim, err := New(Config{
+		Nodes:           3,
+		Topology:        Ring,
+		RouteRumorTimer: 1,
+		BaseDir:         "./_SimulationStop/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Cleanup()
+	sim.Start()
+	sim.SendRumor("node0", "before stopping")
+	time.Sleep(500 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		sim.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("goroutines of the nodes still running after Stop")
+	}
+}
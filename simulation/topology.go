@@ -0,0 +1,61 @@
+package simulation
+
+import (
+	"math/rand"
+)
+
+type Topology int
+
+const (
+	// Every node is connected to the previous and the next one, the last one closes the ring
+	Ring Topology = iota
+	// Like a ring without the link between the last and the first node
+	Line
+	// The first node is connected to every other node
+	Star
+	// Random connected graph, extra links are added with Config.EdgeProbability
+	RandomGraph
+)
+
+// Build the adjacency list of n nodes for the given topology
+func buildEdges(topology Topology, n int, edgeProbability float64, random *rand.Rand) [][]int {
+	edges := make([][]int, n)
+	connected := make(map[[2]int]bool)
+	connect := func(a, b int) {
+		if a == b || connected[[2]int{a, b}] {
+			return
+		}
+		connected[[2]int{a, b}] = true
+		connected[[2]int{b, a}] = true
+		edges[a] = append(edges[a], b)
+		edges[b] = append(edges[b], a)
+	}
+	switch topology {
+	case Ring:
+		for i := 0; i < n; i++ {
+			connect(i, (i+1)%n)
+		}
+	case Line:
+		for i := 0; i+1 < n; i++ {
+			connect(i, i+1)
+		}
+	case Star:
+		for i := 1; i < n; i++ {
+			connect(0, i)
+		}
+	case RandomGraph:
+		// Random spanning tree first so the graph is always connected
+		order := random.Perm(n)
+		for i := 1; i < n; i++ {
+			connect(order[i], order[random.Intn(i)])
+		}
+		for i := 0; i < n; i++ {
+			for j := i + 1; j < n; j++ {
+				if random.Float64() < edgeProbability {
+					connect(i, j)
+				}
+			}
+		}
+	}
+	return edges
+}